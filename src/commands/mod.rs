@@ -1,6 +1,12 @@
+use std::collections::BTreeMap;
 use std::fs;
-use std::path::Path;
-use std::io::{self, Write};
+use std::path::{Component, Path, PathBuf};
+use std::io::{self, IsTerminal, Write};
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::thread;
+use std::time::Duration;
+
+use regex::Regex;
 
 use crate::utils;
 
@@ -16,12 +22,69 @@ fn color_string(s: &str, color_code: &str) -> String {
     format!("{}{}{}", color_code, s, RESET)
 }
 
+// InitOptions controls how HandleInit writes the default AGENTS.md file
+#[derive(Debug, Default)]
+pub struct InitOptions {
+    // Overwrite an existing AGENTS.md without prompting for confirmation
+    pub force: bool,
+    // Set the written file's permissions to this mode
+    pub chmod: Option<u32>,
+    // Append this file's content after the template, or after the "# AGENTS" header in place of the built-in template's sections
+    pub append: Option<PathBuf>,
+    // Build the template from answers to a few questions when run in a terminal
+    pub interactive: bool,
+    // Write the template even if it holds nothing but the "# AGENTS" header
+    pub allow_empty: bool,
+}
+
+// Template init writes when no content is supplied, with sections to fill in
+const DEFAULT_TEMPLATE: &str = "# AGENTS\n\n## Project\n\n- Describe what the project does and how it is laid out\n\n## Testing\n\n- Name the command that runs the tests\n";
+
 // HandleInit creates a default AGENTS.md file in the current directory if one doesn't exist
-pub fn handle_init(force: bool) -> Result<(), Box<dyn std::error::Error>> {
+pub fn handle_init(options: &InitOptions) -> Result<(), Box<dyn std::error::Error>> {
     let agents_file_path = Path::new("AGENTS.md");
+    utils::ensure_safe_target(Path::new("."))?;
+
+    // Content to write to the AGENTS.md file - the built-in template unless the user supplies their own
+    let mut agents_content = String::from(DEFAULT_TEMPLATE);
+    let mut built_in = true;
+    if options.interactive {
+        if io::stdin().is_terminal() {
+            agents_content = interactive_template(&mut io::stdin().lock(), &mut io::stdout())?;
+            built_in = false;
+        } else {
+            utils::log_info("Standard input is not a terminal, using the default template");
+        }
+    }
+
+    // Build and check the combined content before asking to overwrite anything
+    if let Some(append_path) = &options.append {
+        let (err, snippet) = utils::read_file(append_path);
+        if let Some(error) = err {
+            return Err(format!("Could not read {}: {}", append_path.display(), error).into());
+        }
+        // The snippet takes the place of the built-in template's placeholder sections
+        let base = if built_in { "# AGENTS" } else { agents_content.trim_end() };
+        agents_content = format!("{}\n\n{}", base, snippet);
+        utils::log_info(&format!("Appended content from: {}", append_path.display()));
+
+        let issues = utils::validate_agents(&agents_content);
+        let errors: Vec<&str> = issues
+            .iter()
+            .filter(|issue| issue.severity == utils::Severity::Error)
+            .map(|issue| issue.message.as_str())
+            .collect();
+        if !errors.is_empty() {
+            return Err(format!("Combined AGENTS.md content is invalid: {}", errors.join("; ")).into());
+        }
+    }
+
+    if utils::is_header_only(&agents_content) && !options.allow_empty {
+        return Err("The AGENTS.md template holds nothing but the '# AGENTS' header. Add a body to it, or pass --allow-empty to write it anyway.".into());
+    }
 
     // Check if we need user confirmation
-    let needs_confirmation = utils::file_exists(agents_file_path) && !force;
+    let needs_confirmation = utils::file_exists(agents_file_path) && !options.force;
     if needs_confirmation {
         // Prompt user for confirmation before overwriting
         println!(
@@ -47,21 +110,89 @@ pub fn handle_init(force: bool) -> Result<(), Box<dyn std::error::Error>> {
         utils::log_info("No existing AGENTS.md or force is true, proceeding with init");
     }
 
-    // Content to write to the AGENTS.md file - initialize with just the header for an empty template
-    let agents_content = "# AGENTS\n\n\n";
-
-    if let Some(error) = utils::write_file(agents_file_path, agents_content) {
+    if let Some(error) = utils::write_file(agents_file_path, &agents_content) {
         return Err(error);
     }
+    if let Some(mode) = options.chmod {
+        utils::set_file_mode(agents_file_path, mode)?;
+        utils::log_info(&format!("Set AGENTS.md mode to {:04o}", mode));
+    }
     utils::log_info("Created AGENTS.md file");
     println!("{} AGENTS.md", color_string("Created", GREEN));
 
     Ok(())
 }
 
+// CleanOptions controls how HandleClean removes the AGENTS.md file
+#[derive(Debug, Default)]
+pub struct CleanOptions {
+    // Stash the file first and only remove it if that succeeds
+    pub stash_first: bool,
+    // Stash under this name instead of the project's name
+    pub name: Option<String>,
+    // Only remove the file if the project's stash holds the same content
+    pub only_if_stashed: bool,
+}
+
+// interactive_template asks about the project on output, reads the answers from input and builds an
+// AGENTS.md from them. Sections whose question was left blank are omitted.
+fn interactive_template(input: &mut dyn io::BufRead, output: &mut dyn Write) -> Result<String, Box<dyn std::error::Error>> {
+    let mut ask = |question: &str| -> Result<String, Box<dyn std::error::Error>> {
+        write!(output, "{}: ", color_string(question, BOLD))?;
+        output.flush()?;
+        read_input_line(input)
+    };
+    let project_type = ask("Project type (e.g. Rust CLI, React web app)")?;
+    let test_command = ask("Command that runs the tests (e.g. cargo test)")?;
+    let style = ask("Style preferences, separated by commas")?;
+
+    let mut content = String::from("# AGENTS\n");
+    if !project_type.is_empty() {
+        content.push_str(&format!("\n## Project\n\nThis is a {} project.\n", project_type));
+    }
+    if !test_command.is_empty() {
+        content.push_str(&format!("\n## Testing\n\n- Run `{}` and make sure it passes before finishing a change.\n", test_command));
+    }
+    let preferences: Vec<&str> = style.split(',').map(str::trim).filter(|p| !p.is_empty()).collect();
+    if !preferences.is_empty() {
+        content.push_str("\n## Style\n\n");
+        for preference in preferences {
+            content.push_str(&format!("- {}\n", preference));
+        }
+    }
+
+    if !utils::is_valid_agents(&content) {
+        return Err("Generated AGENTS.md content is invalid".into());
+    }
+    Ok(content)
+}
+
 // HandleClean removes the AGENTS.md file from the current directory if it exists
-pub fn handle_clean() -> Result<(), Box<dyn std::error::Error>> {
+pub fn handle_clean(options: &CleanOptions) -> Result<(), Box<dyn std::error::Error>> {
     let agents_file_path = Path::new("AGENTS.md");
+    utils::ensure_safe_target(Path::new("."))?;
+
+    if (options.stash_first || options.only_if_stashed) && utils::file_exists(agents_file_path) {
+        let stash_name = match &options.name {
+            Some(name) => name.clone(),
+            None => utils::get_project_root()?
+                .file_name()
+                .and_then(|name| name.to_str())
+                .ok_or("Could not extract project name")?
+                .to_string(),
+        };
+
+        let (err, content) = utils::read_file(agents_file_path);
+        if let Some(error) = err {
+            return Err(error);
+        }
+        if options.only_if_stashed {
+            ensure_stashed(&stash_name, &content)?;
+        } else if !store_stash(&stash_name, content, &StashOptions::default())? {
+            println!("{} was not removed.", color_string("AGENTS.md", BOLD));
+            return Ok(());
+        }
+    }
 
     if utils::file_exists(agents_file_path) {
         fs::remove_file(agents_file_path)?;
@@ -79,203 +210,5865 @@ pub fn handle_clean() -> Result<(), Box<dyn std::error::Error>> {
     Ok(())
 }
 
+// ensure_stashed fails unless the named stash exists and has the same checksum as content. Provenance
+// stamps are ignored, since stashing strips them.
+fn ensure_stashed(stash_name: &str, content: &str) -> Result<(), Box<dyn std::error::Error>> {
+    let stash_path = utils::get_stashes_dir()?.join(utils::stash_file_name(stash_name));
+    if !utils::file_exists(&stash_path) {
+        return Err(format!(
+            "No stash found for {}; AGENTS.md was not removed. Run 'agstash stash' first or use --stash-first.",
+            stash_name
+        )
+        .into());
+    }
+    // A linked stash is the local file itself, so it would always match and removing the file would lose it
+    if utils::is_symlink(&stash_path) {
+        return Err(format!(
+            "The stash for {} is a link to AGENTS.md, not a copy; AGENTS.md was not removed. Run 'agstash stash' without --link first.",
+            stash_name
+        )
+        .into());
+    }
+
+    let local_checksum = utils::content_checksum(utils::strip_provenance(content).as_bytes());
+    let stash_checksum = utils::reader_checksum(&mut utils::open_stash_reader(stash_name)?)?;
+    if local_checksum != stash_checksum {
+        return Err(format!(
+            "AGENTS.md differs from the stash for {} (SHA-256 {} locally, {} stashed); AGENTS.md was not removed. Run 'agstash stash' to update the stash first.",
+            stash_name, local_checksum, stash_checksum
+        )
+        .into());
+    }
+
+    utils::log_info(&format!("AGENTS.md matches the stash at: {}", stash_path.display()));
+    Ok(())
+}
+
+// StashOptions controls how HandleStash reads and stores the AGENTS.md file
+#[derive(Debug, Default)]
+pub struct StashOptions {
+    // Remove HTML comments from the stashed copy while leaving the local file untouched
+    pub strip_comments: bool,
+    // Take the stash content from the system clipboard instead of the local file
+    pub from_clipboard: bool,
+    // Stash from this directory without project root detection, naming the stash after it
+    pub force_dir: Option<PathBuf>,
+    // Keep running and re-stash the local AGENTS.md whenever it changes
+    pub watch: bool,
+    // Only stash if AGENTS.md changed since this git ref
+    pub since_commit: Option<String>,
+    // Leave these sections (by heading title) out of the stashed copy
+    pub exclude_sections: Vec<String>,
+    // Store the stash read-only (0444) so later stashes refuse to overwrite it
+    pub read_only: bool,
+    // Overwrite the stash even if it is read-only
+    pub force: bool,
+    // Stash invalid content anyway, warning about it and failing once it is stored
+    pub quiet_validate: bool,
+    // Refuse to stash content that has validation warnings, such as bullet style violations
+    pub lint: bool,
+    // Hard-link the stash to another project's byte-identical stash instead of storing a second copy
+    pub dedupe_global: bool,
+    // Name the stash after the origin remote (owner/repo) rather than the project directory
+    pub project_from_gitconfig: bool,
+    // Store the stash as a symbolic link to the project's AGENTS.md so it tracks the live file
+    pub link: bool,
+    // Re-read the written stash and fail unless it matches the stashed content and still validates
+    pub verify: bool,
+    // Require "# AGENTS" to be the very first line of the stashed content
+    pub strict_header: bool,
+    // Trim anything before the "# AGENTS" header so it becomes the first line
+    pub normalize_header: bool,
+    // Fire-and-forget mode for editor hooks: stash quietly when the content is valid and changed,
+    // skip otherwise, and never fail
+    pub auto: bool,
+    // With auto, still log what the stash does instead of staying silent
+    pub verbose: bool,
+}
+
 // HandleStash reads the AGENTS.md file from the project root and copies it to a global stash location
-pub fn handle_stash() -> Result<(), Box<dyn std::error::Error>> {
-    let root = utils::get_project_root()?;
+pub fn handle_stash(options: &StashOptions) -> Result<(), Box<dyn std::error::Error>> {
+    if options.auto {
+        // Editor hooks run on every save, so auto stashes print nothing unless --verbose asks for the log
+        let previous = if options.verbose { None } else { Some(utils::set_log_output(Some(Box::new(io::sink())))) };
+        if let Err(error) = stash_project(options) {
+            utils::log_info(&format!("Auto stash skipped: {}", error));
+        }
+        if let Some(previous) = previous {
+            utils::set_log_output(previous);
+        }
+        return Ok(());
+    }
+    stash_project(options)
+}
+
+// stash_project stashes the project's AGENTS.md as HandleStash describes
+fn stash_project(options: &StashOptions) -> Result<(), Box<dyn std::error::Error>> {
+    let root = match &options.force_dir {
+        Some(dir) => resolve_force_dir(dir)?,
+        None => utils::get_project_root()?,
+    };
 
     utils::log_info(&format!("Found project root at: {}", root.display()));
 
-    let project_name = root
-        .file_name()
-        .and_then(|name| name.to_str())
-        .ok_or("Could not extract project name")?;
+    let project_name = resolve_project_name(&root, options.project_from_gitconfig)?;
+    let project_name = project_name.as_str();
 
     let agents_path = root.join("AGENTS.md");
 
-    if !utils::file_exists(&agents_path) {
-        utils::log_info(&format!("AGENTS.md does not exist in project root: {}", agents_path.display()));
+    if options.watch {
+        return watch_stash(&agents_path, project_name, options, &AtomicBool::new(false), WATCH_POLL_INTERVAL);
+    }
+
+    if let Some(git_ref) = &options.since_commit {
+        match utils::git_file_changed_since(&root, git_ref, "AGENTS.md") {
+            Ok(false) => {
+                utils::log_info(&format!("AGENTS.md unchanged since {}, skipping stash", git_ref));
+                if !options.auto {
+                    println!(
+                        "{} has not changed since {}. Stash skipped.",
+                        color_string("AGENTS.md", BOLD),
+                        color_string(git_ref, BOLD)
+                    );
+                }
+                return Ok(());
+            }
+            Ok(true) => utils::log_info(&format!("AGENTS.md changed since {}", git_ref)),
+            Err(error) => utils::log_warn(&format!("Could not compare AGENTS.md with {}, stashing anyway: {}", git_ref, error)),
+        }
+    }
+
+    let agents_content = if options.from_clipboard {
+        utils::log_info("Reading stash content from clipboard");
+        utils::read_clipboard()?
+    } else {
+        if !utils::file_exists(&agents_path) {
+            utils::log_info(&format!("AGENTS.md does not exist in project root: {}", agents_path.display()));
+            if !options.auto {
+                println!(
+                    "{} {}",
+                    color_string("AGENTS.md", BOLD),
+                    color_string("does not exist in project root.", YELLOW)
+                );
+            }
+            return Ok(());
+        }
+
+        let (err, content) = utils::read_file(&agents_path);
+        if let Some(error) = err {
+            return Err(error);
+        }
+        content
+    };
+
+    if options.link {
+        return link_stash(project_name, &agents_path, &agents_content, options);
+    }
+    store_stash(project_name, agents_content, options)?;
+    Ok(())
+}
+
+// link_stash stores the project's stash as a symbolic link to agents_path, once its current content
+// has been checked like a copied stash would be
+fn link_stash(project_name: &str, agents_path: &Path, agents_content: &str, options: &StashOptions) -> Result<(), Box<dyn std::error::Error>> {
+    if !utils::is_valid_agents(agents_content) {
+        utils::log_warn("AGENTS.md content is invalid, stash aborted");
+        if !options.auto {
+            println!(
+                "{} {}",
+                color_string("AGENTS.md content is invalid (missing '# AGENTS' header).", YELLOW),
+                color_string("Stash aborted.", YELLOW)
+            );
+        }
+        return Ok(());
+    }
+    if options.lint {
+        reject_validation_warnings(agents_content, "AGENTS.md", "stash", !options.auto)?;
+    }
+
+    let stash_path = utils::get_stash_path(project_name)?;
+    if !options.force && is_read_only_stash(&stash_path)? {
+        return Err(format!("Stash for {} is read-only; use --force to overwrite it", project_name).into());
+    }
+
+    // An absolute target keeps the link valid wherever it is read from
+    let target = fs::canonicalize(agents_path)?;
+    utils::log_info(&format!("Linking {} to {}", stash_path.display(), target.display()));
+    utils::replace_with_symlink(&target, &stash_path)?;
+    if !options.auto {
         println!(
-            "{} {}",
-            color_string("AGENTS.md", BOLD),
-            color_string("does not exist in project root.", YELLOW)
+            "{} AGENTS.md for {}",
+            color_string("Linked", GREEN),
+            color_string(project_name, BOLD)
         );
-        return Ok(());
     }
+    Ok(())
+}
 
-    let (err, agents_content) = utils::read_file(&agents_path);
-    if let Some(error) = err {
-        return Err(error);
+// resolve_project_name names the project at root after its directory or, when from_gitconfig is set
+// and the repository has an origin remote, after the remote's owner/repo
+fn resolve_project_name(root: &Path, from_gitconfig: bool) -> Result<String, Box<dyn std::error::Error>> {
+    if from_gitconfig {
+        match utils::git_remote_project(root)? {
+            Some(name) => {
+                utils::log_info(&format!("Using project name from remote.origin.url: {}", name));
+                return Ok(name);
+            }
+            None => utils::log_info("No usable remote.origin.url, naming the project after its directory"),
+        }
+    }
+
+    let name = root
+        .file_name()
+        .and_then(|name| name.to_str())
+        .ok_or("Could not extract project name")?;
+    Ok(name.to_string())
+}
+
+// store_stash strips and validates the content as the options ask and writes it as the project's
+// stash, returning false if the content was invalid and nothing was stored. With quiet_validate,
+// invalid content is stored and then reported as an error.
+fn store_stash(project_name: &str, mut agents_content: String, options: &StashOptions) -> Result<bool, Box<dyn std::error::Error>> {
+    let unstamped = utils::strip_provenance(&agents_content);
+    if unstamped != agents_content {
+        agents_content = unstamped;
+        utils::log_info("Stripped apply provenance stamp from stash content");
+    }
+    if options.strip_comments {
+        agents_content = utils::strip_html_comments(&agents_content);
+        utils::log_info("Stripped HTML comments from stash content");
+    }
+    if !options.exclude_sections.is_empty() {
+        agents_content = exclude_sections(&agents_content, &options.exclude_sections);
+    }
+    if options.normalize_header {
+        agents_content = utils::normalize_header(&agents_content);
+    }
+    if options.strict_header {
+        check_strict_header(&agents_content, "AGENTS.md")?;
     }
 
-    if !utils::is_valid_agents(&agents_content) {
+    let valid = utils::is_valid_agents(&agents_content);
+    if !valid && options.quiet_validate {
+        utils::log_warn("AGENTS.md content is invalid, stashing it anyway");
+        println!(
+            "{} {}",
+            color_string("AGENTS.md content is invalid (missing '# AGENTS' header).", YELLOW),
+            color_string("Stashing anyway.", YELLOW)
+        );
+    } else if !valid && options.auto {
+        utils::log_info("AGENTS.md content is invalid, skipping auto stash");
+        return Ok(false);
+    } else if !valid {
         utils::log_warn("AGENTS.md content is invalid, stash aborted");
         println!(
             "{} {}",
             color_string("AGENTS.md content is invalid (missing '# AGENTS' header).", YELLOW),
             color_string("Stash aborted.", YELLOW)
         );
-        return Ok(());
+        return Ok(false);
+    }
+
+    if options.lint && valid {
+        reject_validation_warnings(&agents_content, "AGENTS.md", "stash", !options.auto)?;
     }
 
     let stash_path = utils::get_stash_path(project_name)?;
+    if options.auto && utils::file_exists(&stash_path) {
+        let (err, stashed) = utils::read_file(&stash_path);
+        if err.is_none() && stashed == agents_content {
+            utils::log_info("AGENTS.md is unchanged since the last stash, skipping auto stash");
+            return Ok(true);
+        }
+    }
+    if !options.force && is_read_only_stash(&stash_path)? {
+        return Err(format!("Stash for {} is read-only; use --force to overwrite it", project_name).into());
+    }
 
     utils::log_info(&format!("Stashing to path: {}", stash_path.display()));
-    if let Some(error) = utils::copy_file(&agents_path, &stash_path) {
+    let identical = if options.dedupe_global {
+        find_identical_stash(&stash_path, &agents_content)?
+    } else {
+        None
+    };
+    // Both paths replace the stash via rename, so a stash hard-linked by gc or --dedupe-global is
+    // replaced rather than modified in place. apply reads a link exactly like a copy.
+    if let Some(canonical) = identical {
+        utils::log_info(&format!("Linking {} to identical stash {}", stash_path.display(), canonical.display()));
+        utils::replace_with_hard_link(&canonical, &stash_path)?;
+    } else if let Some(error) = utils::write_file_atomic(&stash_path, &agents_content) {
         return Err(error);
     }
+    if options.read_only {
+        utils::set_file_mode(&stash_path, 0o444)?;
+        utils::log_info(&format!("Marked stash for {} read-only", project_name));
+    }
+    if options.verify {
+        let mut reader = utils::open_stash_reader(project_name)?;
+        verify_read_back(&mut reader, &agents_content, &stash_path.display().to_string())?;
+    }
     utils::log_info(&format!("AGENTS.md stashed for project: {}", project_name));
+    if !options.auto {
+        println!(
+            "{} AGENTS.md for {}",
+            color_string("Stashed", GREEN),
+            color_string(project_name, BOLD)
+        );
+    }
+
+    if !valid {
+        return Err(format!("Stashed invalid AGENTS.md content for {} (missing '# AGENTS' header)", project_name).into());
+    }
+    Ok(true)
+}
+
+// find_identical_stash returns another stash in stash_path's directory whose content is exactly
+// content, if there is one
+fn find_identical_stash(stash_path: &Path, content: &str) -> Result<Option<PathBuf>, Box<dyn std::error::Error>> {
+    let stashes_dir = stash_path.parent().ok_or("Stash path has no parent directory")?;
+    let checksum = utils::content_checksum(content.as_bytes());
+    for path in utils::list_stash_files(stashes_dir)? {
+        if path != stash_path && !utils::is_symlink(&path) && utils::file_checksum(&path)? == checksum {
+            return Ok(Some(path));
+        }
+    }
+    Ok(None)
+}
+
+// check_strict_header fails unless content starts with the "# AGENTS" header on its very first line
+fn check_strict_header(content: &str, label: &str) -> Result<(), Box<dyn std::error::Error>> {
+    if utils::has_strict_header(content) {
+        return Ok(());
+    }
+    Err(format!(
+        "{} does not start with '# AGENTS' on its first line (--strict-header); use --normalize-header to trim what comes before it",
+        label
+    )
+    .into())
+}
+
+// reject_validation_warnings fails the operation named by action when content has validation
+// warnings, printing them first if print_issues is set
+fn reject_validation_warnings(content: &str, label: &str, action: &str, print_issues: bool) -> Result<(), Box<dyn std::error::Error>> {
+    let warnings = utils::validate_agents(content);
+    if warnings.is_empty() {
+        return Ok(());
+    }
+    if print_issues {
+        print_validation_issues(&warnings);
+    }
+    Err(format!("{} has {} validation warning(s); {} aborted", label, warnings.len(), action).into())
+}
+
+// is_read_only_stash reports whether the stash at path exists and was stored with --read-only. A
+// linked stash is never read-only, whatever the mode of the file it points to.
+fn is_read_only_stash(path: &Path) -> Result<bool, Box<dyn std::error::Error>> {
+    match fs::symlink_metadata(path) {
+        Ok(metadata) => Ok(metadata.permissions().readonly()),
+        Err(e) if e.kind() == io::ErrorKind::NotFound => Ok(false),
+        Err(e) => Err(e.into()),
+    }
+}
+
+// How often stash --watch checks the local AGENTS.md for changes
+const WATCH_POLL_INTERVAL: Duration = Duration::from_millis(500);
+
+// watch_stash polls agents_path and stashes its content each time it changes, once it has stayed the
+// same for a full poll interval so a burst of saves is stashed once. Invalid content and failed
+// writes are reported and skipped. Runs until stop is set; since stashes are written atomically,
+// interrupting the process is also safe.
+fn watch_stash(
+    agents_path: &Path,
+    project_name: &str,
+    options: &StashOptions,
+    stop: &AtomicBool,
+    poll_interval: Duration,
+) -> Result<(), Box<dyn std::error::Error>> {
     println!(
-        "{} AGENTS.md for {}",
-        color_string("Stashed", GREEN),
-        color_string(project_name, BOLD)
+        "Watching {} for changes, press Ctrl-C to stop",
+        color_string(&agents_path.display().to_string(), BOLD)
     );
 
+    // Content that was last stashed or rejected, and a change waiting to settle
+    let mut handled: Option<String> = None;
+    let mut pending: Option<String> = None;
+
+    while !stop.load(Ordering::SeqCst) {
+        let current = if utils::file_exists(agents_path) {
+            match utils::read_file(agents_path) {
+                (None, content) => Some(content),
+                (Some(error), _) => {
+                    utils::log_warn(&format!("Could not read {}: {}", agents_path.display(), error));
+                    None
+                }
+            }
+        } else {
+            None
+        };
+
+        if current.is_some() && current != handled {
+            if current == pending {
+                let content = pending.take().unwrap_or_default();
+                if let Err(error) = store_stash(project_name, content, options) {
+                    utils::log_warn(&format!("Could not stash {}: {}", agents_path.display(), error));
+                }
+                handled = current;
+            } else {
+                pending = current;
+            }
+        } else {
+            pending = None;
+        }
+
+        thread::sleep(poll_interval);
+    }
+
     Ok(())
 }
 
+// resolve_force_dir turns a --force-dir argument into an absolute directory so that relative paths
+// such as "." still yield a meaningful project name
+fn resolve_force_dir(dir: &Path) -> Result<PathBuf, Box<dyn std::error::Error>> {
+    if !dir.is_dir() {
+        return Err(format!("Directory not found: {}", dir.display()).into());
+    }
+
+    utils::log_info(&format!("Skipping project root detection, using directory: {}", dir.display()));
+    Ok(fs::canonicalize(dir)?)
+}
+
+// ApplyOptions controls how HandleApply writes the stashed AGENTS.md file
+#[derive(Debug, Default)]
+pub struct ApplyOptions {
+    // Overwrite an existing AGENTS.md without prompting for confirmation
+    pub force: bool,
+    // Copy the stash to the system clipboard instead of writing a file
+    pub to_clipboard: bool,
+    // Print the diff between the existing AGENTS.md and the stash to stderr before overwriting
+    pub print_diff_on_overwrite: bool,
+    // Apply into this directory without project root detection, using the stash named after it
+    pub force_dir: Option<PathBuf>,
+    // Create the force_dir directory if it does not exist yet
+    pub create_dirs: bool,
+    // Append a JSON line describing the operation to this file
+    pub report: Option<PathBuf>,
+    // Set the applied file's permissions to this mode
+    pub chmod: Option<u32>,
+    // Fail instead of prompting when confirmation would be required
+    pub no_prompt: bool,
+    // Keep these sections (by heading title) from the existing AGENTS.md when overwriting it
+    pub preserve_local_sections: Vec<String>,
+    // Abort unless the stash has this SHA-256 checksum (hex)
+    pub expect_sha256: Option<String>,
+    // Read the expected SHA-256 checksum from this file, in sha256sum format
+    pub checksum_file: Option<PathBuf>,
+    // Apply AGENTS.md content downloaded from this URL instead of the stash
+    pub from_url: Option<String>,
+    // Also save the downloaded content as the project's stash
+    pub stash_download: bool,
+    // Fail if the stash changes between the start of the apply and the write
+    pub lockstep: bool,
+    // Re-read the written AGENTS.md and fail unless it matches the intended content and validates
+    pub verify_after: bool,
+    // Print the written AGENTS.md's SHA-256 in sha256sum format after a successful apply
+    pub report_checksum: bool,
+    // Run the repository's .git/hooks/post-agents after a successful apply, if it is executable
+    pub run_hooks: bool,
+    // Hold an advisory lock on this file for the duration of the apply
+    pub lock_file: Option<PathBuf>,
+    // How long to wait for lock_file before giving up; zero tries once
+    pub lock_timeout: Duration,
+    // Print what the apply would do without changing any files
+    pub dry_run: bool,
+    // Print the dry-run plan as JSON
+    pub json: bool,
+    // Refuse to apply over a local AGENTS.md that is already valid
+    pub only_if_valid_local: bool,
+    // With dry_run, print only the summary line and fail if the apply would change AGENTS.md
+    pub exit_code: bool,
+    // Abort instead of applying content that has validation warnings
+    pub fail_on_warning: bool,
+    // Restore the files captured in this snapshot instead of applying the stash
+    pub snapshot: Option<String>,
+    // Append a comment naming the stash, its checksum and the time it was applied
+    pub record_origin: bool,
+    // Only update an existing AGENTS.md; never create the file or its directory
+    pub no_create: bool,
+    // Abort unless the resolved project has this name
+    pub expect_project: Option<String>,
+    // Write AGENTS.md with these line endings instead of the stash's own
+    pub normalize_line_endings: Option<utils::LineEndings>,
+    // Append a comment naming the agstash version that applied the file
+    pub stamp_version: bool,
+    // Look the stash up by the origin remote (owner/repo) rather than the project directory
+    pub project_from_gitconfig: bool,
+    // Give the applied AGENTS.md the stash file's modification time
+    pub keep_mtime: bool,
+    // Print the diff the apply introduces as a JSON array of hunks
+    pub report_diff_json: bool,
+    // Wrap paragraph text to this many columns before writing
+    pub reflow: Option<usize>,
+    // Compose AGENTS.md from these projects' stashes, each layered over the ones before it
+    pub chain: Vec<String>,
+    // Print a single plain status line for the apply instead of the usual messages
+    pub summary: bool,
+    // Require "# AGENTS" to be the very first line of the applied content
+    pub strict_header: bool,
+    // Trim anything before the "# AGENTS" header so it becomes the first line
+    pub normalize_header: bool,
+}
+
+// ApplyOutcome describes what an apply did
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum ApplyOutcome {
+    Created,
+    Overwritten,
+    CopiedToClipboard,
+    NoStash,
+    Cancelled,
+    InvalidStash,
+}
+
+impl ApplyOutcome {
+    // as_str returns the stable name used for the outcome in reports
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            ApplyOutcome::Created => "created",
+            ApplyOutcome::Overwritten => "overwritten",
+            ApplyOutcome::CopiedToClipboard => "copied-to-clipboard",
+            ApplyOutcome::NoStash => "no-stash",
+            ApplyOutcome::Cancelled => "cancelled",
+            ApplyOutcome::InvalidStash => "invalid-stash",
+        }
+    }
+}
+
+// ApplyTarget records the project and stash an apply resolved, as far as it got
+#[derive(Debug, Default)]
+struct ApplyTarget {
+    root: Option<PathBuf>,
+    project_name: Option<String>,
+    stash_file_path: Option<PathBuf>,
+}
+
 // HandleApply copies the stashed AGENTS.md file back to the project root
-pub fn handle_apply(force: bool) -> Result<(), Box<dyn std::error::Error>> {
-    let root = utils::get_project_root()?;
+pub fn handle_apply(options: &ApplyOptions) -> Result<(), Box<dyn std::error::Error>> {
+    // The lock is released when _lock goes out of scope
+    let _lock = match &options.lock_file {
+        Some(lock_path) => {
+            // The default lock lives in the .agstash directory, which may not exist yet
+            if *lock_path == utils::get_lock_path()? {
+                fs::create_dir_all(utils::get_agstash_dir()?)?;
+            }
+            utils::log_info(&format!("Acquiring lock: {}", lock_path.display()));
+            Some(utils::acquire_lock(lock_path, options.lock_timeout)?)
+        }
+        None => None,
+    };
 
-    utils::log_info(&format!("Found project root at: {}", root.display()));
-    let project_name = root
-        .file_name()
-        .and_then(|name| name.to_str())
-        .ok_or("Could not extract project name")?;
+    if options.dry_run || options.report_diff_json {
+        let plan = plan_apply(options)?;
+        if options.report_diff_json {
+            println!("{}", render_diff_json(&plan.hunks)?);
+        } else {
+            let rendered = render_apply_plan(&plan, options.json)?;
+            if options.exit_code && !options.json {
+                println!("{}", rendered.lines().next().unwrap_or_default());
+            } else {
+                println!("{}", rendered);
+            }
+        }
+        if options.dry_run {
+            if options.exit_code && plan.differs {
+                return Err(format!("Applying the stash would change {}", plan.destination.display()).into());
+            }
+            return Ok(());
+        }
+    }
+
+    let mut target = ApplyTarget::default();
+    let result = apply_stash(options, &mut target);
+
+    if let Some(report_path) = &options.report {
+        if let Err(error) = append_apply_report(report_path, &target, &result) {
+            // The apply's own error takes precedence over a failure to record it
+            if result.is_ok() {
+                return Err(error);
+            }
+            utils::log_warn(&format!("Could not write apply report to {}: {}", report_path.display(), error));
+        }
+    }
+
+    if let (true, Ok(outcome), Some(project_name)) = (options.summary, &result, &target.project_name) {
+        let size = match (outcome, &target.root) {
+            (ApplyOutcome::Created | ApplyOutcome::Overwritten, Some(root)) => Some(fs::metadata(root.join("AGENTS.md"))?.len()),
+            _ => None,
+        };
+        println!("{}", apply_summary(*outcome, project_name, size));
+    }
+
+    if let (Ok(ApplyOutcome::Created | ApplyOutcome::Overwritten), Some(root)) = (&result, &target.root) {
+        if options.report_checksum {
+            println!("{}", checksum_line(&root.join("AGENTS.md"))?);
+        }
+        if options.run_hooks {
+            run_post_agents_hook(root);
+        }
+    }
+
+    result.map(|_| ())
+}
+
+// apply_summary formats the single status line --summary prints for an apply's outcome, including the
+// written file's size when there is one
+fn apply_summary(outcome: ApplyOutcome, project_name: &str, size: Option<u64>) -> String {
+    let (verb, detail) = match outcome {
+        ApplyOutcome::Created => ("applied", "created"),
+        ApplyOutcome::Overwritten => ("applied", "overwrote"),
+        ApplyOutcome::CopiedToClipboard => ("copied", "to clipboard"),
+        ApplyOutcome::NoStash => ("skipped", "no stash"),
+        ApplyOutcome::Cancelled => ("skipped", "cancelled"),
+        ApplyOutcome::InvalidStash => ("skipped", "invalid stash"),
+    };
+    match size {
+        Some(bytes) => format!("agstash: {} AGENTS.md for {} ({}, {})", verb, project_name, detail, format_size(bytes)),
+        None => format!("agstash: {} AGENTS.md for {} ({})", verb, project_name, detail),
+    }
+}
+
+// format_size renders a byte count for people, in B below a kilobyte and in KB or MB with one decimal
+fn format_size(bytes: u64) -> String {
+    const KB: f64 = 1024.0;
+    let size = bytes as f64;
+    if size < KB {
+        format!("{} B", bytes)
+    } else if size < KB * KB {
+        format!("{:.1} KB", size / KB)
+    } else {
+        format!("{:.1} MB", size / (KB * KB))
+    }
+}
+
+// apply_stash performs the apply and returns its outcome, filling in target as the project and stash are resolved
+fn apply_stash(options: &ApplyOptions, target: &mut ApplyTarget) -> Result<ApplyOutcome, Box<dyn std::error::Error>> {
+    let root = resolve_apply_root(options)?;
+    target.root = Some(root.clone());
+    let project_name = resolve_project_name(&root, options.project_from_gitconfig)?;
+    let project_name = project_name.as_str();
+    target.project_name = Some(project_name.to_string());
+    check_expected_project(project_name, options)?;
+
+    let stash_file_path = utils::get_stash_path(project_name)?;
+    let agents_md_file_path = root.join("AGENTS.md");
+
+    refuse_missing_no_create(&agents_md_file_path, options)?;
+
+    if let Some(id) = &options.snapshot {
+        refuse_valid_local(&agents_md_file_path, options)?;
+        return apply_snapshot(id, &root, project_name, options);
+    }
+    if !options.chain.is_empty() {
+        refuse_valid_local(&agents_md_file_path, options)?;
+        return apply_chain(&options.chain, &root, project_name, options);
+    }
+    if let Some(url) = &options.from_url {
+        refuse_valid_local(&agents_md_file_path, options)?;
+        if options.stash_download {
+            target.stash_file_path = Some(stash_file_path.clone());
+        }
+        return apply_from_url(url, &root, &stash_file_path, project_name, options);
+    }
+    target.stash_file_path = Some(stash_file_path.clone());
+
+    utils::log_info(&format!("Looking for stash at: {}", stash_file_path.display()));
+
+    // Check if stash exists first
+    if !utils::file_exists(&stash_file_path) {
+        utils::log_info(&format!("No stash found for project: {}", project_name));
+        if !options.summary {
+            println!("No stash found for project {}", color_string(project_name, BOLD));
+        }
+        return Ok(ApplyOutcome::NoStash);
+    }
+
+    if let Some(expected) = expected_checksum(options)? {
+        verify_stash_checksum(&stash_file_path, &expected)?;
+    }
+
+    // Remember the stash as it was at the start so a change before the write can be caught
+    let lockstep_checksum = if options.lockstep {
+        Some(utils::file_checksum(&stash_file_path)?)
+    } else {
+        None
+    };
+
+    if options.to_clipboard {
+        return copy_stash_to_clipboard(&stash_file_path, project_name);
+    }
+    refuse_valid_local(&agents_md_file_path, options)?;
+    utils::ensure_safe_target(&root)?;
+
+    if !confirm_overwrite(&agents_md_file_path, options)? {
+        return Ok(ApplyOutcome::Cancelled);
+    }
+
+    if !root.is_dir() {
+        utils::log_info(&format!("Creating directory: {}", root.display()));
+        fs::create_dir_all(&root)?;
+    }
+
+    // Validate and apply the stash
+    apply_stash_content(&stash_file_path, &agents_md_file_path, project_name, options, lockstep_checksum.as_deref())
+}
+
+// apply_chain composes AGENTS.md from the named stashes in order, layering each over the result of the
+// ones before it, and writes the composed content to root. Every stash must exist and be valid.
+fn apply_chain(chain: &[String], root: &Path, project_name: &str, options: &ApplyOptions) -> Result<ApplyOutcome, Box<dyn std::error::Error>> {
+    let stashes_dir = utils::get_stashes_dir()?;
+    let mut composed: Option<String> = None;
+    for name in chain {
+        let stash_path = stashes_dir.join(utils::stash_file_name(name));
+        if !utils::file_exists(&stash_path) {
+            return Err(format!("No stash found for {} in --chain; AGENTS.md was not modified", name).into());
+        }
+        let (err, content) = utils::read_file(&stash_path);
+        if let Some(error) = err {
+            return Err(error);
+        }
+        if !utils::is_valid_agents(&content) {
+            return Err(format!("Stash for {} in --chain is invalid (missing '# AGENTS' header); AGENTS.md was not modified", name).into());
+        }
+
+        utils::log_info(&format!("Layering stash for {} from: {}", name, stash_path.display()));
+        composed = Some(match composed {
+            Some(base) => layer_stash(&base, &content),
+            None => content,
+        });
+    }
+    let content = composed.ok_or("--chain needs at least one stash")?;
+
+    utils::ensure_safe_target(root)?;
+    let agents_md_file_path = root.join("AGENTS.md");
+    if !confirm_overwrite(&agents_md_file_path, options)? {
+        return Ok(ApplyOutcome::Cancelled);
+    }
+
+    if !root.is_dir() {
+        utils::log_info(&format!("Creating directory: {}", root.display()));
+        fs::create_dir_all(root)?;
+    }
+
+    write_agents_file(content, &agents_md_file_path, project_name, options, None)
+}
+
+// layer_stash returns base with overlay layered on top. Each of the overlay's top-level sections
+// replaces the base section of the same title, or is appended if base has none, and any text the
+// overlay has before its first section replaces the base's.
+fn layer_stash(base: &str, overlay: &str) -> String {
+    let overlay_sections = utils::parse_agents_sections(overlay);
+    let mut titles = Vec::new();
+    let mut index = 0;
+    while index < overlay_sections.len() {
+        let section = &overlay_sections[index];
+        if section.level < 2 {
+            index += 1;
+            continue;
+        }
+        titles.push(section.title.clone());
+        index += section_span(&overlay_sections[index..], &section.title).map_or(1, |span| span.end);
+    }
+
+    let layered = overlay_named_sections(base, overlay, &titles, "Layered");
+    let intro = overlay_sections
+        .iter()
+        .find(|section| section.level == 1)
+        .map(|section| section.body.as_str())
+        .filter(|body| !body.trim().is_empty());
+    let Some(intro) = intro else {
+        return layered;
+    };
+
+    let mut sections = utils::parse_agents_sections(&layered);
+    if let Some(header) = sections.iter_mut().find(|section| section.level == 1) {
+        header.body = intro.to_string();
+    }
+    utils::render_agents_sections(&sections)
+}
+
+// refuse_missing_no_create fails if --no-create is set and there is no AGENTS.md at path to update
+fn refuse_missing_no_create(path: &Path, options: &ApplyOptions) -> Result<(), Box<dyn std::error::Error>> {
+    if options.no_create && !path.is_file() {
+        return Err(format!("{} does not exist and --no-create only updates an existing file", path.display()).into());
+    }
+    Ok(())
+}
+
+// refuse_valid_local fails if --only-if-valid-local is set and the AGENTS.md at path is already valid
+fn refuse_valid_local(path: &Path, options: &ApplyOptions) -> Result<(), Box<dyn std::error::Error>> {
+    if options.only_if_valid_local && is_valid_local_file(path)? {
+        return Err(format!(
+            "{} is already valid; refusing to overwrite it (--only-if-valid-local)",
+            path.display()
+        )
+        .into());
+    }
+    Ok(())
+}
+
+// is_valid_local_file reports whether path exists and holds valid AGENTS.md content
+fn is_valid_local_file(path: &Path) -> Result<bool, Box<dyn std::error::Error>> {
+    if !utils::file_exists(path) {
+        return Ok(false);
+    }
+    let (err, content) = utils::read_file(path);
+    if let Some(error) = err {
+        return Err(error);
+    }
+    Ok(utils::is_valid_agents(&content))
+}
+
+// check_expected_project fails if --expect-project names a project other than the resolved one
+fn check_expected_project(project_name: &str, options: &ApplyOptions) -> Result<(), Box<dyn std::error::Error>> {
+    match &options.expect_project {
+        Some(expected) if expected != project_name => Err(format!(
+            "Resolved project is {}, not the expected {}; AGENTS.md was not modified",
+            project_name, expected
+        )
+        .into()),
+        _ => Ok(()),
+    }
+}
+
+// checksum_line formats a file's SHA-256 the way sha256sum prints it, so the line can be checked
+// with `sha256sum -c`
+fn checksum_line(path: &Path) -> Result<String, Box<dyn std::error::Error>> {
+    Ok(format!("{}  {}", utils::file_checksum(path)?, path.display()))
+}
+
+// run_post_agents_hook runs the repository's .git/hooks/post-agents, if present and executable, with
+// AGSTASH_PROJECT_DIR set to the project root. A failing hook is reported but does not undo the apply.
+fn run_post_agents_hook(root: &Path) {
+    let hook = root.join(".git").join("hooks").join("post-agents");
+    if !utils::is_executable(&hook) {
+        utils::log_info(&format!("No executable post-agents hook at: {}", hook.display()));
+        return;
+    }
+
+    utils::log_info(&format!("Running hook: {}", hook.display()));
+    match utils::run_hook(&hook, root, &[("AGSTASH_PROJECT_DIR", root)]) {
+        Ok(status) if status.success() => {
+            println!("{} post-agents hook", color_string("Ran", GREEN));
+        }
+        Ok(status) => {
+            utils::log_warn(&format!("post-agents hook failed: {}", status));
+            println!("{} {}", color_string("post-agents hook failed:", RED), status);
+        }
+        Err(error) => {
+            utils::log_warn(&format!("post-agents hook failed: {}", error));
+            println!("{} {}", color_string("post-agents hook failed:", RED), error);
+        }
+    }
+}
+
+// confirm_overwrite asks before an existing AGENTS.md is replaced, unless force is set, and returns
+// whether to go ahead. With no_prompt set, a needed confirmation is an error instead.
+fn confirm_overwrite(agents_md_file_path: &Path, options: &ApplyOptions) -> Result<bool, Box<dyn std::error::Error>> {
+    let needs_confirmation = utils::file_exists(agents_md_file_path) && !options.force;
+    if !needs_confirmation {
+        utils::log_info("No existing AGENTS.md or force is true, proceeding with apply");
+        return Ok(true);
+    }
+    if options.no_prompt {
+        return Err("Confirmation required: AGENTS.md already exists (use --force to overwrite it)".into());
+    }
+
+    utils::log_info("AGENTS.md exists and force is false, prompting user");
+    println!(
+        "\n{} {} already exists in the current directory.",
+        color_string("WARNING:", &format!("{}{}", YELLOW, BOLD)),
+        color_string("AGENTS.md", BOLD)
+    );
+    println!("Do you want to replace it with the stashed version?");
+    println!("This action will permanently overwrite the current file.\n");
+    print!("Type 'yes' to confirm or 'no' to cancel [y/N]: ");
+    io::stdout().flush()?; // Ensure the prompt is displayed
+
+    let user_confirmed = get_user_confirmation()?;
+    if !user_confirmed {
+        utils::log_info("User declined to overwrite, aborting apply");
+        println!("\nOperation cancelled. {} was not modified.", color_string("AGENTS.md", BOLD));
+    } else {
+        utils::log_info("User confirmed overwrite");
+        println!("\nConfirmed. Applying stashed {}...", color_string("AGENTS.md", BOLD));
+    }
+    Ok(user_confirmed)
+}
+
+// apply_from_url downloads AGENTS.md content and applies it like a stash, optionally saving it as the
+// project's stash as well
+fn apply_from_url(
+    url: &str,
+    root: &Path,
+    stash_file_path: &Path,
+    project_name: &str,
+    options: &ApplyOptions,
+) -> Result<ApplyOutcome, Box<dyn std::error::Error>> {
+    // Only --force replaces a read-only stash, and the replacement stays read-only
+    let stash_read_only = options.stash_download && is_read_only_stash(stash_file_path)?;
+    if stash_read_only && !options.force {
+        return Err(format!("Stash for {} is read-only; use --force to overwrite it", project_name).into());
+    }
+
+    utils::log_info(&format!("Fetching AGENTS.md from: {}", url));
+    let content = utils::fetch_url(url, MAX_DOWNLOAD_SIZE)?;
+
+    if !utils::is_valid_agents(&content) {
+        utils::log_warn("Downloaded content is invalid, apply aborted");
+        if !options.summary {
+            println!(
+                "{} {}",
+                color_string("Downloaded content is invalid (missing '# AGENTS' header).", YELLOW),
+                color_string("Apply aborted.", YELLOW)
+            );
+        }
+        return Ok(ApplyOutcome::InvalidStash);
+    }
+
+    utils::ensure_safe_target(root)?;
+    let agents_md_file_path = root.join("AGENTS.md");
+    if !confirm_overwrite(&agents_md_file_path, options)? {
+        return Ok(ApplyOutcome::Cancelled);
+    }
+
+    if !root.is_dir() {
+        utils::log_info(&format!("Creating directory: {}", root.display()));
+        fs::create_dir_all(root)?;
+    }
+
+    if options.stash_download {
+        utils::log_info(&format!("Stashing downloaded content to: {}", stash_file_path.display()));
+        if let Some(error) = utils::write_file_atomic(stash_file_path, &content) {
+            return Err(error);
+        }
+        if stash_read_only {
+            utils::set_file_mode(stash_file_path, 0o444)?;
+        }
+    }
+
+    write_agents_file(content, &agents_md_file_path, project_name, options, None)
+}
+
+// Largest AGENTS.md apply --from-url will download
+const MAX_DOWNLOAD_SIZE: u64 = 1_000_000;
+
+// Unchanged lines kept around each change in a dry-run plan's hunks
+const PLAN_DIFF_CONTEXT: usize = 3;
+
+// ApplyPlan describes what an apply would do, as computed by a dry run
+#[derive(Debug)]
+struct ApplyPlan {
+    // "create", "overwrite" or "skip"
+    action: &'static str,
+    // Why the apply would be skipped
+    reason: Option<String>,
+    project: String,
+    stash: PathBuf,
+    destination: PathBuf,
+    // Whether the stash differs from the existing AGENTS.md; always true when there is none
+    differs: bool,
+    hunks: Vec<utils::DiffHunk>,
+}
+
+// plan_apply resolves the project and stash like an apply would and computes the resulting change,
+// without creating or writing anything
+fn plan_apply(options: &ApplyOptions) -> Result<ApplyPlan, Box<dyn std::error::Error>> {
+    let root = resolve_apply_root(options)?;
+    let project_name = resolve_project_name(&root, options.project_from_gitconfig)?;
+    let project_name = project_name.as_str();
+    check_expected_project(project_name, options)?;
+
+    // get_stash_path would create the stashes directory
+    let mut plan = ApplyPlan {
+        action: "skip",
+        reason: None,
+        project: project_name.to_string(),
+        stash: utils::get_stashes_dir()?.join(utils::stash_file_name(project_name)),
+        destination: root.join("AGENTS.md"),
+        differs: false,
+        hunks: Vec::new(),
+    };
+    // The apply would fail before looking at the stash, so the plan does too
+    refuse_missing_no_create(&plan.destination, options)?;
+
+    if !utils::file_exists(&plan.stash) {
+        plan.reason = Some("no stash found".to_string());
+        return Ok(plan);
+    }
+
+    let (err, stash_content) = utils::read_file(&plan.stash);
+    if let Some(error) = err {
+        return Err(error);
+    }
+    if !utils::is_valid_agents(&stash_content) {
+        plan.reason = Some("stash content is invalid (missing '# AGENTS' header)".to_string());
+        return Ok(plan);
+    }
+
+    let existing_content = if utils::file_exists(&plan.destination) {
+        plan.action = "overwrite";
+        let (err, content) = utils::read_file(&plan.destination);
+        if let Some(error) = err {
+            return Err(error);
+        }
+        content
+    } else {
+        plan.action = "create";
+        String::new()
+    };
+    if options.only_if_valid_local && plan.action == "overwrite" && utils::is_valid_agents(&existing_content) {
+        plan.action = "skip";
+        plan.reason = Some("local AGENTS.md is already valid".to_string());
+        return Ok(plan);
+    }
+    let local_content = (plan.action == "overwrite").then_some(existing_content.as_str());
+    let stash_content = prepare_agents_content(stash_content, local_content, project_name, options)?;
+
+    // The line diff ignores line terminators, so call out mixed endings it would hide
+    for (label, content) in [("Stash", &stash_content), ("AGENTS.md", &existing_content)] {
+        if utils::detect_line_endings(content) == utils::LineEndings::Mixed {
+            utils::log_warn(&format!("{} mixes LF and CRLF line endings", label));
+        }
+    }
+
+    let diff = utils::line_diff(&existing_content, &stash_content);
+    let (added, removed, unchanged) = utils::diff_stats(&diff);
+    utils::log_info(&format!("Diff: {} added, {} removed, {} unchanged line(s)", added, removed, unchanged));
+    plan.differs = plan.action == "create" || existing_content != stash_content;
+    plan.hunks = utils::diff_hunks(&diff, PLAN_DIFF_CONTEXT);
+    Ok(plan)
+}
+
+// render_apply_plan formats a dry-run plan as a short summary with a diff, or as a JSON object
+fn render_apply_plan(plan: &ApplyPlan, json: bool) -> Result<String, Box<dyn std::error::Error>> {
+    if json {
+        let mut report = serde_json::json!({
+            "action": plan.action,
+            "project": plan.project,
+            "stash": plan.stash,
+            "destination": plan.destination,
+            "differs": plan.differs,
+            "hunks": hunks_json(&plan.hunks),
+        });
+        if let Some(reason) = &plan.reason {
+            report["reason"] = serde_json::Value::String(reason.clone());
+        }
+        return Ok(serde_json::to_string_pretty(&report)?);
+    }
+
+    if let Some(reason) = &plan.reason {
+        return Ok(format!(
+            "Would skip {}: {}",
+            color_string(&plan.project, BOLD),
+            reason
+        ));
+    }
+
+    let mut rendered = format!(
+        "Would {} {} from {}",
+        plan.action,
+        plan.destination.display(),
+        plan.stash.display()
+    );
+    if !plan.differs {
+        rendered.push_str(" (no changes)");
+    }
+    if !plan.hunks.is_empty() {
+        rendered.push_str("\n--- AGENTS.md (current)\n+++ AGENTS.md (stash)");
+    }
+    for hunk in &plan.hunks {
+        rendered.push_str(&format!(
+            "\n@@ -{},{} +{},{} @@\n",
+            hunk.old_start, hunk.old_lines, hunk.new_start, hunk.new_lines
+        ));
+        rendered.push_str(render_diff_lines(&hunk.lines).trim_end_matches('\n'));
+    }
+    Ok(rendered)
+}
+
+// render_diff_json formats diff hunks as a JSON array, as printed by --report-diff-json
+fn render_diff_json(hunks: &[utils::DiffHunk]) -> Result<String, Box<dyn std::error::Error>> {
+    Ok(serde_json::to_string_pretty(&hunks_json(hunks))?)
+}
+
+// hunks_json converts diff hunks to JSON objects holding their line ranges and op-tagged lines
+fn hunks_json(hunks: &[utils::DiffHunk]) -> serde_json::Value {
+    hunks
+        .iter()
+        .map(|hunk| {
+            let lines: Vec<serde_json::Value> = hunk
+                .lines
+                .iter()
+                .map(|line| {
+                    let (op, text) = match line {
+                        utils::DiffLine::Unchanged(text) => ("context", text),
+                        utils::DiffLine::Removed(text) => ("remove", text),
+                        utils::DiffLine::Added(text) => ("add", text),
+                    };
+                    serde_json::json!({ "op": op, "text": text })
+                })
+                .collect();
+            serde_json::json!({
+                "old_start": hunk.old_start,
+                "old_lines": hunk.old_lines,
+                "new_start": hunk.new_start,
+                "new_lines": hunk.new_lines,
+                "lines": lines,
+            })
+        })
+        .collect()
+}
+
+// expected_checksum returns the lowercase SHA-256 the stash must match, from --expect-sha256 or the
+// first field of --checksum-file, if either is set
+fn expected_checksum(options: &ApplyOptions) -> Result<Option<String>, Box<dyn std::error::Error>> {
+    let expected = match (&options.expect_sha256, &options.checksum_file) {
+        (Some(hex), _) => hex.trim().to_string(),
+        (None, Some(path)) => {
+            let (err, content) = utils::read_file(path);
+            if let Some(error) = err {
+                return Err(format!("Could not read checksum file {}: {}", path.display(), error).into());
+            }
+            content.split_whitespace().next().unwrap_or_default().to_string()
+        }
+        (None, None) => return Ok(None),
+    };
+
+    if expected.len() != 64 || !expected.chars().all(|c| c.is_ascii_hexdigit()) {
+        return Err(format!("Invalid SHA-256 checksum: '{}'", expected).into());
+    }
+    Ok(Some(expected.to_ascii_lowercase()))
+}
+
+// verify_stash_checksum fails unless the stash file's SHA-256 matches expected
+fn verify_stash_checksum(stash_file_path: &Path, expected: &str) -> Result<(), Box<dyn std::error::Error>> {
+    let actual = utils::file_checksum(stash_file_path)?;
+    if actual != expected {
+        return Err(format!(
+            "Checksum mismatch for {}: expected {}, got {}",
+            stash_file_path.display(),
+            expected,
+            actual
+        )
+        .into());
+    }
+
+    utils::log_info(&format!("Stash checksum verified: {}", actual));
+    Ok(())
+}
+
+// append_apply_report appends one JSON object describing an apply to the report file, creating it if needed
+fn append_apply_report(
+    report_path: &Path,
+    target: &ApplyTarget,
+    result: &Result<ApplyOutcome, Box<dyn std::error::Error>>,
+) -> Result<(), Box<dyn std::error::Error>> {
+    let checksum = match &target.stash_file_path {
+        Some(path) if path.is_file() => Some(utils::file_checksum(path)?),
+        _ => None,
+    };
+
+    let mut record = serde_json::json!({
+        "project": target.project_name,
+        "stash": target.stash_file_path,
+        "checksum": checksum,
+        "timestamp": utils::format_timestamp(std::time::SystemTime::now()),
+        "outcome": match result {
+            Ok(outcome) => outcome.as_str(),
+            Err(_) => "error",
+        },
+    });
+    if let Err(error) = result {
+        record["error"] = serde_json::Value::String(error.to_string());
+    }
+
+    let mut report_file = fs::OpenOptions::new().create(true).append(true).open(report_path)?;
+    writeln!(report_file, "{}", serde_json::to_string(&record)?)?;
+    utils::log_info(&format!("Appended apply report to: {}", report_path.display()));
+    Ok(())
+}
+
+// resolve_apply_root finds the directory an apply targets: the --force-dir directory if one is given,
+// otherwise the project root
+fn resolve_apply_root(options: &ApplyOptions) -> Result<PathBuf, Box<dyn std::error::Error>> {
+    let root = match &options.force_dir {
+        Some(dir) => resolve_apply_dir(dir, options.create_dirs)?,
+        None => utils::get_project_root()?,
+    };
+    utils::log_info(&format!("Found project root at: {}", root.display()));
+    Ok(root)
+}
+
+// resolve_apply_dir resolves an apply --force-dir argument. A missing directory is only accepted when
+// create_dirs is set, in which case its absolute path is returned and it is created just before writing.
+fn resolve_apply_dir(dir: &Path, create_dirs: bool) -> Result<PathBuf, Box<dyn std::error::Error>> {
+    if dir.is_dir() {
+        return resolve_force_dir(dir);
+    }
+
+    if !create_dirs {
+        return Err(format!("Directory not found: {} (use --create-dirs to create it)", dir.display()).into());
+    }
+
+    utils::log_info(&format!("Skipping project root detection, directory will be created: {}", dir.display()));
+    Ok(std::env::current_dir()?.join(dir))
+}
+
+fn get_user_confirmation() -> Result<bool, Box<dyn std::error::Error>> {
+    let input = read_input_line(&mut io::stdin().lock())?.to_lowercase();
+    // Accept various forms of "yes"
+    if ["y", "yes", "ye", "yep", "yeah"].contains(&input.as_str()) {
+        return Ok(true);
+    }
+    // Accept various forms of "no" or default to no
+    if ["n", "no", "nope", ""].contains(&input.as_str()) {
+        return Ok(false);
+    }
+    // If input doesn't match expected values, default to false (no)
+    Ok(false)
+}
+
+// read_input_line reads one line of user input without surrounding whitespace; end of input reads
+// as an empty answer
+fn read_input_line(input: &mut dyn io::BufRead) -> Result<String, Box<dyn std::error::Error>> {
+    let mut line = String::new();
+    input.read_line(&mut line)?;
+    Ok(line.trim().to_string())
+}
+
+// apply_stash_content validates the stashed content and copies it to the project's AGENTS.md file.
+// If lockstep_checksum is given, the content must still have that checksum.
+fn apply_stash_content(
+    stash_file_path: &Path,
+    agents_md_file_path: &Path,
+    project_name: &str,
+    options: &ApplyOptions,
+    lockstep_checksum: Option<&str>,
+) -> Result<ApplyOutcome, Box<dyn std::error::Error>> {
+    utils::log_info(&format!("Reading stash content from: {}", stash_file_path.display()));
+    let (err, stash_content) = utils::read_file(stash_file_path);
+    if let Some(error) = err {
+        return Err(error);
+    }
+
+    if let Some(expected) = lockstep_checksum {
+        let actual = utils::content_checksum(stash_content.as_bytes());
+        if actual != expected {
+            return Err(format!(
+                "Stash {} changed during the apply (SHA-256 was {}, now {}); AGENTS.md was not modified",
+                stash_file_path.display(),
+                expected,
+                actual
+            )
+            .into());
+        }
+    }
+
+    if !utils::is_valid_agents(&stash_content) {
+        utils::log_warn("Stash content is invalid, apply aborted");
+        if !options.summary {
+            println!(
+                "{} {}",
+                color_string("Stash content is invalid (missing '# AGENTS' header).", YELLOW),
+                color_string("Apply aborted.", YELLOW)
+            );
+        }
+        return Ok(ApplyOutcome::InvalidStash);
+    }
+
+    let modified = if options.keep_mtime {
+        Some(fs::metadata(stash_file_path)?.modified()?)
+    } else {
+        None
+    };
+    write_agents_file(stash_content, agents_md_file_path, project_name, options, modified)
+}
+
+// write_agents_file writes validated content to the project's AGENTS.md, transformed by
+// prepare_agents_content, and applies the requested diff output and permissions. If modified is given, the file's
+// modification time is set to it.
+fn write_agents_file(
+    stash_content: String,
+    agents_md_file_path: &Path,
+    project_name: &str,
+    options: &ApplyOptions,
+    modified: Option<std::time::SystemTime>,
+) -> Result<ApplyOutcome, Box<dyn std::error::Error>> {
+    let existed = utils::file_exists(agents_md_file_path);
+    let local_content = if existed && !options.preserve_local_sections.is_empty() {
+        let (err, local_content) = utils::read_file(agents_md_file_path);
+        if let Some(error) = err {
+            return Err(error);
+        }
+        Some(local_content)
+    } else {
+        None
+    };
+    let content = prepare_agents_content(stash_content, local_content.as_deref(), project_name, options)?;
+
+    if options.print_diff_on_overwrite {
+        if let Some(diff) = overwrite_diff(agents_md_file_path, &content)? {
+            eprint!("{}", diff);
+        }
+    }
+
+    utils::log_info(&format!("Applying stash to: {}", agents_md_file_path.display()));
+    if let Some(error) = utils::write_file(agents_md_file_path, &content) {
+        return Err(error);
+    }
+    // Set before chmod, which may leave the file read-only
+    if let Some(time) = modified {
+        utils::set_modified_time(agents_md_file_path, time)?;
+        utils::log_info("Set AGENTS.md modification time to the stash's");
+    }
+    if let Some(mode) = options.chmod {
+        utils::set_file_mode(agents_md_file_path, mode)?;
+        utils::log_info(&format!("Set AGENTS.md mode to {:04o}", mode));
+    }
+    if options.verify_after {
+        verify_written_file(agents_md_file_path, &content)?;
+    }
+    utils::log_info(&format!("AGENTS.md applied for project: {}", project_name));
+    if !options.summary {
+        println!(
+            "{} AGENTS.md for {}",
+            color_string("Applied", GREEN),
+            color_string(project_name, BOLD)
+        );
+    }
+
+    Ok(if existed { ApplyOutcome::Overwritten } else { ApplyOutcome::Created })
+}
+
+// prepare_agents_content turns stash content into what an apply writes to AGENTS.md: header checks and
+// normalization, sections preserved from local_content (the existing file, if any), reflow, stamps and
+// line endings. Dry runs build their plan with it too, so the reported diff matches the real write.
+fn prepare_agents_content(
+    stash_content: String,
+    local_content: Option<&str>,
+    project_name: &str,
+    options: &ApplyOptions,
+) -> Result<String, Box<dyn std::error::Error>> {
+    // The provenance stamp records the stash as stored, before any normalization
+    let checksum = utils::content_checksum(stash_content.as_bytes());
+    let stash_content = if options.normalize_header {
+        utils::normalize_header(&stash_content)
+    } else {
+        stash_content
+    };
+    if options.strict_header {
+        check_strict_header(&stash_content, "Stash content")?;
+    }
+    if options.fail_on_warning {
+        reject_validation_warnings(&stash_content, "Stash content", "apply", true)?;
+    }
+
+    let mut content = match local_content {
+        Some(local_content) if !options.preserve_local_sections.is_empty() => {
+            preserve_local_sections(&stash_content, local_content, &options.preserve_local_sections)
+        }
+        _ => stash_content,
+    };
+    if let Some(width) = options.reflow {
+        content = utils::reflow(&content, width);
+        utils::log_info(&format!("Reflowed paragraphs to {} columns", width));
+    }
+    let mut stamps = Vec::new();
+    if options.record_origin {
+        stamps.push(utils::provenance_stamp(project_name, &checksum, std::time::SystemTime::now()));
+    }
+    if options.stamp_version {
+        stamps.push(utils::version_stamp());
+    }
+    if !stamps.is_empty() {
+        // A preserved local section may still carry the stamps from an earlier apply
+        content = utils::strip_provenance(&content);
+        if !content.ends_with('\n') {
+            content.push('\n');
+        }
+        for stamp in stamps {
+            content.push_str(&stamp);
+            content.push('\n');
+        }
+    }
+    if let Some(endings) = options.normalize_line_endings {
+        content = utils::normalize_line_endings(&content, endings);
+        utils::log_info(&format!("Normalized line endings to {}", endings.as_str()));
+    }
+    Ok(content)
+}
+
+// preserve_local_sections returns the stash content with each of the named sections taken from the
+// local content instead. A section the stash also has is replaced in place; one it lacks is appended.
+// Names the local content has no section for are ignored.
+fn preserve_local_sections(stash_content: &str, local_content: &str, titles: &[String]) -> String {
+    overlay_named_sections(stash_content, local_content, titles, "Preserved local")
+}
+
+// overlay_named_sections returns content with each of the named sections taken from source instead,
+// replacing the section in place or appending it, and logging each one with label. Names source has
+// no section for are ignored.
+fn overlay_named_sections(content: &str, source: &str, titles: &[String], label: &str) -> String {
+    let source_sections = utils::parse_agents_sections(source);
+    let mut merged = utils::parse_agents_sections(content);
+
+    for title in titles {
+        let Some(source_span) = section_span(&source_sections, title) else {
+            continue;
+        };
+        let mut preserved = source_sections[source_span].to_vec();
+        if let Some(last) = preserved.last_mut() {
+            end_with_newline(last);
+        }
+
+        match section_span(&merged, title) {
+            Some(span) => {
+                merged.splice(span, preserved);
+            }
+            None => {
+                // Separate the appended section from the last line with a blank line
+                if let Some(last) = merged.last_mut() {
+                    end_with_newline(last);
+                    if !last.body.ends_with("\n\n") {
+                        last.body.push('\n');
+                    }
+                }
+                merged.extend(preserved);
+            }
+        }
+        utils::log_info(&format!("{} section: {}", label, title));
+    }
+    utils::render_agents_sections(&merged)
+}
+
+// exclude_sections returns content without the named sections and their subsections
+fn exclude_sections(content: &str, titles: &[String]) -> String {
+    let mut sections = utils::parse_agents_sections(content);
+    for title in titles {
+        match section_span(&sections, title) {
+            Some(span) => {
+                sections.drain(span);
+                utils::log_info(&format!("Excluded section from stash: {}", title));
+            }
+            None => utils::log_warn(&format!("Section to exclude not found: {}", title)),
+        }
+    }
+    utils::render_agents_sections(&sections)
+}
+
+// end_with_newline adds a line break to the section's body unless its last line already has one
+fn end_with_newline(section: &mut utils::Section) {
+    let last_line = if section.body.is_empty() { &section.heading } else { &section.body };
+    if !last_line.ends_with('\n') {
+        section.body.push('\n');
+    }
+}
+
+// section_span finds the section titled title (ignoring case) and returns the index range covering it
+// and its subsections, up to the next heading of the same or a higher level
+fn section_span(sections: &[utils::Section], title: &str) -> Option<std::ops::Range<usize>> {
+    let start = sections
+        .iter()
+        .position(|section| section.level > 0 && section.title.eq_ignore_ascii_case(title.trim()))?;
+    let level = sections[start].level;
+    let end = sections[start + 1..]
+        .iter()
+        .position(|section| section.level <= level)
+        .map_or(sections.len(), |offset| start + 1 + offset);
+    Some(start..end)
+}
+
+// verify_written_file re-reads a written file and fails unless it holds exactly the intended content
+// and still passes validation
+fn verify_written_file(path: &Path, intended: &str) -> Result<(), Box<dyn std::error::Error>> {
+    let mut file = fs::File::open(path)?;
+    verify_read_back(&mut file, intended, &path.display().to_string())
+}
+
+// verify_read_back reads written content back from reader and fails unless it is exactly intended and
+// still passes validation. label names what was written in errors.
+fn verify_read_back(reader: &mut dyn io::Read, intended: &str, label: &str) -> Result<(), Box<dyn std::error::Error>> {
+    let mut bytes = Vec::new();
+    reader
+        .read_to_end(&mut bytes)
+        .map_err(|e| format!("Verification failed: could not re-read {}: {}", label, e))?;
+
+    let expected = utils::content_checksum(intended.as_bytes());
+    let actual = utils::content_checksum(&bytes);
+    if actual != expected {
+        return Err(format!(
+            "Verification failed: {} does not match what was written (expected SHA-256 {}, found {})",
+            label,
+            expected,
+            actual
+        )
+        .into());
+    }
+
+    let content = String::from_utf8(bytes).map_err(|_| format!("Verification failed: {} is not valid UTF-8", label))?;
+    let errors: Vec<String> = utils::validate_agents(&content)
+        .into_iter()
+        .filter(|issue| issue.severity == utils::Severity::Error)
+        .map(|issue| issue.message)
+        .collect();
+    if !errors.is_empty() {
+        return Err(format!("Verification failed: {} is invalid: {}", label, errors.join("; ")).into());
+    }
+
+    utils::log_info(&format!("Verified {} (SHA-256 {})", label, actual));
+    Ok(())
+}
+
+// overwrite_diff renders the diff from the existing file to new_content, or None if there is no existing file
+fn overwrite_diff(existing_path: &Path, new_content: &str) -> Result<Option<String>, Box<dyn std::error::Error>> {
+    if !utils::file_exists(existing_path) {
+        return Ok(None);
+    }
+
+    let (err, existing_content) = utils::read_file(existing_path);
+    if let Some(error) = err {
+        return Err(error);
+    }
+
+    let diff = utils::line_diff(&existing_content, new_content);
+    Ok(Some(render_diff(&diff, "AGENTS.md (current)", "AGENTS.md (stash)")))
+}
+
+// render_diff formats a line diff with -/+ markers, coloring removed lines red and added lines green
+fn render_diff(diff: &[utils::DiffLine], old_label: &str, new_label: &str) -> String {
+    format!("--- {}\n+++ {}\n{}", old_label, new_label, render_diff_lines(diff))
+}
+
+// render_diff_lines formats diff lines with their -/+ markers, one per line
+fn render_diff_lines(diff: &[utils::DiffLine]) -> String {
+    let mut rendered = String::new();
+    for line in diff {
+        let formatted = match line {
+            utils::DiffLine::Unchanged(text) => format!(" {}", text),
+            utils::DiffLine::Removed(text) => color_string(&format!("-{}", text), RED),
+            utils::DiffLine::Added(text) => color_string(&format!("+{}", text), GREEN),
+        };
+        rendered.push_str(&formatted);
+        rendered.push('\n');
+    }
+    rendered
+}
+
+// copy_stash_to_clipboard validates the stashed content and places it on the system clipboard
+fn copy_stash_to_clipboard(stash_file_path: &Path, project_name: &str) -> Result<ApplyOutcome, Box<dyn std::error::Error>> {
+    utils::log_info(&format!("Reading stash content from: {}", stash_file_path.display()));
+    let (err, stash_content) = utils::read_file(stash_file_path);
+    if let Some(error) = err {
+        return Err(error);
+    }
+
+    if !utils::is_valid_agents(&stash_content) {
+        utils::log_warn("Stash content is invalid, apply aborted");
+        println!(
+            "{} {}",
+            color_string("Stash content is invalid (missing '# AGENTS' header).", YELLOW),
+            color_string("Apply aborted.", YELLOW)
+        );
+        return Ok(ApplyOutcome::InvalidStash);
+    }
+
+    utils::write_clipboard(&stash_content)?;
+    utils::log_info(&format!("AGENTS.md copied to clipboard for project: {}", project_name));
+    println!(
+        "{} AGENTS.md for {} to clipboard",
+        color_string("Copied", GREEN),
+        color_string(project_name, BOLD)
+    );
+
+    Ok(ApplyOutcome::CopiedToClipboard)
+}
+
+// HandleGc reports byte-identical stashes and, when dedupe is set, hard-links each duplicate to a
+// single shared copy to reclaim space. Linked stashes whose file is gone are reported too, and removed
+// when prune_dangling is set.
+pub fn handle_gc(dedupe: bool, prune_dangling: bool) -> Result<(), Box<dyn std::error::Error>> {
+    let stashes_dir = utils::get_stashes_dir()?;
+
+    utils::log_info(&format!("Scanning stashes in: {}", stashes_dir.display()));
+    for link in utils::list_dangling_stash_links(&stashes_dir)? {
+        let target = fs::read_link(&link)?;
+        let name = link.file_name().unwrap_or_default().to_string_lossy().into_owned();
+        if prune_dangling {
+            utils::log_info(&format!("Removing dangling stash link: {}", link.display()));
+            fs::remove_file(&link)?;
+            println!("{} {} (linked to missing {})", color_string("Pruned", GREEN), name, target.display());
+        } else {
+            println!(
+                "{} {} is linked to missing {}. Run with {} to remove it.",
+                color_string("Dangling:", YELLOW),
+                name,
+                target.display(),
+                color_string("--prune-dangling", BOLD)
+            );
+        }
+    }
+    let duplicate_groups = utils::find_duplicate_stashes(&stashes_dir)?;
+
+    let mut duplicate_count = 0;
+    let mut reclaimable_bytes: u64 = 0;
+    for group in &duplicate_groups {
+        let canonical = &group[0];
+        let names: Vec<String> = group
+            .iter()
+            .filter_map(|path| path.file_name())
+            .map(|name| name.to_string_lossy().into_owned())
+            .collect();
+        println!("{} {}", color_string("Identical:", YELLOW), names.join(", "));
+
+        for duplicate in &group[1..] {
+            // Stashes already linked to the canonical copy take no extra space
+            if utils::is_same_file(canonical, duplicate)? {
+                continue;
+            }
+
+            duplicate_count += 1;
+            reclaimable_bytes += fs::metadata(duplicate)?.len();
+
+            if dedupe {
+                utils::log_info(&format!("Linking {} to {}", duplicate.display(), canonical.display()));
+                utils::replace_with_hard_link(canonical, duplicate)?;
+            }
+        }
+    }
+
+    if duplicate_count == 0 {
+        utils::log_info("No duplicate stashes to compact");
+        println!("No duplicate stashes found.");
+    } else if dedupe {
+        println!(
+            "{} {} duplicate stash(es), reclaimed {} bytes",
+            color_string("Deduplicated", GREEN),
+            duplicate_count,
+            reclaimable_bytes
+        );
+    } else {
+        println!(
+            "Found {} duplicate stash(es), {} bytes reclaimable. Run with {} to reclaim.",
+            duplicate_count,
+            reclaimable_bytes,
+            color_string("--dedupe", BOLD)
+        );
+    }
+
+    Ok(())
+}
+
+// HandlePlaceholderReport prints each distinct {{NAME}} placeholder in the project's stash with how
+// often it occurs, without applying anything. The project is resolved from options as apply would.
+pub fn handle_placeholder_report(options: &ApplyOptions) -> Result<(), Box<dyn std::error::Error>> {
+    let root = resolve_apply_root(options)?;
+    let project_name = resolve_project_name(&root, options.project_from_gitconfig)?;
+
+    let stash_file_path = utils::get_stashes_dir()?.join(utils::stash_file_name(&project_name));
+    if !utils::file_exists(&stash_file_path) {
+        utils::log_info(&format!("No stash found for project: {}", project_name));
+        println!("No stash found for project {}", color_string(&project_name, BOLD));
+        return Ok(());
+    }
+
+    let mut content = String::new();
+    utils::open_stash_reader(&project_name)?.read_to_string(&mut content)?;
+    println!("{}", render_placeholder_report(&utils::find_placeholders(&content), &project_name));
+    Ok(())
+}
+
+// render_placeholder_report lists the placeholders found in a project's stash, one per line with its count
+fn render_placeholder_report(placeholders: &BTreeMap<String, usize>, project_name: &str) -> String {
+    if placeholders.is_empty() {
+        return format!("No placeholders in the stash for {}", color_string(project_name, BOLD));
+    }
+
+    let width = placeholders.keys().map(|name| name.chars().count()).max().unwrap_or(0);
+    let mut report = format!(
+        "{} placeholder(s) in the stash for {}:",
+        placeholders.len(),
+        color_string(project_name, BOLD)
+    );
+    for (name, count) in placeholders {
+        let token = format!("{{{{{}}}}}", name);
+        report.push_str(&format!("\n  {:width$}  {}", token, count, width = width + 4));
+    }
+    report
+}
+
+// HandleValidateOnly runs full validation over the project's stash (or the given file) and prints every
+// issue without applying anything. The project is resolved from options as apply would. Returns an
+// error if any issue is critical.
+pub fn handle_validate_only(file: Option<&Path>, options: &ApplyOptions) -> Result<(), Box<dyn std::error::Error>> {
+    let source_path = match file {
+        Some(path) => path.to_path_buf(),
+        None => {
+            let root = resolve_apply_root(options)?;
+            let project_name = resolve_project_name(&root, options.project_from_gitconfig)?;
+
+            let stash_file_path = utils::get_stash_path(&project_name)?;
+            if !utils::file_exists(&stash_file_path) {
+                utils::log_info(&format!("No stash found for project: {}", project_name));
+                println!("No stash found for project {}", color_string(&project_name, BOLD));
+                return Ok(());
+            }
+            stash_file_path
+        }
+    };
+
+    utils::log_info(&format!("Validating: {}", source_path.display()));
+    let (err, content) = utils::read_file(&source_path);
+    if let Some(error) = err {
+        return Err(error);
+    }
+
+    report_validation(&content, &source_path.display().to_string())
+}
+
+// HandleValidate runs full validation over the file at path, or standard input when path is None or
+// "-", and prints every issue. Returns an error if any issue is critical.
+pub fn handle_validate(path: Option<&Path>) -> Result<(), Box<dyn std::error::Error>> {
+    match path.filter(|path| *path != Path::new("-")) {
+        Some(path) => handle_validate_only(Some(path), &ApplyOptions::default()),
+        None => {
+            utils::log_info("Validating standard input");
+            let content = io::read_to_string(io::stdin())?;
+            report_validation(&content, "standard input")
+        }
+    }
+}
+
+// report_validation prints the validation issues for content, read from label, and fails if any of
+// them is critical
+fn report_validation(content: &str, label: &str) -> Result<(), Box<dyn std::error::Error>> {
+    let issues = utils::validate_agents(content);
+    print_validation_issues(&issues);
+
+    let error_count = issues
+        .iter()
+        .filter(|issue| issue.severity == utils::Severity::Error)
+        .count();
+    if error_count > 0 {
+        return Err(format!("{} failed validation with {} error(s)", label, error_count).into());
+    }
+
+    println!("{} {}", color_string("Valid:", GREEN), label);
+    Ok(())
+}
+
+// print_validation_issues prints each issue prefixed with its color-coded severity
+fn print_validation_issues(issues: &[utils::ValidationIssue]) {
+    for issue in issues {
+        let label = match issue.severity {
+            utils::Severity::Error => color_string("ERROR:", &format!("{}{}", RED, BOLD)),
+            utils::Severity::Warning => color_string("WARNING:", &format!("{}{}", YELLOW, BOLD)),
+        };
+        println!("{} {}", label, issue.message);
+    }
+}
+
+// SnapshotOptions holds the flags for the snapshot command
+#[derive(Debug, Default)]
+pub struct SnapshotOptions {
+    // Use this id instead of one made from the project name and the time
+    pub name: Option<String>,
+    // Further agent files, relative to the project root, to capture along with AGENTS.md
+    pub include: Vec<PathBuf>,
+}
+
+// HandleSnapshot captures the project's AGENTS.md, any included agent files and the current git
+// commit in a snapshot that apply --snapshot restores
+pub fn handle_snapshot(options: &SnapshotOptions) -> Result<(), Box<dyn std::error::Error>> {
+    let root = utils::get_project_root()?;
+    utils::log_info(&format!("Found project root at: {}", root.display()));
+    let project_name = root
+        .file_name()
+        .and_then(|name| name.to_str())
+        .ok_or("Could not extract project name")?;
+
+    let mut files = serde_json::Map::new();
+    for relative in std::iter::once(Path::new("AGENTS.md")).chain(options.include.iter().map(PathBuf::as_path)) {
+        let relative = snapshot_file_path(relative)?;
+        let (err, content) = utils::read_file(root.join(relative));
+        if let Some(error) = err {
+            return Err(format!("Could not read {}: {}", relative.display(), error).into());
+        }
+        if relative == Path::new("AGENTS.md") && !utils::is_valid_agents(&content) {
+            return Err("AGENTS.md content is invalid (missing '# AGENTS' header); snapshot aborted".into());
+        }
+        files.insert(relative.to_string_lossy().into_owned(), serde_json::Value::String(content));
+    }
+
+    let created = utils::format_timestamp(std::time::SystemTime::now());
+    let id = match &options.name {
+        Some(name) => utils::sanitize_file_name(name),
+        None => format!("{}-{}", utils::sanitize_file_name(project_name), created.replace(['-', ':'], "")),
+    };
+    let snapshot_path = utils::get_snapshots_dir()?.join(format!("{}.json", id));
+    if utils::file_exists(&snapshot_path) {
+        return Err(format!("Snapshot {} already exists; choose another --name", id).into());
+    }
+    let commit = utils::git_head_commit(&root)?;
+
+    let snapshot = serde_json::json!({
+        "id": id,
+        "project": project_name,
+        "created": created,
+        "commit": commit,
+        "files": files,
+    });
+    fs::create_dir_all(utils::get_snapshots_dir()?)?;
+    utils::log_info(&format!("Writing snapshot to: {}", snapshot_path.display()));
+    if let Some(error) = utils::write_file_atomic(&snapshot_path, &serde_json::to_string_pretty(&snapshot)?) {
+        return Err(error);
+    }
+
+    println!(
+        "{} {} of {} ({} file(s), commit {})",
+        color_string("Snapshot", GREEN),
+        color_string(&id, BOLD),
+        project_name,
+        files.len(),
+        commit.as_deref().unwrap_or("none")
+    );
+    Ok(())
+}
+
+// snapshot_file_path checks that a snapshot entry names a file inside the project root, so a
+// snapshot can never read or write outside it
+fn snapshot_file_path(path: &Path) -> Result<&Path, Box<dyn std::error::Error>> {
+    let inside = path.components().next().is_some() && path.components().all(|c| matches!(c, Component::Normal(_)));
+    if !inside {
+        return Err(format!("Snapshot file {} must be a relative path inside the project", path.display()).into());
+    }
+    Ok(path)
+}
+
+// apply_snapshot restores every file captured in snapshot id into root. AGENTS.md is written like a
+// stash apply; the other files are only replaced with --force.
+fn apply_snapshot(id: &str, root: &Path, project_name: &str, options: &ApplyOptions) -> Result<ApplyOutcome, Box<dyn std::error::Error>> {
+    let snapshot_path = utils::get_snapshots_dir()?.join(format!("{}.json", utils::sanitize_file_name(id)));
+    if !utils::file_exists(&snapshot_path) {
+        return Err(format!("No snapshot named {}", id).into());
+    }
+    let (err, content) = utils::read_file(&snapshot_path);
+    if let Some(error) = err {
+        return Err(error);
+    }
+    let snapshot: serde_json::Value =
+        serde_json::from_str(&content).map_err(|e| format!("Snapshot {} is corrupt: {}", id, e))?;
+    let files = snapshot["files"]
+        .as_object()
+        .ok_or_else(|| format!("Snapshot {} has no files", id))?;
+    let agents_content = files
+        .get("AGENTS.md")
+        .and_then(|content| content.as_str())
+        .ok_or_else(|| format!("Snapshot {} has no AGENTS.md", id))?;
+    if !utils::is_valid_agents(agents_content) {
+        return Err(format!("Snapshot {} holds an invalid AGENTS.md (missing '# AGENTS' header)", id).into());
+    }
+
+    if let Some(snapshot_project) = snapshot["project"].as_str().filter(|name| *name != project_name) {
+        utils::log_warn(&format!("Snapshot {} was taken in project {}", id, snapshot_project));
+    }
+    if let Some(commit) = snapshot["commit"].as_str() {
+        let head = utils::git_head_commit(root)?;
+        if head.as_deref() != Some(commit) {
+            utils::log_warn(&format!(
+                "Snapshot {} was taken at commit {}, but HEAD is {}",
+                id,
+                commit,
+                head.as_deref().unwrap_or("not a commit")
+            ));
+        }
+    }
+
+    // Check every extra file before writing anything
+    let mut extra_files = Vec::new();
+    for (name, content) in files.iter().filter(|(name, _)| name.as_str() != "AGENTS.md") {
+        let relative = snapshot_file_path(Path::new(name))?;
+        let content = content.as_str().ok_or_else(|| format!("Snapshot entry {} is not text", name))?;
+        extra_files.push((root.join(relative), content));
+    }
+    let existing: Vec<String> = extra_files
+        .iter()
+        .filter(|(path, _)| utils::file_exists(path))
+        .map(|(path, _)| path.display().to_string())
+        .collect();
+    if !options.force && !existing.is_empty() {
+        return Err(format!("Snapshot files already exist: {} (use --force to overwrite them)", existing.join(", ")).into());
+    }
+
+    utils::ensure_safe_target(root)?;
+    let agents_md_file_path = root.join("AGENTS.md");
+    if !confirm_overwrite(&agents_md_file_path, options)? {
+        return Ok(ApplyOutcome::Cancelled);
+    }
+
+    for (path, content) in &extra_files {
+        if let Some(parent) = path.parent() {
+            fs::create_dir_all(parent)?;
+        }
+        utils::log_info(&format!("Restoring: {}", path.display()));
+        if let Some(error) = utils::write_file(path, content) {
+            return Err(error);
+        }
+    }
+    let outcome = write_agents_file(agents_content.to_string(), &agents_md_file_path, project_name, options, None)?;
+    if !options.summary {
+        println!(
+            "{} snapshot {} ({} file(s))",
+            color_string("Restored", GREEN),
+            color_string(id, BOLD),
+            extra_files.len() + 1
+        );
+    }
+    Ok(outcome)
+}
+
+// HandleWhereis prints the resolved locations agstash stores its data in, optionally as JSON
+pub fn handle_whereis(json: bool) -> Result<(), Box<dyn std::error::Error>> {
+    println!("{}", whereis_report(json)?);
+    Ok(())
+}
+
+// whereis_report renders the agstash storage locations as aligned text or a JSON object. Everything
+// it lists lives under the agstash directory, which uninstall removes.
+fn whereis_report(json: bool) -> Result<String, Box<dyn std::error::Error>> {
+    let agstash_dir = utils::get_agstash_dir()?;
+    let stashes_dir = utils::get_stashes_dir()?;
+    let snapshots_dir = utils::get_snapshots_dir()?;
+    let lock_file = utils::get_lock_path()?;
+
+    if json {
+        let report = serde_json::json!({
+            "agstash_dir": agstash_dir,
+            "stashes_dir": stashes_dir,
+            "snapshots_dir": snapshots_dir,
+            "lock_file": lock_file,
+        });
+        return Ok(serde_json::to_string_pretty(&report)?);
+    }
+
+    let locations = [
+        ("agstash directory:", &agstash_dir),
+        ("stashes directory:", &stashes_dir),
+        ("snapshots directory:", &snapshots_dir),
+        ("lock file:", &lock_file),
+    ];
+    let lines: Vec<String> = locations
+        .iter()
+        .map(|(label, path)| format!("{} {}", color_string(&format!("{:<20}", label), BOLD), path.display()))
+        .collect();
+    Ok(lines.join("\n"))
+}
+
+// PlannedRename is a single stash rename computed by rename-all
+#[derive(Debug, PartialEq, Eq)]
+struct PlannedRename {
+    from: String,
+    to: String,
+}
+
+// HandleRenameAll renames every stash whose project name matches pattern, substituting replacement
+// (which may reference capture groups such as $1). Nothing is renamed if any rename would collide with
+// an existing stash or with another rename. When dry_run is set the renames are only printed.
+pub fn handle_rename_all(pattern: &str, replacement: &str, dry_run: bool, force: bool) -> Result<(), Box<dyn std::error::Error>> {
+    let regex = Regex::new(pattern).map_err(|e| format!("Invalid --match pattern: {}", e))?;
+    let stashes_dir = utils::get_stashes_dir()?;
+
+    utils::log_info(&format!("Scanning stashes in: {}", stashes_dir.display()));
+    let project_names: Vec<String> = utils::list_stash_files(&stashes_dir)?
+        .iter()
+        .filter_map(|path| utils::project_name_from_stash_file(path))
+        .map(|name| name.to_string())
+        .collect();
+
+    let renames = plan_renames(&project_names, &regex, replacement);
+    if renames.is_empty() {
+        println!("No stashes match {}", color_string(pattern, BOLD));
+        return Ok(());
+    }
+
+    refuse_rename_collisions(&renames, &project_names)?;
+
+    if !force {
+        let mut read_only_count = 0;
+        for rename in &renames {
+            if is_read_only_stash(&listed_stash_path(&stashes_dir, &rename.from))? {
+                read_only_count += 1;
+                println!("{} {} is read-only", color_string("Refused:", YELLOW), rename.from);
+            }
+        }
+        if read_only_count > 0 {
+            return Err(format!("{} stash(es) are read-only; use --force to rename them", read_only_count).into());
+        }
+    }
+
+    execute_renames(&stashes_dir, &renames, dry_run)
+}
+
+// HandleRepairNames renames stashes whose file names predate the current naming scheme, such as names
+// with characters that are now sanitized, so that apply finds them again. Nothing is renamed if any
+// rename would collide with an existing stash or with another rename. When dry_run is set the renames
+// are only printed.
+pub fn handle_repair_names(dry_run: bool) -> Result<(), Box<dyn std::error::Error>> {
+    let stashes_dir = utils::get_stashes_dir()?;
+
+    utils::log_info(&format!("Scanning stashes in: {}", stashes_dir.display()));
+    let project_names: Vec<String> = utils::list_stash_files(&stashes_dir)?
+        .iter()
+        .filter_map(|path| utils::project_name_from_stash_file(path))
+        .map(|name| name.to_string())
+        .collect();
+
+    let renames = plan_name_repairs(&project_names);
+    if renames.is_empty() {
+        println!("All stash names match the current naming scheme");
+        return Ok(());
+    }
+
+    refuse_rename_collisions(&renames, &project_names)?;
+    execute_renames(&stashes_dir, &renames, dry_run)
+}
+
+// plan_name_repairs returns a rename for each stash name that the current sanitization would change
+fn plan_name_repairs(project_names: &[String]) -> Vec<PlannedRename> {
+    project_names
+        .iter()
+        .map(|name| PlannedRename {
+            from: name.clone(),
+            to: utils::sanitize_file_name(name),
+        })
+        .filter(|rename| rename.from != rename.to)
+        .collect()
+}
+
+// refuse_rename_collisions prints each rename that would collide and fails if there are any
+fn refuse_rename_collisions(renames: &[PlannedRename], existing: &[String]) -> Result<(), Box<dyn std::error::Error>> {
+    let collisions = find_rename_collisions(renames, existing);
+    for rename in &collisions {
+        println!(
+            "{} {} -> {} would collide with an existing stash",
+            color_string("Refused:", YELLOW),
+            rename.from,
+            color_string(&rename.to, BOLD)
+        );
+    }
+    if !collisions.is_empty() {
+        return Err(format!("{} rename(s) would collide; no stashes were renamed", collisions.len()).into());
+    }
+    Ok(())
+}
+
+// execute_renames renames each planned stash file in stashes_dir, or only prints the renames when
+// dry_run is set
+fn execute_renames(stashes_dir: &Path, renames: &[PlannedRename], dry_run: bool) -> Result<(), Box<dyn std::error::Error>> {
+    for rename in renames {
+        if dry_run {
+            println!("Would rename {} -> {}", rename.from, color_string(&rename.to, BOLD));
+            continue;
+        }
+
+        let from_path = listed_stash_path(stashes_dir, &rename.from);
+        let to_path = stashes_dir.join(utils::stash_file_name(&rename.to));
+        utils::log_info(&format!("Renaming {} to {}", from_path.display(), to_path.display()));
+        fs::rename(&from_path, &to_path)?;
+        println!("{} {} -> {}", color_string("Renamed", GREEN), rename.from, color_string(&rename.to, BOLD));
+    }
+
+    Ok(())
+}
+
+// listed_stash_path returns the path of the stash file a name from list_stash_files came from. Legacy
+// names are not what stash_file_name would produce, so the path is built without sanitizing.
+fn listed_stash_path(stashes_dir: &Path, project_name: &str) -> PathBuf {
+    stashes_dir.join(format!("stash-{}.md", project_name))
+}
+
+// plan_renames applies the pattern to each project name, keeping only names that actually change.
+// Targets are sanitized the same way stash file names are.
+fn plan_renames(project_names: &[String], regex: &Regex, replacement: &str) -> Vec<PlannedRename> {
+    project_names
+        .iter()
+        .filter(|name| regex.is_match(name))
+        .map(|name| PlannedRename {
+            from: name.clone(),
+            to: utils::sanitize_file_name(&regex.replace_all(name, replacement)),
+        })
+        .filter(|rename| rename.from != rename.to)
+        .collect()
+}
+
+// find_rename_collisions returns the renames whose target already exists as a stash or is shared
+// with another rename
+fn find_rename_collisions<'a>(renames: &'a [PlannedRename], existing: &[String]) -> Vec<&'a PlannedRename> {
+    renames
+        .iter()
+        .filter(|rename| {
+            existing.contains(&rename.to)
+                || renames.iter().filter(|other| other.to == rename.to).count() > 1
+        })
+        .collect()
+}
+
+// HandleUninstall completely removes the .agstash directory and all its contents from the user's home directory.
+// When dry_run is set it only lists what would be removed.
+pub fn handle_uninstall(dry_run: bool) -> Result<(), Box<dyn std::error::Error>> {
+    let agstash_dir = utils::get_agstash_dir()?;
+
+    utils::log_info(&format!("Located agstash directory at: {}", agstash_dir.display()));
+
+    if dry_run && utils::file_exists(&agstash_dir) {
+        let entries = list_tree(&agstash_dir)?;
+        let total_bytes: u64 = entries.iter().map(|(_, size)| size).sum();
+        for (path, _) in &entries {
+            println!("Would remove {}", path.display());
+        }
+        println!(
+            "{} {} entries, {} bytes",
+            color_string("Would remove", YELLOW),
+            entries.len(),
+            total_bytes
+        );
+    } else if utils::file_exists(&agstash_dir) {
+        utils::log_info(&format!("Removing agstash directory: {}", agstash_dir.display()));
+        fs::remove_dir_all(&agstash_dir)?;
+        utils::log_info("Successfully removed agstash directory");
+        println!("{} {}", color_string("Removed", RED), agstash_dir.display());
+    } else {
+        utils::log_info(&format!("agstash directory does not exist: {}", agstash_dir.display()));
+        println!(
+            "{} {}",
+            color_string(".agstash directory", BOLD),
+            color_string("does not exist.", YELLOW)
+        );
+    }
+
+    Ok(())
+}
+
+// list_tree returns dir and everything beneath it, parents before their contents, with the size in
+// bytes of each file (0 for directories). Symbolic links are listed but not followed.
+fn list_tree(dir: &Path) -> Result<Vec<(PathBuf, u64)>, Box<dyn std::error::Error>> {
+    let mut entries = vec![(dir.to_path_buf(), 0)];
+    let mut children: Vec<PathBuf> = fs::read_dir(dir)?
+        .map(|entry| entry.map(|entry| entry.path()))
+        .collect::<Result<_, _>>()?;
+    children.sort();
+
+    for child in children {
+        let metadata = fs::symlink_metadata(&child)?;
+        if metadata.is_dir() {
+            entries.extend(list_tree(&child)?);
+        } else {
+            entries.push((child, metadata.len()));
+        }
+    }
+    Ok(entries)
+}
+
+#[cfg(test)]
+mod tests {
+    use std::fs;
+    use std::env;
+    use std::path::{Path, PathBuf};
+    use tempfile::TempDir;
+    use serial_test::serial;
+
+    use std::io;
+    use std::sync::atomic::{AtomicBool, Ordering};
+    use std::thread;
+    use std::time::Duration;
+    use crate::commands;
+    use crate::utils;
+
+    #[test]
+    #[serial]
+    fn test_handle_init() {
+        // Create a temporary directory and change to it
+        let temp_dir = TempDir::new().unwrap();
+        let original_dir = env::current_dir().unwrap();
+        env::set_current_dir(&temp_dir).unwrap();
+        
+        // Ensure cleanup happens
+        let _cleanup = defer::defer(|| {
+            let _ = env::set_current_dir(&original_dir);
+        });
+
+        // Create a .git directory to establish project root
+        fs::create_dir(".git").unwrap();
+
+        // Run init command with force to bypass confirmation
+        let result = commands::handle_init(&commands::InitOptions { force: true, ..Default::default() });
+        assert!(result.is_ok());
+
+        // Check if AGENTS.md was created
+        let agents_file = temp_dir.path().join("AGENTS.md");
+        assert!(agents_file.exists());
+
+        // Read the content and verify it
+        let content = fs::read_to_string(&agents_file).unwrap();
+        let expected_content = "# AGENTS\n\n## Project\n\n- Describe what the project does and how it is laid out\n\n## Testing\n\n- Name the command that runs the tests\n";
+        assert_eq!(content, expected_content);
+        assert!(utils::is_valid_agents(&content));
+        assert!(!utils::is_header_only(&content));
+
+        // Try to init again - should overwrite with force=true
+        let result = commands::handle_init(&commands::InitOptions { force: true, ..Default::default() });
+        assert!(result.is_ok());
+    }
+
+    #[test]
+    #[serial]
+    fn test_handle_init_allow_empty() {
+        // Create a temporary directory and change to it
+        let temp_dir = TempDir::new().unwrap();
+        let original_dir = env::current_dir().unwrap();
+        env::set_current_dir(&temp_dir).unwrap();
+        
+        // Ensure cleanup happens
+        let _cleanup = defer::defer(|| {
+            let _ = env::set_current_dir(&original_dir);
+        });
+
+        // Create a .git directory to establish project root
+        fs::create_dir(".git").unwrap();
+
+        // Appended content that is blank, or only repeats the header, is refused
+        let snippet_path = temp_dir.path().join("snippet.md");
+        fs::write(&snippet_path, "\n# AGENTS\n   \n").unwrap();
+        let options = commands::InitOptions {
+            force: true,
+            append: Some(snippet_path.clone()),
+            ..Default::default()
+        };
+        let err = commands::handle_init(&options).unwrap_err();
+        assert!(err.to_string().contains("--allow-empty"));
+        assert!(!Path::new("AGENTS.md").exists());
+
+        // --allow-empty writes it anyway
+        let empty_options = commands::InitOptions { allow_empty: true, ..options };
+        assert!(commands::handle_init(&empty_options).is_ok());
+        assert!(utils::is_header_only(&fs::read_to_string("AGENTS.md").unwrap()));
+        let options = commands::InitOptions { allow_empty: false, ..empty_options };
+
+        // A template with a body is written
+        fs::write(&snippet_path, "## Testing\n\n- Run cargo test\n").unwrap();
+        assert!(commands::handle_init(&options).is_ok());
+        assert_eq!(fs::read_to_string("AGENTS.md").unwrap(), "# AGENTS\n\n## Testing\n\n- Run cargo test\n");
+
+        // The built-in template has a body, so it is written without --allow-empty
+        assert!(commands::handle_init(&commands::InitOptions { force: true, ..Default::default() }).is_ok());
+        assert_eq!(fs::read_to_string("AGENTS.md").unwrap(), commands::DEFAULT_TEMPLATE);
+    }
+
+    #[test]
+    #[serial]
+    #[cfg(unix)]
+    fn test_handle_init_chmod() {
+        use std::os::unix::fs::PermissionsExt;
+
+        // Create a temporary directory and change to it
+        let temp_dir = TempDir::new().unwrap();
+        let original_dir = env::current_dir().unwrap();
+        env::set_current_dir(&temp_dir).unwrap();
+        
+        // Ensure cleanup happens
+        let _cleanup = defer::defer(|| {
+            let _ = env::set_current_dir(&original_dir);
+        });
+
+        let result = commands::handle_init(&commands::InitOptions {
+            force: true,
+            chmod: Some(0o600),
+            ..Default::default()
+        });
+        assert!(result.is_ok());
+
+        let mode = fs::metadata("AGENTS.md").unwrap().permissions().mode();
+        assert_eq!(mode & 0o7777, 0o600);
+    }
+
+    #[test]
+    #[serial]
+    fn test_handle_init_append() {
+        // Create a temporary directory and change to it
+        let temp_dir = TempDir::new().unwrap();
+        let original_dir = env::current_dir().unwrap();
+        env::set_current_dir(&temp_dir).unwrap();
+        
+        // Ensure cleanup happens
+        let _cleanup = defer::defer(|| {
+            let _ = env::set_current_dir(&original_dir);
+        });
+
+        let snippet_path = temp_dir.path().join("snippet.md");
+        fs::write(&snippet_path, "## Testing\n- Run the full suite before pushing\n").unwrap();
+
+        let result = commands::handle_init(&commands::InitOptions {
+            force: true,
+            append: Some(snippet_path),
+            ..Default::default()
+        });
+        assert!(result.is_ok());
+
+        let content = fs::read_to_string("AGENTS.md").unwrap();
+        assert_eq!(content, "# AGENTS\n\n## Testing\n- Run the full suite before pushing\n");
+        assert!(utils::is_valid_agents(&content));
+
+        // A missing snippet fails before anything is written
+        fs::remove_file("AGENTS.md").unwrap();
+        let result = commands::handle_init(&commands::InitOptions {
+            force: true,
+            append: Some(temp_dir.path().join("missing.md")),
+            ..Default::default()
+        });
+        assert!(result.is_err());
+        assert!(!Path::new("AGENTS.md").exists());
+    }
+
+    #[test]
+    fn test_interactive_template() {
+        let mut input = io::Cursor::new("Rust CLI\ncargo test\nrustfmt defaults, no unwrap in library code,\n");
+        let mut output = Vec::new();
+        let content = commands::interactive_template(&mut input, &mut output).unwrap();
+        assert_eq!(
+            content,
+            "# AGENTS\n\n## Project\n\nThis is a Rust CLI project.\n\n## Testing\n\n- Run `cargo test` and make sure it passes before finishing a change.\n\n## Style\n\n- rustfmt defaults\n- no unwrap in library code\n"
+        );
+        assert!(String::from_utf8(output).unwrap().contains("Project type"));
+
+        // Blank answers, or running out of input, leave sections out
+        let mut input = io::Cursor::new("\ngo test ./...\n");
+        let content = commands::interactive_template(&mut input, &mut Vec::new()).unwrap();
+        assert_eq!(content, "# AGENTS\n\n## Testing\n\n- Run `go test ./...` and make sure it passes before finishing a change.\n");
+        assert!(utils::is_valid_agents(&content));
+    }
+
+    #[test]
+    #[serial]
+    fn test_handle_clean() {
+        // Create a temporary directory and change to it
+        let temp_dir = TempDir::new().unwrap();
+        let original_dir = env::current_dir().unwrap();
+        env::set_current_dir(&temp_dir).unwrap();
+        
+        // Ensure cleanup happens
+        let _cleanup = defer::defer(|| {
+            let _ = env::set_current_dir(&original_dir);
+        });
+
+        // Create a .git directory to establish project root
+        fs::create_dir(".git").unwrap();
+
+        // Create an AGENTS.md file
+        let agents_file = "AGENTS.md";
+        let agents_content = "# AGENTS\n\nTest content";
+        fs::write(agents_file, agents_content).unwrap();
+
+        // Verify the file exists
+        assert!(Path::new(agents_file).exists());
+
+        // Run clean command
+        let result = commands::handle_clean(&commands::CleanOptions::default());
+        assert!(result.is_ok());
+
+        // Check if AGENTS.md was removed
+        assert!(!Path::new(agents_file).exists());
+
+        // Try to clean again - should not error
+        let result = commands::handle_clean(&commands::CleanOptions::default());
+        assert!(result.is_ok());
+    }
+
+    #[test]
+    #[serial]
+    fn test_safe_mode() {
+        // Create a temporary directory and change to it
+        let temp_dir = TempDir::new().unwrap();
+        let original_dir = env::current_dir().unwrap();
+        env::set_current_dir(&temp_dir).unwrap();
+        
+        // Ensure cleanup happens
+        let _cleanup = defer::defer(|| {
+            let _ = env::set_current_dir(&original_dir);
+            utils::set_safe_mode(false);
+        });
+
+        // Outside a repository init and clean refuse to touch AGENTS.md
+        utils::set_safe_mode(true);
+        fs::write("AGENTS.md", "# AGENTS\n\nStray file").unwrap();
+        assert!(commands::handle_clean(&commands::CleanOptions::default()).is_err());
+        assert!(commands::handle_init(&commands::InitOptions { force: true, ..Default::default() }).is_err());
+        assert_eq!(fs::read_to_string("AGENTS.md").unwrap(), "# AGENTS\n\nStray file");
+
+        // Inside one they go ahead
+        fs::create_dir(".git").unwrap();
+        assert!(commands::handle_init(&commands::InitOptions { force: true, ..Default::default() }).is_ok());
+        assert_eq!(fs::read_to_string("AGENTS.md").unwrap(), commands::DEFAULT_TEMPLATE);
+        assert!(commands::handle_clean(&commands::CleanOptions::default()).is_ok());
+        assert!(!Path::new("AGENTS.md").exists());
+    }
+
+    #[test]
+    #[serial]
+    fn test_safe_mode_apply() {
+        // A directory with a stash but no git repository
+        let temp_dir = TempDir::new().unwrap();
+        let project_dir = temp_dir.path().join("unsafe-project");
+        fs::create_dir(&project_dir).unwrap();
+        fs::write(project_dir.join("AGENTS.md"), "# AGENTS\n\nStashed content").unwrap();
+        let _cleanup = defer::defer(|| utils::set_safe_mode(false));
+
+        // Set up HOME environment variable to temp directory
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
+
+        let stash_options = commands::StashOptions {
+            force_dir: Some(project_dir.clone()),
+            ..Default::default()
+        };
+        assert!(commands::handle_stash(&stash_options).is_ok());
+        fs::remove_file(project_dir.join("AGENTS.md")).unwrap();
+
+        utils::set_safe_mode(true);
+        let options = commands::ApplyOptions {
+            force_dir: Some(project_dir.clone()),
+            ..Default::default()
+        };
+        let err = commands::handle_apply(&options).unwrap_err();
+        assert!(err.to_string().contains("not inside a git repository"));
+        assert!(!project_dir.join("AGENTS.md").exists());
+    }
+
+    #[test]
+    #[serial]
+    fn test_handle_clean_stash_first() {
+        // Create a temporary directory and change to it
+        let temp_dir = TempDir::new().unwrap();
+        let original_dir = env::current_dir().unwrap();
+        env::set_current_dir(&temp_dir).unwrap();
+        
+        // Ensure cleanup happens
+        let _cleanup = defer::defer(|| {
+            let _ = env::set_current_dir(&original_dir);
+        });
+
+        // Create a .git directory to establish project root
+        fs::create_dir(".git").unwrap();
+
+        // Set up HOME environment variable to temp directory
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
+
+        let options = commands::CleanOptions {
+            stash_first: true,
+            name: Some("experiment-1".to_string()),
+            ..Default::default()
+        };
+
+        // Invalid content cannot be stashed, so the local file is kept
+        fs::write("AGENTS.md", "no header").unwrap();
+        assert!(commands::handle_clean(&options).is_ok());
+        assert_eq!(fs::read_to_string("AGENTS.md").unwrap(), "no header");
+        assert!(!utils::get_stash_path("experiment-1").unwrap().exists());
+
+        // Valid content is archived under the name before the file is removed
+        fs::write("AGENTS.md", "# AGENTS\n\nExperimental guidance").unwrap();
+        assert!(commands::handle_clean(&options).is_ok());
+        assert!(!Path::new("AGENTS.md").exists());
+        let stashed = fs::read_to_string(utils::get_stash_path("experiment-1").unwrap()).unwrap();
+        assert_eq!(stashed, "# AGENTS\n\nExperimental guidance");
+
+        // Without a name the project's stash is used
+        fs::write("AGENTS.md", "# AGENTS\n\nProject guidance").unwrap();
+        let options = commands::CleanOptions {
+            stash_first: true,
+            ..Default::default()
+        };
+        assert!(commands::handle_clean(&options).is_ok());
+        let project_name = temp_dir.path().file_name().unwrap().to_str().unwrap();
+        let stashed = fs::read_to_string(utils::get_stash_path(project_name).unwrap()).unwrap();
+        assert_eq!(stashed, "# AGENTS\n\nProject guidance");
+    }
+
+    #[test]
+    #[serial]
+    fn test_handle_clean_only_if_stashed() {
+        // Create a temporary directory and change to it
+        let temp_dir = TempDir::new().unwrap();
+        let original_dir = env::current_dir().unwrap();
+        env::set_current_dir(&temp_dir).unwrap();
+        
+        // Ensure cleanup happens
+        let _cleanup = defer::defer(|| {
+            let _ = env::set_current_dir(&original_dir);
+        });
+
+        // Create a .git directory to establish project root
+        fs::create_dir(".git").unwrap();
+
+        // Set up HOME environment variable to temp directory
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
+
+        let options = commands::CleanOptions {
+            only_if_stashed: true,
+            ..Default::default()
+        };
+
+        // No stash: refused
+        fs::write("AGENTS.md", "# AGENTS\n\nLocal guidance").unwrap();
+        let err = commands::handle_clean(&options).unwrap_err();
+        assert!(err.to_string().contains("No stash found"));
+        assert!(Path::new("AGENTS.md").exists());
+
+        // Differing stash: refused
+        assert!(commands::handle_stash(&commands::StashOptions::default()).is_ok());
+        fs::write("AGENTS.md", "# AGENTS\n\nEdited guidance").unwrap();
+        let err = commands::handle_clean(&options).unwrap_err();
+        assert!(err.to_string().contains("differs from the stash"));
+        assert_eq!(fs::read_to_string("AGENTS.md").unwrap(), "# AGENTS\n\nEdited guidance");
+
+        // Matching stash: removed
+        assert!(commands::handle_stash(&commands::StashOptions::default()).is_ok());
+        assert!(commands::handle_clean(&options).is_ok());
+        assert!(!Path::new("AGENTS.md").exists());
+    }
+
+    #[test]
+    #[serial]
+    #[cfg(unix)]
+    fn test_handle_clean_only_if_stashed_link() {
+        // Create a temporary directory and change to it
+        let temp_dir = TempDir::new().unwrap();
+        let original_dir = env::current_dir().unwrap();
+        env::set_current_dir(&temp_dir).unwrap();
+        
+        // Ensure cleanup happens
+        let _cleanup = defer::defer(|| {
+            let _ = env::set_current_dir(&original_dir);
+        });
+
+        // Create a .git directory to establish project root
+        fs::create_dir(".git").unwrap();
+
+        // Set up HOME environment variable to temp directory
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
+
+        let options = commands::CleanOptions {
+            only_if_stashed: true,
+            ..Default::default()
+        };
+
+        // A linked stash points back at AGENTS.md, so it is not a copy to fall back on
+        fs::write("AGENTS.md", "# AGENTS\n\nLocal guidance").unwrap();
+        assert!(commands::handle_stash(&commands::StashOptions { link: true, ..Default::default() }).is_ok());
+        let err = commands::handle_clean(&options).unwrap_err();
+        assert!(err.to_string().contains("is a link"));
+        assert_eq!(fs::read_to_string("AGENTS.md").unwrap(), "# AGENTS\n\nLocal guidance");
+
+        // Once a real copy is stashed the file can go
+        assert!(commands::handle_stash(&commands::StashOptions::default()).is_ok());
+        assert!(commands::handle_clean(&options).is_ok());
+        assert!(!Path::new("AGENTS.md").exists());
+    }
+
+    #[test]
+    #[serial]
+    fn test_handle_stash() {
+        // Create a temporary directory and change to it
+        let temp_dir = TempDir::new().unwrap();
+        let original_dir = env::current_dir().unwrap();
+        env::set_current_dir(&temp_dir).unwrap();
+        
+        // Ensure cleanup happens
+        let _cleanup = defer::defer(|| {
+            let _ = env::set_current_dir(&original_dir);
+        });
+
+        // Create a .git directory to establish project root
+        fs::create_dir(".git").unwrap();
+
+        // Set up HOME environment variable to temp directory
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
+
+        // Create an AGENTS.md file with valid content
+        let agents_file = "AGENTS.md";
+        let agents_content = "# AGENTS\n\nTest content";
+        fs::write(agents_file, agents_content).unwrap();
+
+        // Run stash command
+        let result = commands::handle_stash(&commands::StashOptions::default());
+        assert!(result.is_ok());
+
+        // Check if the file was stashed
+        let project_name = temp_dir.path().file_name().unwrap().to_str().unwrap();
+        let stash_path = dirs::home_dir()
+            .unwrap()
+            .join(".agstash")
+            .join("stashes")
+            .join(utils::stash_file_name(project_name));
+            
+        assert!(stash_path.exists());
+
+        // Read the stashed content and verify it
+        let stashed_content = fs::read_to_string(&stash_path).unwrap();
+        assert_eq!(stashed_content, agents_content);
+    }
+
+    #[test]
+    #[serial]
+    fn test_handle_stash_read_only() {
+        // Create a temporary directory and change to it
+        let temp_dir = TempDir::new().unwrap();
+        let original_dir = env::current_dir().unwrap();
+        env::set_current_dir(&temp_dir).unwrap();
+        
+        // Ensure cleanup happens
+        let _cleanup = defer::defer(|| {
+            let _ = env::set_current_dir(&original_dir);
+        });
+
+        // Create a .git directory to establish project root
+        fs::create_dir(".git").unwrap();
+
+        // Set up HOME environment variable to temp directory
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
+
+        fs::write("AGENTS.md", "# AGENTS\n\nCanonical").unwrap();
+        let result = commands::handle_stash(&commands::StashOptions { read_only: true, ..Default::default() });
+        assert!(result.is_ok());
+
+        let project_name = temp_dir.path().file_name().unwrap().to_str().unwrap();
+        let stash_path = utils::get_stash_path(project_name).unwrap();
+        assert!(fs::metadata(&stash_path).unwrap().permissions().readonly());
+
+        // A plain stash refuses to replace the read-only one
+        fs::write("AGENTS.md", "# AGENTS\n\nCareless edit").unwrap();
+        let result = commands::handle_stash(&commands::StashOptions::default());
+        assert!(result.unwrap_err().to_string().contains("read-only"));
+        assert_eq!(fs::read_to_string(&stash_path).unwrap(), "# AGENTS\n\nCanonical");
+
+        // So does renaming it
+        assert!(commands::handle_rename_all(".+", "renamed", false, false).is_err());
+        assert!(stash_path.exists());
+
+        // --force overwrites it, leaving a writable stash behind
+        let result = commands::handle_stash(&commands::StashOptions { force: true, ..Default::default() });
+        assert!(result.is_ok());
+        assert_eq!(fs::read_to_string(&stash_path).unwrap(), "# AGENTS\n\nCareless edit");
+        assert!(!fs::metadata(&stash_path).unwrap().permissions().readonly());
+    }
+
+    #[test]
+    #[serial]
+    fn test_handle_stash_quiet_validate() {
+        // Create a temporary directory and change to it
+        let temp_dir = TempDir::new().unwrap();
+        let original_dir = env::current_dir().unwrap();
+        env::set_current_dir(&temp_dir).unwrap();
+        
+        // Ensure cleanup happens
+        let _cleanup = defer::defer(|| {
+            let _ = env::set_current_dir(&original_dir);
+        });
+
+        // Create a .git directory to establish project root
+        fs::create_dir(".git").unwrap();
+
+        // Set up HOME environment variable to temp directory
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
+
+        fs::write("AGENTS.md", "Draft notes without a header").unwrap();
+        let project_name = temp_dir.path().file_name().unwrap().to_str().unwrap();
+        let stash_path = utils::get_stash_path(project_name).unwrap();
+
+        // By default invalid content is not stashed
+        assert!(commands::handle_stash(&commands::StashOptions::default()).is_ok());
+        assert!(!stash_path.exists());
+
+        // With --quiet-validate it is stashed, and the command still fails
+        let result = commands::handle_stash(&commands::StashOptions { quiet_validate: true, ..Default::default() });
+        assert!(result.unwrap_err().to_string().contains("Stashed invalid AGENTS.md content"));
+        assert_eq!(fs::read_to_string(&stash_path).unwrap(), "Draft notes without a header");
+
+        // Valid content stashes cleanly either way
+        fs::write("AGENTS.md", "# AGENTS\n\nFinished notes").unwrap();
+        let result = commands::handle_stash(&commands::StashOptions { quiet_validate: true, ..Default::default() });
+        assert!(result.is_ok());
+    }
+
+    #[test]
+    #[serial]
+    fn test_handle_stash_lint() {
+        // Create a temporary directory and change to it
+        let temp_dir = TempDir::new().unwrap();
+        let original_dir = env::current_dir().unwrap();
+        env::set_current_dir(&temp_dir).unwrap();
+        
+        // Ensure cleanup happens
+        let _cleanup = defer::defer(|| {
+            let _ = env::set_current_dir(&original_dir);
+            utils::set_bullet_style(None);
+        });
+
+        // Create a .git directory to establish project root
+        fs::create_dir(".git").unwrap();
+
+        // Set up HOME environment variable to temp directory
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
+
+        utils::set_bullet_style(Some(utils::BulletStyle { prefix: Some("- ".to_string()), no_trailing_period: true }));
+        let project_name = temp_dir.path().file_name().unwrap().to_str().unwrap();
+        let stash_path = utils::get_stash_path(project_name).unwrap();
+        let options = commands::StashOptions { lint: true, ..Default::default() };
+
+        fs::write("AGENTS.md", "# AGENTS\n\n* Use tabs.\n").unwrap();
+        let err = commands::handle_stash(&options).unwrap_err();
+        assert!(err.to_string().contains("2 validation warning(s)"));
+        assert!(!stash_path.exists());
+
+        // Without --lint the warnings do not block
+        assert!(commands::handle_stash(&commands::StashOptions::default()).is_ok());
+        assert!(stash_path.exists());
+
+        fs::write("AGENTS.md", "# AGENTS\n\n- Use tabs\n").unwrap();
+        assert!(commands::handle_stash(&options).is_ok());
+        assert_eq!(fs::read_to_string(&stash_path).unwrap(), "# AGENTS\n\n- Use tabs\n");
+    }
+
+    #[test]
+    #[serial]
+    fn test_handle_stash_dedupe_global() {
+        // Create a temporary directory and change to it
+        let temp_dir = TempDir::new().unwrap();
+        let original_dir = env::current_dir().unwrap();
+        env::set_current_dir(&temp_dir).unwrap();
+        
+        // Ensure cleanup happens
+        let _cleanup = defer::defer(|| {
+            let _ = env::set_current_dir(&original_dir);
+        });
+
+        // Set up HOME environment variable to temp directory
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
+
+        let shared = "# AGENTS\n\n- shared rule\n";
+        for project in ["alpha", "beta"] {
+            fs::create_dir(project).unwrap();
+            fs::write(Path::new(project).join("AGENTS.md"), shared).unwrap();
+        }
+        let stash = |project: &str| {
+            commands::handle_stash(&commands::StashOptions {
+                force_dir: Some(PathBuf::from(project)),
+                dedupe_global: true,
+                ..Default::default()
+            })
+        };
+        assert!(stash("alpha").is_ok());
+        assert!(stash("beta").is_ok());
+
+        // beta's stash shares alpha's content rather than copying it
+        let alpha_stash = utils::get_stash_path("alpha").unwrap();
+        let beta_stash = utils::get_stash_path("beta").unwrap();
+        assert!(utils::is_same_file(&alpha_stash, &beta_stash).unwrap());
+
+        // Applying beta reads the shared content
+        fs::remove_file("beta/AGENTS.md").unwrap();
+        let options = commands::ApplyOptions { force_dir: Some(PathBuf::from("beta")), ..Default::default() };
+        assert!(commands::handle_apply(&options).is_ok());
+        assert_eq!(fs::read_to_string("beta/AGENTS.md").unwrap(), shared);
+
+        // Re-stashing different content for beta leaves alpha untouched
+        fs::write("beta/AGENTS.md", "# AGENTS\n\n- beta rule\n").unwrap();
+        assert!(stash("beta").is_ok());
+        assert!(!utils::is_same_file(&alpha_stash, &beta_stash).unwrap());
+        assert_eq!(fs::read_to_string(&alpha_stash).unwrap(), shared);
+    }
+
+    // SharedBuffer is a writer whose output the test can read back
+    #[derive(Clone, Default)]
+    struct SharedBuffer(std::sync::Arc<std::sync::Mutex<Vec<u8>>>);
+
+    impl std::io::Write for SharedBuffer {
+        fn write(&mut self, buf: &[u8]) -> std::io::Result<usize> {
+            self.0.lock().unwrap().extend_from_slice(buf);
+            Ok(buf.len())
+        }
+
+        fn flush(&mut self) -> std::io::Result<()> {
+            Ok(())
+        }
+    }
+
+    #[test]
+    #[serial]
+    fn test_handle_stash_trace() {
+        // Create a temporary directory and change to it
+        let temp_dir = TempDir::new().unwrap();
+        let original_dir = env::current_dir().unwrap();
+        env::set_current_dir(&temp_dir).unwrap();
+        
+        // Ensure cleanup happens
+        let _cleanup = defer::defer(|| {
+            let _ = env::set_current_dir(&original_dir);
+            utils::set_trace_output(None);
+        });
+
+        // Create a .git directory to establish project root
+        fs::create_dir(".git").unwrap();
+
+        // Set up HOME environment variable to temp directory
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
+
+        fs::write("AGENTS.md", "# AGENTS\n\nTraced content").unwrap();
+        let buffer = SharedBuffer::default();
+        utils::set_trace_output(Some(Box::new(buffer.clone())));
+        assert!(commands::handle_stash(&commands::StashOptions::default()).is_ok());
+        utils::set_trace_output(None);
+
+        let trace = String::from_utf8(buffer.0.lock().unwrap().clone()).unwrap();
+        let lines: Vec<&str> = trace.lines().collect();
+        assert_eq!(lines.len(), 3, "unexpected trace: {}", trace);
+        assert!(lines[0].starts_with("TRACE: find project root "));
+        assert!(lines[1].starts_with("TRACE: read ") && lines[1].contains("AGENTS.md"));
+        assert!(lines[2].starts_with("TRACE: atomic write ") && lines[2].contains("stash-"));
+        for line in lines {
+            let duration = line.rsplit(" took ").next().unwrap();
+            assert!(duration.ends_with('s'), "no duration in: {}", line);
+        }
+
+        // Nothing is traced once tracing is off
+        assert!(commands::handle_stash(&commands::StashOptions::default()).is_ok());
+        assert_eq!(buffer.0.lock().unwrap().len(), trace.len());
+    }
+
+    #[test]
+    #[serial]
+    fn test_handle_stash_invalid_content() {
+        // Create a temporary directory and change to it
+        let temp_dir = TempDir::new().unwrap();
+        let original_dir = env::current_dir().unwrap();
+        env::set_current_dir(&temp_dir).unwrap();
+        
+        // Ensure cleanup happens
+        let _cleanup = defer::defer(|| {
+            let _ = env::set_current_dir(&original_dir);
+        });
+
+        // Create a .git directory to establish project root
+        fs::create_dir(".git").unwrap();
+
+        // Set up HOME environment variable to temp directory
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
+
+        // Create an AGENTS.md file with invalid content (missing header)
+        let agents_file = "AGENTS.md";
+        let agents_content = "Invalid content without header";
+        fs::write(agents_file, agents_content).unwrap();
+
+        // Run stash command - should not error but should not stash
+        let result = commands::handle_stash(&commands::StashOptions::default());
+        assert!(result.is_ok());
+
+        // Check that no stash was created
+        let project_name = temp_dir.path().file_name().unwrap().to_str().unwrap();
+        let stash_path = dirs::home_dir()
+            .unwrap()
+            .join(".agstash")
+            .join("stashes")
+            .join(utils::stash_file_name(project_name));
+            
+        // The stash directory might still be created even if no file is stashed
+        // So we check if the specific stash file exists
+        assert!(!stash_path.exists());
+    }
+
+    #[test]
+    #[serial]
+    fn test_handle_stash_strip_comments() {
+        // Create a temporary directory and change to it
+        let temp_dir = TempDir::new().unwrap();
+        let original_dir = env::current_dir().unwrap();
+        env::set_current_dir(&temp_dir).unwrap();
+        
+        // Ensure cleanup happens
+        let _cleanup = defer::defer(|| {
+            let _ = env::set_current_dir(&original_dir);
+        });
+
+        // Create a .git directory to establish project root
+        fs::create_dir(".git").unwrap();
+
+        // Set up HOME environment variable to temp directory
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
+
+        // Create an AGENTS.md file with comments
+        let agents_file = "AGENTS.md";
+        let agents_content = "# AGENTS\n<!-- TODO: remove -->\n- Test content\n";
+        fs::write(agents_file, agents_content).unwrap();
+
+        // Run stash command with comment stripping
+        let result = commands::handle_stash(&commands::StashOptions {
+            strip_comments: true,
+            ..Default::default()
+        });
+        assert!(result.is_ok());
+
+        // Check the stash has the comments removed
+        let project_name = temp_dir.path().file_name().unwrap().to_str().unwrap();
+        let stash_path = dirs::home_dir()
+            .unwrap()
+            .join(".agstash")
+            .join("stashes")
+            .join(utils::stash_file_name(project_name));
+
+        let stashed_content = fs::read_to_string(&stash_path).unwrap();
+        assert_eq!(stashed_content, "# AGENTS\n- Test content\n");
+
+        // The local file must be left untouched
+        let local_content = fs::read_to_string(agents_file).unwrap();
+        assert_eq!(local_content, agents_content);
+    }
+
+    #[test]
+    fn test_exclude_sections() {
+        let content = "# AGENTS\n\n## Shared\n- shared\n\n## Secrets\n- token path\n### Machine\n- host\n\n## Notes\n- notes\n";
+
+        // A section goes with its subsections
+        let single = vec!["Secrets".to_string()];
+        assert_eq!(
+            commands::exclude_sections(content, &single),
+            "# AGENTS\n\n## Shared\n- shared\n\n## Notes\n- notes\n"
+        );
+
+        let multiple = vec!["secrets".to_string(), "Notes".to_string(), "Missing".to_string()];
+        assert_eq!(commands::exclude_sections(content, &multiple), "# AGENTS\n\n## Shared\n- shared\n\n");
+    }
+
+    #[test]
+    #[serial]
+    fn test_handle_stash_exclude_sections() {
+        // Create a temporary directory and change to it
+        let temp_dir = TempDir::new().unwrap();
+        let original_dir = env::current_dir().unwrap();
+        env::set_current_dir(&temp_dir).unwrap();
+        
+        // Ensure cleanup happens
+        let _cleanup = defer::defer(|| {
+            let _ = env::set_current_dir(&original_dir);
+        });
+
+        // Create a .git directory to establish project root
+        fs::create_dir(".git").unwrap();
+
+        // Set up HOME environment variable to temp directory
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
+
+        let local_content = "# AGENTS\n\n## Shared\n- shared\n\n## Secrets\n- ~/.ssh/work\n\n## Scratch\n- todo\n";
+        fs::write("AGENTS.md", local_content).unwrap();
+        let options = commands::StashOptions {
+            exclude_sections: vec!["Secrets".to_string(), "Scratch".to_string()],
+            ..Default::default()
+        };
+        assert!(commands::handle_stash(&options).is_ok());
+
+        // The sections are absent from the stash but kept locally
+        let project_name = temp_dir.path().file_name().unwrap().to_str().unwrap();
+        let stashed = fs::read_to_string(utils::get_stash_path(project_name).unwrap()).unwrap();
+        assert_eq!(stashed, "# AGENTS\n\n## Shared\n- shared\n\n");
+        assert_eq!(fs::read_to_string("AGENTS.md").unwrap(), local_content);
+
+        // Excluding the header section leaves invalid content, which is not stored
+        fs::write("AGENTS.md", "# AGENTS\n\nNew content").unwrap();
+        let options = commands::StashOptions {
+            exclude_sections: vec!["AGENTS".to_string()],
+            ..Default::default()
+        };
+        assert!(commands::handle_stash(&options).is_ok());
+        let stashed = fs::read_to_string(utils::get_stash_path(project_name).unwrap()).unwrap();
+        assert_eq!(stashed, "# AGENTS\n\n## Shared\n- shared\n\n");
+
+        // A heading inside a ~~~ block nested in a ``` block is not a section of its own
+        let local_content = "# AGENTS\n\n## Docs\n```md\n~~~\n## Secrets\n~~~\n```\nDocs text\n";
+        fs::write("AGENTS.md", local_content).unwrap();
+        let options = commands::StashOptions {
+            exclude_sections: vec!["Secrets".to_string()],
+            ..Default::default()
+        };
+        assert!(commands::handle_stash(&options).is_ok());
+        let stashed = fs::read_to_string(utils::get_stash_path(project_name).unwrap()).unwrap();
+        assert_eq!(stashed, local_content);
+    }
+
+    #[test]
+    #[serial]
+    fn test_handle_stash_strip_comments_invalid_result() {
+        // Create a temporary directory and change to it
+        let temp_dir = TempDir::new().unwrap();
+        let original_dir = env::current_dir().unwrap();
+        env::set_current_dir(&temp_dir).unwrap();
+        
+        // Ensure cleanup happens
+        let _cleanup = defer::defer(|| {
+            let _ = env::set_current_dir(&original_dir);
+        });
+
+        // Create a .git directory to establish project root
+        fs::create_dir(".git").unwrap();
+
+        // Set up HOME environment variable to temp directory
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
+
+        // The header only exists inside a comment, so stripping leaves invalid content
+        let agents_file = "AGENTS.md";
+        fs::write(agents_file, "<!-- # AGENTS -->\n- Test content\n").unwrap();
+
+        let result = commands::handle_stash(&commands::StashOptions {
+            strip_comments: true,
+            ..Default::default()
+        });
+        assert!(result.is_ok());
+
+        // Check that no stash was created
+        let project_name = temp_dir.path().file_name().unwrap().to_str().unwrap();
+        let stash_path = dirs::home_dir()
+            .unwrap()
+            .join(".agstash")
+            .join("stashes")
+            .join(utils::stash_file_name(project_name));
+        assert!(!stash_path.exists());
+    }
+
+    #[test]
+    #[serial]
+    fn test_watch_stash() {
+        // Create a temporary directory to act as the project
+        let temp_dir = TempDir::new().unwrap();
+        let project_dir = temp_dir.path().join("watched");
+        fs::create_dir(&project_dir).unwrap();
+
+        // Set up HOME environment variable to temp directory
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
+
+        let agents_path = project_dir.join("AGENTS.md");
+        let stash_path = utils::get_stash_path("watched").unwrap();
+        fs::write(&agents_path, "# AGENTS\n\nFirst version").unwrap();
+
+        // wait_for polls until the stash holds the expected content
+        let wait_for = |expected: &str| {
+            let deadline = std::time::Instant::now() + Duration::from_secs(5);
+            while std::time::Instant::now() < deadline {
+                if fs::read_to_string(&stash_path).map(|content| content == expected).unwrap_or(false) {
+                    return true;
+                }
+                thread::sleep(Duration::from_millis(10));
+            }
+            false
+        };
+
+        let stop = AtomicBool::new(false);
+        let options = commands::StashOptions::default();
+        thread::scope(|scope| {
+            let watcher = scope.spawn(|| {
+                commands::watch_stash(&agents_path, "watched", &options, &stop, Duration::from_millis(20)).is_ok()
+            });
+
+            // The initial content is stashed, then each settled edit
+            assert!(wait_for("# AGENTS\n\nFirst version"));
+            fs::write(&agents_path, "# AGENTS\n\nSecond version").unwrap();
+            assert!(wait_for("# AGENTS\n\nSecond version"));
+
+            // Invalid content is skipped and the watcher keeps running
+            fs::write(&agents_path, "no header").unwrap();
+            thread::sleep(Duration::from_millis(200));
+            assert_eq!(fs::read_to_string(&stash_path).unwrap(), "# AGENTS\n\nSecond version");
+            fs::write(&agents_path, "# AGENTS\n\nThird version").unwrap();
+            assert!(wait_for("# AGENTS\n\nThird version"));
+
+            stop.store(true, Ordering::SeqCst);
+            assert!(watcher.join().unwrap());
+        });
+    }
+
+    #[test]
+    #[serial]
+    #[cfg(unix)]
+    fn test_handle_stash_from_clipboard() {
+        // Create a temporary directory and change to it
+        let temp_dir = TempDir::new().unwrap();
+        let original_dir = env::current_dir().unwrap();
+        env::set_current_dir(&temp_dir).unwrap();
+        
+        // Ensure cleanup happens
+        let _cleanup = defer::defer(|| {
+            let _ = env::set_current_dir(&original_dir);
+        });
+
+        // Create a .git directory to establish project root
+        fs::create_dir(".git").unwrap();
+
+        // Set up HOME environment variable to temp directory
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
+
+        // Stub the clipboard with valid content
+        let original_path = env::var("PATH").unwrap_or_default();
+        let clipboard_file = utils::install_clipboard_stub(temp_dir.path());
+        let _cleanup_path = defer::defer(move || {
+            env::set_var("PATH", original_path);
+        });
+        let clipboard_content = "# AGENTS\n\nFrom clipboard";
+        fs::write(&clipboard_file, clipboard_content).unwrap();
+
+        // Stash without any local AGENTS.md
+        let result = commands::handle_stash(&commands::StashOptions {
+            from_clipboard: true,
+            ..Default::default()
+        });
+        assert!(result.is_ok());
+
+        let project_name = temp_dir.path().file_name().unwrap().to_str().unwrap();
+        let stash_path = dirs::home_dir()
+            .unwrap()
+            .join(".agstash")
+            .join("stashes")
+            .join(utils::stash_file_name(project_name));
+
+        let stashed_content = fs::read_to_string(&stash_path).unwrap();
+        assert_eq!(stashed_content, clipboard_content);
+        assert!(!Path::new("AGENTS.md").exists());
+    }
+
+    #[test]
+    #[serial]
+    #[cfg(unix)]
+    fn test_handle_apply_to_clipboard() {
+        // Create a temporary directory and change to it
+        let temp_dir = TempDir::new().unwrap();
+        let original_dir = env::current_dir().unwrap();
+        env::set_current_dir(&temp_dir).unwrap();
+        
+        // Ensure cleanup happens
+        let _cleanup = defer::defer(|| {
+            let _ = env::set_current_dir(&original_dir);
+        });
+
+        // Create a .git directory to establish project root
+        fs::create_dir(".git").unwrap();
+
+        // Set up HOME environment variable to temp directory
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
+
+        let original_path = env::var("PATH").unwrap_or_default();
+        let clipboard_file = utils::install_clipboard_stub(temp_dir.path());
+        let _cleanup_path = defer::defer(move || {
+            env::set_var("PATH", original_path);
+        });
+
+        // Stash a file, then remove the local copy
+        let agents_content = "# AGENTS\n\nTo clipboard";
+        fs::write("AGENTS.md", agents_content).unwrap();
+        assert!(commands::handle_stash(&commands::StashOptions::default()).is_ok());
+        fs::remove_file("AGENTS.md").unwrap();
+
+        let result = commands::handle_apply(&commands::ApplyOptions {
+            to_clipboard: true,
+            ..Default::default()
+        });
+        assert!(result.is_ok());
+
+        // The stash went to the clipboard and no file was written
+        assert_eq!(fs::read_to_string(&clipboard_file).unwrap(), agents_content);
+        assert!(!Path::new("AGENTS.md").exists());
+    }
+
+    #[test]
+    #[serial]
+    fn test_handle_apply_to_clipboard_unavailable() {
+        // Create a temporary directory and change to it
+        let temp_dir = TempDir::new().unwrap();
+        let original_dir = env::current_dir().unwrap();
+        env::set_current_dir(&temp_dir).unwrap();
+        
+        // Ensure cleanup happens
+        let _cleanup = defer::defer(|| {
+            let _ = env::set_current_dir(&original_dir);
+        });
+
+        // Create a .git directory to establish project root
+        fs::create_dir(".git").unwrap();
+
+        // Set up HOME environment variable to temp directory
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
+
+        fs::write("AGENTS.md", "# AGENTS\n\nTo clipboard").unwrap();
+        assert!(commands::handle_stash(&commands::StashOptions::default()).is_ok());
+
+        // Point PATH at an empty directory so no clipboard utility can be found
+        let empty_bin = temp_dir.path().join("empty-bin");
+        fs::create_dir(&empty_bin).unwrap();
+        let original_path = env::var("PATH").unwrap_or_default();
+        env::set_var("PATH", &empty_bin);
+        let _cleanup_path = defer::defer(move || {
+            env::set_var("PATH", original_path);
+        });
+
+        let result = commands::handle_apply(&commands::ApplyOptions {
+            to_clipboard: true,
+            ..Default::default()
+        });
+        assert!(result.is_err());
+        assert!(result.unwrap_err().to_string().contains("No clipboard utility found"));
+    }
+
+    #[test]
+    #[serial]
+    fn test_handle_gc() {
+        // Create a temporary directory to use as HOME
+        let temp_dir = TempDir::new().unwrap();
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
+
+        // Two identical stashes and one unique stash
+        let stashes_dir = temp_dir.path().join(".agstash").join("stashes");
+        fs::create_dir_all(&stashes_dir).unwrap();
+        let stash_a = stashes_dir.join("stash-a.md");
+        let stash_b = stashes_dir.join("stash-b.md");
+        let stash_c = stashes_dir.join("stash-c.md");
+        fs::write(&stash_a, "# AGENTS\n\nShared content").unwrap();
+        fs::write(&stash_b, "# AGENTS\n\nShared content").unwrap();
+        fs::write(&stash_c, "# AGENTS\n\nUnique content").unwrap();
+
+        // Without dedupe, duplicates are only reported
+        let result = commands::handle_gc(false, false);
+        assert!(result.is_ok());
+        assert!(!utils::is_same_file(&stash_a, &stash_b).unwrap());
+
+        // With dedupe, the duplicate is linked to the shared copy
+        let result = commands::handle_gc(true, false);
+        assert!(result.is_ok());
+        assert!(utils::is_same_file(&stash_a, &stash_b).unwrap());
+        assert!(!utils::is_same_file(&stash_a, &stash_c).unwrap());
+        assert_eq!(fs::read_to_string(&stash_b).unwrap(), "# AGENTS\n\nShared content");
+        assert_eq!(fs::read_to_string(&stash_c).unwrap(), "# AGENTS\n\nUnique content");
+
+        // Running again finds nothing left to reclaim
+        let result = commands::handle_gc(true, false);
+        assert!(result.is_ok());
+
+        // A read-only stash is left out, so neither copy's permissions change
+        let stash_d = stashes_dir.join("stash-d.md");
+        fs::write(&stash_d, "# AGENTS\n\nUnique content").unwrap();
+        utils::set_file_mode(&stash_d, 0o444).unwrap();
+        assert!(commands::handle_gc(true, false).is_ok());
+        assert!(!utils::is_same_file(&stash_c, &stash_d).unwrap());
+        assert!(!fs::metadata(&stash_c).unwrap().permissions().readonly());
+        assert!(fs::metadata(&stash_d).unwrap().permissions().readonly());
+    }
+
+    #[test]
+    #[serial]
+    fn test_handle_stash_after_gc_dedupe() {
+        // Create a temporary directory and change to it
+        let temp_dir = TempDir::new().unwrap();
+        let project_dir = temp_dir.path().join("project-a");
+        fs::create_dir_all(project_dir.join(".git")).unwrap();
+        let original_dir = env::current_dir().unwrap();
+        env::set_current_dir(&project_dir).unwrap();
+        
+        // Ensure cleanup happens
+        let _cleanup = defer::defer(|| {
+            let _ = env::set_current_dir(&original_dir);
+        });
+
+        // Set up HOME environment variable to temp directory
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
+
+        // Two identical stashes, deduplicated into one shared file
+        let stashes_dir = temp_dir.path().join(".agstash").join("stashes");
+        fs::create_dir_all(&stashes_dir).unwrap();
+        let stash_a = stashes_dir.join("stash-project-a.md");
+        let stash_b = stashes_dir.join("stash-project-b.md");
+        fs::write(&stash_a, "# AGENTS\n\nShared content").unwrap();
+        fs::write(&stash_b, "# AGENTS\n\nShared content").unwrap();
+        assert!(commands::handle_gc(true, false).is_ok());
+
+        // Re-stashing one project must not change the other project's stash
+        fs::write(project_dir.join("AGENTS.md"), "# AGENTS\n\nUpdated content").unwrap();
+        assert!(commands::handle_stash(&commands::StashOptions::default()).is_ok());
+
+        assert_eq!(fs::read_to_string(&stash_a).unwrap(), "# AGENTS\n\nUpdated content");
+        assert_eq!(fs::read_to_string(&stash_b).unwrap(), "# AGENTS\n\nShared content");
+    }
+
+    #[test]
+    #[serial]
+    fn test_handle_validate_only() {
+        // Create a temporary directory and change to it
+        let temp_dir = TempDir::new().unwrap();
+        let original_dir = env::current_dir().unwrap();
+        env::set_current_dir(&temp_dir).unwrap();
+        
+        // Ensure cleanup happens
+        let _cleanup = defer::defer(|| {
+            let _ = env::set_current_dir(&original_dir);
+        });
+
+        // Create a .git directory to establish project root
+        fs::create_dir(".git").unwrap();
+
+        // Set up HOME environment variable to temp directory
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
+
+        // Stash a valid file, then remove the local copy
+        fs::write("AGENTS.md", "# AGENTS\n\nTest content").unwrap();
+        assert!(commands::handle_stash(&commands::StashOptions::default()).is_ok());
+        fs::remove_file("AGENTS.md").unwrap();
+
+        // A valid stash passes and nothing is applied
+        let result = commands::handle_validate_only(None, &commands::ApplyOptions::default());
+        assert!(result.is_ok());
+        assert!(!Path::new("AGENTS.md").exists());
+
+        // --force-dir validates the stash named after that directory instead
+        let other_dir = temp_dir.path().join("other");
+        fs::create_dir(&other_dir).unwrap();
+        fs::write(utils::get_stash_path("other").unwrap(), "No header here").unwrap();
+        let options = commands::ApplyOptions { force_dir: Some(other_dir.clone()), ..Default::default() };
+        assert!(commands::handle_validate_only(None, &options).is_err());
+        assert!(commands::handle_placeholder_report(&options).is_ok());
+
+        // and a missing directory is refused, as it is by apply, unless --create-dirs is set
+        let missing = commands::ApplyOptions { force_dir: Some(temp_dir.path().join("missing")), ..Default::default() };
+        assert!(commands::handle_validate_only(None, &missing).is_err());
+        assert!(commands::handle_placeholder_report(&missing).is_err());
+        let missing = commands::ApplyOptions { create_dirs: true, ..missing };
+        assert!(commands::handle_validate_only(None, &missing).is_ok());
+        assert!(!temp_dir.path().join("missing").exists());
+    }
+
+    #[test]
+    fn test_handle_validate_only_file() {
+        let temp_dir = TempDir::new().unwrap();
+
+        // Warnings alone do not fail validation
+        let warning_file = temp_dir.path().join("warning.md");
+        fs::write(&warning_file, "\n# AGENTS\n").unwrap();
+        assert!(commands::handle_validate_only(Some(&warning_file), &commands::ApplyOptions::default()).is_ok());
+
+        // Errors fail validation
+        let error_file = temp_dir.path().join("error.md");
+        fs::write(&error_file, "No header here").unwrap();
+        let result = commands::handle_validate_only(Some(&error_file), &commands::ApplyOptions::default());
+        assert!(result.is_err());
+        assert!(result.unwrap_err().to_string().contains("1 error(s)"));
+
+        // The validated files are left untouched
+        assert_eq!(fs::read_to_string(&error_file).unwrap(), "No header here");
+    }
+
+    #[test]
+    fn test_handle_validate() {
+        let temp_dir = TempDir::new().unwrap();
+
+        let valid_file = temp_dir.path().join("valid.md");
+        fs::write(&valid_file, "# AGENTS\n\n- Use tabs\n").unwrap();
+        assert!(commands::handle_validate(Some(&valid_file)).is_ok());
+
+        // A header-only file only warns
+        let header_only = temp_dir.path().join("header-only.md");
+        fs::write(&header_only, "# AGENTS\n").unwrap();
+        assert!(commands::handle_validate(Some(&header_only)).is_ok());
+
+        // A file without a header fails
+        let headerless = temp_dir.path().join("headerless.md");
+        fs::write(&headerless, "- Use tabs\n").unwrap();
+        let err = commands::handle_validate(Some(&headerless)).unwrap_err();
+        assert!(err.to_string().contains("1 error(s)"));
+
+        // A missing file fails rather than passing silently
+        assert!(commands::handle_validate(Some(&temp_dir.path().join("missing.md"))).is_err());
+
+        // Content read from standard input is reported under that name
+        let err = commands::report_validation("", "standard input").unwrap_err();
+        assert_eq!(err.to_string(), "standard input failed validation with 1 error(s)");
+    }
+
+    #[test]
+    #[serial]
+    fn test_whereis_report() {
+        // Create a temporary directory to use as HOME
+        let temp_dir = TempDir::new().unwrap();
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
+
+        let agstash_dir = temp_dir.path().join(".agstash");
+        let stashes_dir = agstash_dir.join("stashes");
+
+        let snapshots_dir = agstash_dir.join("snapshots");
+        let lock_file = agstash_dir.join("apply.lock");
+
+        // Text output lists every path
+        let report = commands::whereis_report(false).unwrap();
+        assert!(report.contains(&agstash_dir.display().to_string()));
+        assert!(report.contains(&stashes_dir.display().to_string()));
+        assert!(report.contains(&snapshots_dir.display().to_string()));
+        assert!(report.contains(&lock_file.display().to_string()));
+
+        // JSON output has one key per location
+        let report = commands::whereis_report(true).unwrap();
+        let parsed: serde_json::Value = serde_json::from_str(&report).unwrap();
+        assert_eq!(parsed["agstash_dir"], agstash_dir.display().to_string());
+        assert_eq!(parsed["stashes_dir"], stashes_dir.display().to_string());
+        assert_eq!(parsed["snapshots_dir"], snapshots_dir.display().to_string());
+        assert_eq!(parsed["lock_file"], lock_file.display().to_string());
+
+        // Reporting locations must not create them
+        assert!(!agstash_dir.exists());
+        assert!(commands::handle_whereis(false).is_ok());
+    }
+
+    #[test]
+    #[serial]
+    fn test_handle_stash_force_dir() {
+        // A directory with no .git or .gitignore, so root detection would not find it
+        let temp_dir = TempDir::new().unwrap();
+        let export_dir = temp_dir.path().join("exported-project");
+        fs::create_dir(&export_dir).unwrap();
+        let agents_content = "# AGENTS\n\nExported content";
+        fs::write(export_dir.join("AGENTS.md"), agents_content).unwrap();
+
+        // Set up HOME environment variable to temp directory
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
+
+        let result = commands::handle_stash(&commands::StashOptions {
+            force_dir: Some(export_dir.clone()),
+            ..Default::default()
+        });
+        assert!(result.is_ok());
+
+        // The stash is named after the directory
+        let stash_path = temp_dir.path()
+            .join(".agstash")
+            .join("stashes")
+            .join("stash-exported-project.md");
+        assert_eq!(fs::read_to_string(&stash_path).unwrap(), agents_content);
+    }
+
+    #[test]
+    #[serial]
+    fn test_handle_stash_since_commit() {
+        // Create a temporary git repository and change to it
+        let temp_dir = TempDir::new().unwrap();
+        let original_dir = env::current_dir().unwrap();
+        env::set_current_dir(&temp_dir).unwrap();
+        
+        // Ensure cleanup happens
+        let _cleanup = defer::defer(|| {
+            let _ = env::set_current_dir(&original_dir);
+        });
+
+        // Set up HOME environment variable to temp directory
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
+
+        let git = |args: &[&str]| {
+            let status = std::process::Command::new("git")
+                .args(["-c", "user.name=agstash", "-c", "user.email=agstash@example.com"])
+                .args(args)
+                .stdout(std::process::Stdio::null())
+                .stderr(std::process::Stdio::null())
+                .status()
+                .unwrap();
+            assert!(status.success(), "git {:?} failed", args);
+        };
+        git(&["init", "-q"]);
+        fs::write("AGENTS.md", "# AGENTS\n\nReleased content").unwrap();
+        git(&["add", "AGENTS.md"]);
+        git(&["commit", "-q", "-m", "release"]);
+        git(&["tag", "v1"]);
+
+        let project_name = temp_dir.path().file_name().unwrap().to_str().unwrap();
+        let stash_path = utils::get_stash_path(project_name).unwrap();
+        let options = commands::StashOptions {
+            since_commit: Some("v1".to_string()),
+            ..Default::default()
+        };
+
+        // Unchanged since the tag, so nothing is stashed
+        assert!(commands::handle_stash(&options).is_ok());
+        assert!(!stash_path.exists());
+
+        // Changed since the tag
+        fs::write("AGENTS.md", "# AGENTS\n\nEdited content").unwrap();
+        assert!(commands::handle_stash(&options).is_ok());
+        assert_eq!(fs::read_to_string(&stash_path).unwrap(), "# AGENTS\n\nEdited content");
+
+        // An unknown ref falls back to stashing
+        fs::write("AGENTS.md", "# AGENTS\n\nEdited again").unwrap();
+        let options = commands::StashOptions {
+            since_commit: Some("no-such-ref".to_string()),
+            ..Default::default()
+        };
+        assert!(commands::handle_stash(&options).is_ok());
+        assert_eq!(fs::read_to_string(&stash_path).unwrap(), "# AGENTS\n\nEdited again");
+
+        // An untracked AGENTS.md has no committed version to compare, so it is always stashed
+        git(&["rm", "-q", "--cached", "AGENTS.md"]);
+        git(&["commit", "-q", "-m", "untrack AGENTS.md"]);
+        git(&["tag", "v2"]);
+        fs::write("AGENTS.md", "# AGENTS\n\nUntracked content").unwrap();
+        let options = commands::StashOptions {
+            since_commit: Some("v2".to_string()),
+            ..Default::default()
+        };
+        assert!(commands::handle_stash(&options).is_ok());
+        assert_eq!(fs::read_to_string(&stash_path).unwrap(), "# AGENTS\n\nUntracked content");
+    }
+
+    #[test]
+    #[serial]
+    fn test_handle_snapshot() {
+        // Create a temporary git repository and change to it
+        let temp_dir = TempDir::new().unwrap();
+        let original_dir = env::current_dir().unwrap();
+        env::set_current_dir(&temp_dir).unwrap();
+        
+        // Ensure cleanup happens
+        let _cleanup = defer::defer(|| {
+            let _ = env::set_current_dir(&original_dir);
+        });
+
+        // Set up HOME environment variable to temp directory
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
+
+        let git = |args: &[&str]| {
+            let status = std::process::Command::new("git")
+                .args(["-c", "user.name=agstash", "-c", "user.email=agstash@example.com"])
+                .args(args)
+                .stdout(std::process::Stdio::null())
+                .stderr(std::process::Stdio::null())
+                .status()
+                .unwrap();
+            assert!(status.success(), "git {:?} failed", args);
+        };
+        git(&["init", "-q"]);
+        fs::create_dir_all(".github").unwrap();
+        fs::write("AGENTS.md", "# AGENTS\n\n- captured rule\n").unwrap();
+        fs::write(".github/copilot-instructions.md", "Captured instructions\n").unwrap();
+        git(&["add", "."]);
+        git(&["commit", "-q", "-m", "initial"]);
+
+        let options = commands::SnapshotOptions {
+            name: Some("baseline".to_string()),
+            include: vec![PathBuf::from(".github/copilot-instructions.md")],
+        };
+        assert!(commands::handle_snapshot(&options).is_ok());
+
+        // The snapshot records the files and the commit
+        let snapshot_path = utils::get_snapshots_dir().unwrap().join("baseline.json");
+        let snapshot: serde_json::Value = serde_json::from_str(&fs::read_to_string(&snapshot_path).unwrap()).unwrap();
+        assert_eq!(snapshot["files"]["AGENTS.md"], "# AGENTS\n\n- captured rule\n");
+        assert_eq!(snapshot["files"][".github/copilot-instructions.md"], "Captured instructions\n");
+        assert_eq!(snapshot["commit"].as_str(), utils::git_head_commit(temp_dir.path()).unwrap().as_deref());
+        assert!(snapshot["commit"].as_str().unwrap().len() >= 40);
+
+        // The same name is not reused, and paths outside the project are refused
+        assert!(commands::handle_snapshot(&options).is_err());
+        let outside = commands::SnapshotOptions { include: vec![PathBuf::from("../secret")], ..Default::default() };
+        assert!(commands::handle_snapshot(&outside).is_err());
+
+        // Restoring brings back the whole set
+        fs::remove_file("AGENTS.md").unwrap();
+        fs::write(".github/copilot-instructions.md", "Edited\n").unwrap();
+        let apply = |force: bool| {
+            commands::handle_apply(&commands::ApplyOptions {
+                snapshot: Some("baseline".to_string()),
+                force,
+                ..Default::default()
+            })
+        };
+        assert!(apply(false).unwrap_err().to_string().contains("already exist"));
+        assert!(!Path::new("AGENTS.md").exists());
+        assert!(apply(true).is_ok());
+        assert_eq!(fs::read_to_string("AGENTS.md").unwrap(), "# AGENTS\n\n- captured rule\n");
+        assert_eq!(fs::read_to_string(".github/copilot-instructions.md").unwrap(), "Captured instructions\n");
+
+        assert!(commands::handle_apply(&commands::ApplyOptions {
+            snapshot: Some("missing".to_string()),
+            ..Default::default()
+        })
+        .is_err());
+    }
+
+    #[test]
+    #[serial]
+    #[cfg(unix)]
+    fn test_handle_stash_link() {
+        use std::io::Read;
+
+        // Create a temporary directory and change to it
+        let temp_dir = TempDir::new().unwrap();
+        let original_dir = env::current_dir().unwrap();
+        env::set_current_dir(&temp_dir).unwrap();
+        
+        // Ensure cleanup happens
+        let _cleanup = defer::defer(|| {
+            let _ = env::set_current_dir(&original_dir);
+        });
+
+        // Create a .git directory to establish project root
+        fs::create_dir(".git").unwrap();
+
+        // Set up HOME environment variable to temp directory
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
+
+        fs::write("AGENTS.md", "# AGENTS\n\nLinked guidance").unwrap();
+        let options = commands::StashOptions { link: true, ..Default::default() };
+        assert!(commands::handle_stash(&options).is_ok());
+
+        // Creating: the stash is a link to the local file
+        let project_name = temp_dir.path().file_name().unwrap().to_str().unwrap();
+        let stash_path = utils::get_stash_path(project_name).unwrap();
+        assert!(utils::is_symlink(&stash_path));
+        assert_eq!(fs::read_link(&stash_path).unwrap(), fs::canonicalize("AGENTS.md").unwrap());
+
+        // Reading through: edits show up in the stash without re-stashing
+        fs::write("AGENTS.md", "# AGENTS\n\nEdited guidance").unwrap();
+        let mut stashed = String::new();
+        utils::open_stash_reader(project_name).unwrap().read_to_string(&mut stashed).unwrap();
+        assert_eq!(stashed, "# AGENTS\n\nEdited guidance");
+        let other_dir = temp_dir.path().join("other");
+        let apply_options = commands::ApplyOptions {
+            force_dir: Some(other_dir.clone()),
+            create_dirs: true,
+            ..Default::default()
+        };
+        fs::copy(&stash_path, utils::get_stash_path("other").unwrap()).unwrap();
+        assert!(commands::handle_apply(&apply_options).is_ok());
+        assert_eq!(fs::read_to_string(other_dir.join("AGENTS.md")).unwrap(), "# AGENTS\n\nEdited guidance");
+
+        // Deduplication leaves the link alone even though "other" has the same content
+        assert!(commands::handle_gc(true, false).is_ok());
+        assert!(utils::is_symlink(&stash_path));
+
+        // Pruning: once the local file is gone the link dangles and only --prune-dangling removes it
+        fs::remove_file("AGENTS.md").unwrap();
+        let stashes_dir = utils::get_stashes_dir().unwrap();
+        assert_eq!(utils::list_dangling_stash_links(&stashes_dir).unwrap(), vec![stash_path.clone()]);
+        assert!(!utils::list_stash_files(&stashes_dir).unwrap().contains(&stash_path));
+        assert!(commands::handle_gc(false, false).is_ok());
+        assert!(utils::is_symlink(&stash_path));
+        assert!(commands::handle_gc(false, true).is_ok());
+        assert!(!utils::is_symlink(&stash_path));
+        assert!(utils::list_dangling_stash_links(&stashes_dir).unwrap().is_empty());
+
+        // A link to a read-only AGENTS.md is not a read-only stash, so a copy replaces it without --force
+        fs::write("AGENTS.md", "# AGENTS\n\nRead-only local file").unwrap();
+        assert!(commands::handle_stash(&options).is_ok());
+        utils::set_file_mode(Path::new("AGENTS.md"), 0o444).unwrap();
+        assert!(commands::handle_stash(&commands::StashOptions::default()).is_ok());
+        assert!(!utils::is_symlink(&stash_path));
+        assert_eq!(fs::read_to_string(&stash_path).unwrap(), "# AGENTS\n\nRead-only local file");
+    }
+
+    #[test]
+    #[serial]
+    fn test_handle_stash_project_from_gitconfig() {
+        // Create a temporary git repository and change to it
+        let temp_dir = TempDir::new().unwrap();
+        let original_dir = env::current_dir().unwrap();
+        env::set_current_dir(&temp_dir).unwrap();
+        
+        // Ensure cleanup happens
+        let _cleanup = defer::defer(|| {
+            let _ = env::set_current_dir(&original_dir);
+        });
+
+        // Set up HOME environment variable to temp directory
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
+
+        let git = |args: &[&str]| {
+            let status = std::process::Command::new("git")
+                .args(args)
+                .stdout(std::process::Stdio::null())
+                .stderr(std::process::Stdio::null())
+                .status()
+                .unwrap();
+            assert!(status.success(), "git {:?} failed", args);
+        };
+        git(&["init", "-q"]);
+        fs::write("AGENTS.md", "# AGENTS\n\n- shared rule\n").unwrap();
+        let options = commands::StashOptions { project_from_gitconfig: true, ..Default::default() };
+
+        // Without a remote the directory name is used
+        assert!(commands::handle_stash(&options).is_ok());
+        let project_name = temp_dir.path().file_name().unwrap().to_str().unwrap();
+        assert!(utils::get_stash_path(project_name).unwrap().exists());
+
+        // With one, the stash is keyed by owner/repo
+        git(&["remote", "add", "origin", "git@github.com:acme/widgets.git"]);
+        assert!(commands::handle_stash(&options).is_ok());
+        let stash_path = utils::get_stash_path("acme/widgets").unwrap();
+        assert!(stash_path.ends_with("stash-acme-widgets.md"));
+        assert!(stash_path.exists());
+
+        // Apply finds it the same way
+        fs::remove_file("AGENTS.md").unwrap();
+        let apply_options = commands::ApplyOptions { project_from_gitconfig: true, ..Default::default() };
+        fs::remove_file(utils::get_stash_path(project_name).unwrap()).unwrap();
+        assert!(commands::handle_apply(&apply_options).is_ok());
+        assert_eq!(fs::read_to_string("AGENTS.md").unwrap(), "# AGENTS\n\n- shared rule\n");
+
+        // So do --validate-only and --placeholder-report
+        assert!(commands::handle_validate_only(None, &apply_options).is_ok());
+        fs::write(&stash_path, "No header here").unwrap();
+        assert!(commands::handle_validate_only(None, &apply_options).is_err());
+        assert!(commands::handle_validate_only(None, &commands::ApplyOptions::default()).is_ok());
+        assert!(commands::handle_placeholder_report(&apply_options).is_ok());
+    }
+
+    #[test]
+    #[serial]
+    fn test_handle_stash_since_commit_not_git() {
+        // A project outside any git repository
+        let temp_dir = TempDir::new().unwrap();
+        let project_dir = temp_dir.path().join("plain-project");
+        fs::create_dir(&project_dir).unwrap();
+        fs::write(project_dir.join("AGENTS.md"), "# AGENTS\n\nPlain content").unwrap();
+        let _ceiling = defer::defer(|| env::remove_var("GIT_CEILING_DIRECTORIES"));
+        env::set_var("GIT_CEILING_DIRECTORIES", temp_dir.path());
+
+        // Set up HOME environment variable to temp directory
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
+
+        // git cannot compare, so the stash happens with a warning
+        assert!(utils::git_file_changed_since(&project_dir, "HEAD", "AGENTS.md").is_err());
+        let result = commands::handle_stash(&commands::StashOptions {
+            force_dir: Some(project_dir.clone()),
+            since_commit: Some("HEAD".to_string()),
+            ..Default::default()
+        });
+        assert!(result.is_ok());
+        let stash_path = utils::get_stash_path("plain-project").unwrap();
+        assert_eq!(fs::read_to_string(&stash_path).unwrap(), "# AGENTS\n\nPlain content");
+    }
+
+    #[test]
+    #[serial]
+    fn test_handle_stash_force_dir_relative() {
+        // Create a temporary directory and change to it
+        let temp_dir = TempDir::new().unwrap();
+        let export_dir = temp_dir.path().join("relative-project");
+        fs::create_dir(&export_dir).unwrap();
+        let original_dir = env::current_dir().unwrap();
+        env::set_current_dir(&export_dir).unwrap();
+        
+        // Ensure cleanup happens
+        let _cleanup = defer::defer(|| {
+            let _ = env::set_current_dir(&original_dir);
+        });
+
+        // Set up HOME environment variable to temp directory
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
+
+        fs::write("AGENTS.md", "# AGENTS\n\nRelative content").unwrap();
+
+        // "." resolves to the directory's real name
+        let result = commands::handle_stash(&commands::StashOptions {
+            force_dir: Some(PathBuf::from(".")),
+            ..Default::default()
+        });
+        assert!(result.is_ok());
+        let stash_path = temp_dir.path()
+            .join(".agstash")
+            .join("stashes")
+            .join("stash-relative-project.md");
+        assert!(stash_path.exists());
+
+        // A missing directory is an error
+        let result = commands::handle_stash(&commands::StashOptions {
+            force_dir: Some(temp_dir.path().join("missing")),
+            ..Default::default()
+        });
+        assert!(result.is_err());
+        assert!(result.unwrap_err().to_string().contains("Directory not found"));
+    }
+
+    #[test]
+    fn test_overwrite_diff() {
+        let temp_dir = TempDir::new().unwrap();
+        let agents_file = temp_dir.path().join("AGENTS.md");
+
+        // No existing file means there is nothing to diff
+        let diff = commands::overwrite_diff(&agents_file, "# AGENTS\n- new\n").unwrap();
+        assert!(diff.is_none());
+
+        // An existing file produces a diff against the new content
+        fs::write(&agents_file, "# AGENTS\n- old\n").unwrap();
+        let diff = commands::overwrite_diff(&agents_file, "# AGENTS\n- new\n").unwrap().unwrap();
+        assert!(diff.starts_with("--- AGENTS.md (current)\n+++ AGENTS.md (stash)\n"));
+        assert!(diff.contains(" # AGENTS\n"));
+        assert!(diff.contains("-- old"));
+        assert!(diff.contains("+- new"));
+    }
+
+    #[test]
+    #[serial]
+    fn test_handle_apply_print_diff_on_overwrite() {
+        // Create a temporary directory and change to it
+        let temp_dir = TempDir::new().unwrap();
+        let original_dir = env::current_dir().unwrap();
+        env::set_current_dir(&temp_dir).unwrap();
+        
+        // Ensure cleanup happens
+        let _cleanup = defer::defer(|| {
+            let _ = env::set_current_dir(&original_dir);
+        });
+
+        // Create a .git directory to establish project root
+        fs::create_dir(".git").unwrap();
+
+        // Set up HOME environment variable to temp directory
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
+
+        // Stash content, then change the local file
+        fs::write("AGENTS.md", "# AGENTS\n\nStashed content").unwrap();
+        assert!(commands::handle_stash(&commands::StashOptions::default()).is_ok());
+        fs::write("AGENTS.md", "# AGENTS\n\nLocal content").unwrap();
+
+        let options = commands::ApplyOptions {
+            force: true,
+            print_diff_on_overwrite: true,
+            ..Default::default()
+        };
+        assert!(commands::handle_apply(&options).is_ok());
+        assert_eq!(fs::read_to_string("AGENTS.md").unwrap(), "# AGENTS\n\nStashed content");
+
+        // Applying where no file exists still works
+        fs::remove_file("AGENTS.md").unwrap();
+        assert!(commands::handle_apply(&options).is_ok());
+        assert_eq!(fs::read_to_string("AGENTS.md").unwrap(), "# AGENTS\n\nStashed content");
+    }
+
+    #[test]
+    fn test_plan_renames() {
+        let names: Vec<String> = ["acme-api", "acme-web", "other"].iter().map(|s| s.to_string()).collect();
+        let regex = regex::Regex::new("^acme-").unwrap();
+
+        let renames = commands::plan_renames(&names, &regex, "");
+        assert_eq!(
+            renames,
+            vec![
+                commands::PlannedRename { from: "acme-api".to_string(), to: "api".to_string() },
+                commands::PlannedRename { from: "acme-web".to_string(), to: "web".to_string() },
+            ]
+        );
+        assert!(commands::find_rename_collisions(&renames, &names).is_empty());
+
+        // Capture groups can be used in the replacement
+        let regex = regex::Regex::new("^acme-(.*)$").unwrap();
+        let renames = commands::plan_renames(&names, &regex, "$1-service");
+        assert_eq!(renames[0].to, "api-service");
+
+        // Targets are sanitized like stash file names
+        let regex = regex::Regex::new("^acme-api$").unwrap();
+        let renames = commands::plan_renames(&names, &regex, "team/api service");
+        assert_eq!(renames[0].to, "team-api-service");
+
+        // Two renames to the same target collide with each other
+        let regex = regex::Regex::new("^acme-.*$").unwrap();
+        let renames = commands::plan_renames(&names, &regex, "merged");
+        assert_eq!(commands::find_rename_collisions(&renames, &names).len(), 2);
+    }
+
+    #[test]
+    #[serial]
+    fn test_handle_rename_all() {
+        // Create a temporary directory to use as HOME
+        let temp_dir = TempDir::new().unwrap();
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
+
+        let stashes_dir = temp_dir.path().join(".agstash").join("stashes");
+        fs::create_dir_all(&stashes_dir).unwrap();
+        fs::write(stashes_dir.join("stash-acme-api.md"), "# AGENTS\n\napi").unwrap();
+        fs::write(stashes_dir.join("stash-acme-web.md"), "# AGENTS\n\nweb").unwrap();
+        fs::write(stashes_dir.join("stash-other.md"), "# AGENTS\n\nother").unwrap();
+
+        // Dry run changes nothing
+        assert!(commands::handle_rename_all("^acme-", "", true, false).is_ok());
+        assert!(stashes_dir.join("stash-acme-api.md").exists());
+        assert!(!stashes_dir.join("stash-api.md").exists());
+
+        // Strip the prefix
+        assert!(commands::handle_rename_all("^acme-", "", false, false).is_ok());
+        assert!(!stashes_dir.join("stash-acme-api.md").exists());
+        assert_eq!(fs::read_to_string(stashes_dir.join("stash-api.md")).unwrap(), "# AGENTS\n\napi");
+        assert_eq!(fs::read_to_string(stashes_dir.join("stash-web.md")).unwrap(), "# AGENTS\n\nweb");
+        assert!(stashes_dir.join("stash-other.md").exists());
+
+        // An invalid pattern is reported
+        assert!(commands::handle_rename_all("(", "", false, false).is_err());
+
+        // A read-only stash under a legacy name is refused too, until --force
+        let legacy_path = stashes_dir.join("stash-acme docs.md");
+        fs::write(&legacy_path, "# AGENTS\n\ndocs").unwrap();
+        utils::set_file_mode(&legacy_path, 0o444).unwrap();
+        let err = commands::handle_rename_all("^acme ", "", false, false).unwrap_err();
+        assert!(err.to_string().contains("read-only"));
+        assert!(legacy_path.exists());
+        assert!(commands::handle_rename_all("^acme ", "", false, true).is_ok());
+        assert!(!legacy_path.exists());
+        assert_eq!(fs::read_to_string(stashes_dir.join("stash-docs.md")).unwrap(), "# AGENTS\n\ndocs");
+    }
+
+    #[test]
+    #[serial]
+    fn test_handle_repair_names() {
+        // Create a temporary directory to use as HOME
+        let temp_dir = TempDir::new().unwrap();
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
+
+        let stashes_dir = temp_dir.path().join(".agstash").join("stashes");
+        fs::create_dir_all(&stashes_dir).unwrap();
+        fs::write(stashes_dir.join("stash-My Project.md"), "# AGENTS\n\nlegacy").unwrap();
+        fs::write(stashes_dir.join("stash-acme@widgets--.md"), "# AGENTS\n\nwidgets").unwrap();
+        fs::write(stashes_dir.join("stash-current.md"), "# AGENTS\n\ncurrent").unwrap();
+
+        // Dry run changes nothing
+        assert!(commands::handle_repair_names(true).is_ok());
+        assert!(stashes_dir.join("stash-My Project.md").exists());
+        assert!(!stashes_dir.join("stash-My-Project.md").exists());
+
+        assert!(commands::handle_repair_names(false).is_ok());
+        assert!(!stashes_dir.join("stash-My Project.md").exists());
+        assert_eq!(fs::read_to_string(utils::get_stash_path("My Project").unwrap()).unwrap(), "# AGENTS\n\nlegacy");
+        assert_eq!(fs::read_to_string(utils::get_stash_path("acme@widgets").unwrap()).unwrap(), "# AGENTS\n\nwidgets");
+        assert!(stashes_dir.join("stash-current.md").exists());
+
+        // Running again finds nothing to repair
+        assert!(commands::handle_repair_names(false).is_ok());
+        assert_eq!(utils::list_stash_files(&stashes_dir).unwrap().len(), 3);
+    }
+
+    #[test]
+    #[serial]
+    fn test_handle_repair_names_collision_refused() {
+        // Create a temporary directory to use as HOME
+        let temp_dir = TempDir::new().unwrap();
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
+
+        let stashes_dir = temp_dir.path().join(".agstash").join("stashes");
+        fs::create_dir_all(&stashes_dir).unwrap();
+        fs::write(stashes_dir.join("stash-my project.md"), "# AGENTS\n\nlegacy").unwrap();
+        fs::write(stashes_dir.join("stash-my-project.md"), "# AGENTS\n\ncurrent").unwrap();
+        fs::write(stashes_dir.join("stash-other app.md"), "# AGENTS\n\nother").unwrap();
+
+        // "my project" -> "my-project" collides, so nothing is renamed at all
+        let result = commands::handle_repair_names(false);
+        assert!(result.is_err());
+        assert!(result.unwrap_err().to_string().contains("would collide"));
+        assert_eq!(fs::read_to_string(stashes_dir.join("stash-my project.md")).unwrap(), "# AGENTS\n\nlegacy");
+        assert_eq!(fs::read_to_string(stashes_dir.join("stash-my-project.md")).unwrap(), "# AGENTS\n\ncurrent");
+        assert!(stashes_dir.join("stash-other app.md").exists());
+    }
+
+    #[test]
+    #[serial]
+    fn test_handle_rename_all_collision_refused() {
+        // Create a temporary directory to use as HOME
+        let temp_dir = TempDir::new().unwrap();
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
+
+        let stashes_dir = temp_dir.path().join(".agstash").join("stashes");
+        fs::create_dir_all(&stashes_dir).unwrap();
+        fs::write(stashes_dir.join("stash-acme-api.md"), "# AGENTS\n\nacme api").unwrap();
+        fs::write(stashes_dir.join("stash-acme-web.md"), "# AGENTS\n\nacme web").unwrap();
+        fs::write(stashes_dir.join("stash-api.md"), "# AGENTS\n\napi").unwrap();
+
+        // acme-api -> api collides, so nothing is renamed at all
+        let result = commands::handle_rename_all("^acme-", "", false, false);
+        assert!(result.is_err());
+        assert!(result.unwrap_err().to_string().contains("would collide"));
+
+        assert_eq!(fs::read_to_string(stashes_dir.join("stash-api.md")).unwrap(), "# AGENTS\n\napi");
+        assert!(stashes_dir.join("stash-acme-api.md").exists());
+        assert!(stashes_dir.join("stash-acme-web.md").exists());
+        assert!(!stashes_dir.join("stash-web.md").exists());
+    }
+
+    #[test]
+    #[serial]
+    fn test_handle_apply_create_dirs() {
+        // Create a temporary directory to use as HOME
+        let temp_dir = TempDir::new().unwrap();
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
+
+        // A stash for "fresh-project" exists, but its directory does not
+        let stashes_dir = temp_dir.path().join(".agstash").join("stashes");
+        fs::create_dir_all(&stashes_dir).unwrap();
+        let agents_content = "# AGENTS\n\nFresh content";
+        fs::write(stashes_dir.join("stash-fresh-project.md"), agents_content).unwrap();
+        let target_dir = temp_dir.path().join("workspace").join("fresh-project");
+
+        // Without --create-dirs a missing directory is an error
+        let result = commands::handle_apply(&commands::ApplyOptions {
+            force_dir: Some(target_dir.clone()),
+            ..Default::default()
+        });
+        assert!(result.is_err());
+        assert!(result.unwrap_err().to_string().contains("--create-dirs"));
+        assert!(!target_dir.exists());
+
+        // With --create-dirs the directory is created and the stash written into it
+        let result = commands::handle_apply(&commands::ApplyOptions {
+            force_dir: Some(target_dir.clone()),
+            create_dirs: true,
+            ..Default::default()
+        });
+        assert!(result.is_ok());
+        assert_eq!(fs::read_to_string(target_dir.join("AGENTS.md")).unwrap(), agents_content);
+    }
+
+    #[test]
+    #[serial]
+    fn test_handle_apply_create_dirs_no_stash() {
+        // Create a temporary directory to use as HOME
+        let temp_dir = TempDir::new().unwrap();
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
+
+        // Nothing is created when there is no stash to apply
+        let target_dir = temp_dir.path().join("no-stash-project");
+        let result = commands::handle_apply(&commands::ApplyOptions {
+            force_dir: Some(target_dir.clone()),
+            create_dirs: true,
+            ..Default::default()
+        });
+        assert!(result.is_ok());
+        assert!(!target_dir.exists());
+    }
+
+    #[test]
+    #[serial]
+    fn test_handle_apply_report() {
+        // Create a temporary directory and change to it
+        let temp_dir = TempDir::new().unwrap();
+        let original_dir = env::current_dir().unwrap();
+        env::set_current_dir(&temp_dir).unwrap();
+        
+        // Ensure cleanup happens
+        let _cleanup = defer::defer(|| {
+            let _ = env::set_current_dir(&original_dir);
+        });
+
+        // Create a .git directory to establish project root
+        fs::create_dir(".git").unwrap();
+
+        // Set up HOME environment variable to temp directory
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
+
+        fs::write("AGENTS.md", "# AGENTS\n\nReported content").unwrap();
+        assert!(commands::handle_stash(&commands::StashOptions::default()).is_ok());
+        let project_name = temp_dir.path().file_name().unwrap().to_str().unwrap();
+        let stash_path = utils::get_stash_path(project_name).unwrap();
+
+        // First apply creates the report, the second appends to it
+        let report_path = temp_dir.path().join("reports").join("apply.jsonl");
+        fs::create_dir(temp_dir.path().join("reports")).unwrap();
+        let options = commands::ApplyOptions {
+            force: true,
+            report: Some(report_path.clone()),
+            ..Default::default()
+        };
+        fs::remove_file("AGENTS.md").unwrap();
+        assert!(commands::handle_apply(&options).is_ok());
+        assert!(commands::handle_apply(&options).is_ok());
+
+        let report = fs::read_to_string(&report_path).unwrap();
+        let records: Vec<serde_json::Value> = report
+            .lines()
+            .map(|line| serde_json::from_str(line).unwrap())
+            .collect();
+        assert_eq!(records.len(), 2);
+
+        let expected_checksum = utils::file_checksum(&stash_path).unwrap();
+        for record in &records {
+            assert_eq!(record["project"], project_name);
+            assert_eq!(record["stash"], stash_path.display().to_string());
+            assert_eq!(record["checksum"], expected_checksum);
+            assert!(record["timestamp"].as_str().unwrap().ends_with('Z'));
+        }
+        assert_eq!(records[0]["outcome"], "created");
+        assert_eq!(records[1]["outcome"], "overwritten");
+    }
+
+    #[test]
+    #[serial]
+    fn test_handle_apply_report_no_stash() {
+        // Create a temporary directory and change to it
+        let temp_dir = TempDir::new().unwrap();
+        let original_dir = env::current_dir().unwrap();
+        env::set_current_dir(&temp_dir).unwrap();
+        
+        // Ensure cleanup happens
+        let _cleanup = defer::defer(|| {
+            let _ = env::set_current_dir(&original_dir);
+        });
+
+        // Create a .git directory to establish project root
+        fs::create_dir(".git").unwrap();
+
+        // Set up HOME environment variable to temp directory
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
+
+        let report_path = temp_dir.path().join("apply.jsonl");
+        let options = commands::ApplyOptions {
+            report: Some(report_path.clone()),
+            ..Default::default()
+        };
+        assert!(commands::handle_apply(&options).is_ok());
+
+        let report = fs::read_to_string(&report_path).unwrap();
+        let record: serde_json::Value = serde_json::from_str(report.trim_end()).unwrap();
+        assert_eq!(record["outcome"], "no-stash");
+        assert!(record["checksum"].is_null());
+    }
+
+    #[test]
+    #[serial]
+    fn test_handle_apply_no_prompt() {
+        // Create a temporary directory and change to it
+        let temp_dir = TempDir::new().unwrap();
+        let original_dir = env::current_dir().unwrap();
+        env::set_current_dir(&temp_dir).unwrap();
+        
+        // Ensure cleanup happens
+        let _cleanup = defer::defer(|| {
+            let _ = env::set_current_dir(&original_dir);
+        });
+
+        // Create a .git directory to establish project root
+        fs::create_dir(".git").unwrap();
+
+        // Set up HOME environment variable to temp directory
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
+
+        fs::write("AGENTS.md", "# AGENTS\n\nStashed content").unwrap();
+        assert!(commands::handle_stash(&commands::StashOptions::default()).is_ok());
+        fs::write("AGENTS.md", "# AGENTS\n\nLocal content").unwrap();
+
+        // A confirmation would be needed, so the apply fails without reading stdin
+        let options = commands::ApplyOptions {
+            no_prompt: true,
+            ..Default::default()
+        };
+        let err = commands::handle_apply(&options).unwrap_err();
+        assert!(err.to_string().contains("Confirmation required"));
+        assert_eq!(fs::read_to_string("AGENTS.md").unwrap(), "# AGENTS\n\nLocal content");
+
+        // With --force there is nothing to confirm
+        let options = commands::ApplyOptions {
+            no_prompt: true,
+            force: true,
+            ..Default::default()
+        };
+        assert!(commands::handle_apply(&options).is_ok());
+        assert_eq!(fs::read_to_string("AGENTS.md").unwrap(), "# AGENTS\n\nStashed content");
+    }
+
+    #[test]
+    #[serial]
+    fn test_handle_apply_only_if_valid_local() {
+        // Create a temporary directory and change to it
+        let temp_dir = TempDir::new().unwrap();
+        let original_dir = env::current_dir().unwrap();
+        env::set_current_dir(&temp_dir).unwrap();
+        
+        // Ensure cleanup happens
+        let _cleanup = defer::defer(|| {
+            let _ = env::set_current_dir(&original_dir);
+        });
+
+        // Create a .git directory to establish project root
+        fs::create_dir(".git").unwrap();
+
+        // Set up HOME environment variable to temp directory
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
+
+        fs::write("AGENTS.md", "# AGENTS\n\nStashed content").unwrap();
+        assert!(commands::handle_stash(&commands::StashOptions::default()).is_ok());
+        let options = commands::ApplyOptions {
+            force: true,
+            only_if_valid_local: true,
+            ..Default::default()
+        };
+
+        // A valid local file is left alone
+        fs::write("AGENTS.md", "# AGENTS\n\nHand-edited content").unwrap();
+        let err = commands::handle_apply(&options).unwrap_err();
+        assert!(err.to_string().contains("already valid"));
+        assert_eq!(fs::read_to_string("AGENTS.md").unwrap(), "# AGENTS\n\nHand-edited content");
+
+        // An invalid local file is replaced
+        fs::write("AGENTS.md", "Notes without a header").unwrap();
+        assert!(commands::handle_apply(&options).is_ok());
+        assert_eq!(fs::read_to_string("AGENTS.md").unwrap(), "# AGENTS\n\nStashed content");
+
+        // A missing local file is created
+        fs::remove_file("AGENTS.md").unwrap();
+        assert!(commands::handle_apply(&options).is_ok());
+        assert_eq!(fs::read_to_string("AGENTS.md").unwrap(), "# AGENTS\n\nStashed content");
+    }
+
+    #[test]
+    #[serial]
+    fn test_handle_apply_only_if_valid_local_other_sources() {
+        // Create a temporary directory and change to it
+        let temp_dir = TempDir::new().unwrap();
+        let original_dir = env::current_dir().unwrap();
+        env::set_current_dir(&temp_dir).unwrap();
+        
+        // Ensure cleanup happens
+        let _cleanup = defer::defer(|| {
+            let _ = env::set_current_dir(&original_dir);
+        });
+
+        // Create a .git directory to establish project root
+        fs::create_dir(".git").unwrap();
+
+        // Set up HOME environment variable to temp directory
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
+
+        fs::write("AGENTS.md", "# AGENTS\n\nSnapshot content").unwrap();
+        assert!(commands::handle_snapshot(&commands::SnapshotOptions {
+            name: Some("s1".to_string()),
+            ..Default::default()
+        })
+        .is_ok());
+        fs::write("AGENTS.md", "# AGENTS\n\nChained content").unwrap();
+        assert!(commands::handle_stash(&commands::StashOptions::default()).is_ok());
+        let project_name = temp_dir.path().file_name().unwrap().to_str().unwrap().to_string();
+
+        let sources = [
+            commands::ApplyOptions { snapshot: Some("s1".to_string()), ..Default::default() },
+            commands::ApplyOptions { chain: vec![project_name], ..Default::default() },
+            commands::ApplyOptions { from_url: Some(serve_http("200 OK", "# AGENTS\n\nDownloaded content")), ..Default::default() },
+        ];
+        for source in sources {
+            let options = commands::ApplyOptions { force: true, only_if_valid_local: true, ..source };
+
+            // A valid local file is left alone whatever the source
+            fs::write("AGENTS.md", "# AGENTS\n\nHand-edited content").unwrap();
+            let err = commands::handle_apply(&options).unwrap_err();
+            assert!(err.to_string().contains("already valid"));
+            assert_eq!(fs::read_to_string("AGENTS.md").unwrap(), "# AGENTS\n\nHand-edited content");
+
+            // An invalid one is still replaced
+            fs::write("AGENTS.md", "Notes without a header").unwrap();
+            assert!(commands::handle_apply(&options).is_ok());
+            assert!(utils::is_valid_agents(&fs::read_to_string("AGENTS.md").unwrap()));
+        }
+    }
+
+    #[test]
+    #[serial]
+    fn test_handle_apply_fail_on_warning() {
+        // Create a temporary directory and change to it
+        let temp_dir = TempDir::new().unwrap();
+        let original_dir = env::current_dir().unwrap();
+        env::set_current_dir(&temp_dir).unwrap();
+        
+        // Ensure cleanup happens
+        let _cleanup = defer::defer(|| {
+            let _ = env::set_current_dir(&original_dir);
+        });
+
+        // Create a .git directory to establish project root
+        fs::create_dir(".git").unwrap();
+
+        // Set up HOME environment variable to temp directory
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
+
+        // Valid, but with nothing after the header
+        fs::write("AGENTS.md", "# AGENTS\n\n").unwrap();
+        assert!(commands::handle_stash(&commands::StashOptions::default()).is_ok());
+        fs::remove_file("AGENTS.md").unwrap();
+
+        let options = commands::ApplyOptions { fail_on_warning: true, ..Default::default() };
+        let err = commands::handle_apply(&options).unwrap_err();
+        assert!(err.to_string().contains("1 validation warning(s)"));
+        assert!(!Path::new("AGENTS.md").exists());
+
+        // Warnings are not fatal by default
+        assert!(commands::handle_apply(&commands::ApplyOptions::default()).is_ok());
+        assert_eq!(fs::read_to_string("AGENTS.md").unwrap(), "# AGENTS\n\n");
+    }
+
+    #[test]
+    #[serial]
+    fn test_handle_apply_record_origin() {
+        // Create a temporary directory and change to it
+        let temp_dir = TempDir::new().unwrap();
+        let original_dir = env::current_dir().unwrap();
+        env::set_current_dir(&temp_dir).unwrap();
+        
+        // Ensure cleanup happens
+        let _cleanup = defer::defer(|| {
+            let _ = env::set_current_dir(&original_dir);
+        });
+
+        // Create a .git directory to establish project root
+        fs::create_dir(".git").unwrap();
+
+        // Set up HOME environment variable to temp directory
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
+
+        let stashed = "# AGENTS\n\n- stashed rule\n";
+        fs::write("AGENTS.md", stashed).unwrap();
+        assert!(commands::handle_stash(&commands::StashOptions::default()).is_ok());
+        let project_name = temp_dir.path().file_name().unwrap().to_str().unwrap();
+        let stash_path = utils::get_stash_path(project_name).unwrap();
+
+        let options = commands::ApplyOptions { force: true, record_origin: true, ..Default::default() };
+        assert!(commands::handle_apply(&options).is_ok());
+        let applied = fs::read_to_string("AGENTS.md").unwrap();
+        let prefix = format!(
+            "{}<!-- agstash: applied from stash {} sha256:{} at ",
+            stashed,
+            project_name,
+            utils::content_checksum(stashed.as_bytes())
+        );
+        assert!(applied.starts_with(&prefix), "{}", applied);
+        assert!(applied.ends_with(" -->\n"));
+
+        // Applying again replaces the stamp rather than adding another
+        assert!(commands::handle_apply(&options).is_ok());
+        assert_eq!(fs::read_to_string("AGENTS.md").unwrap().matches("agstash: applied from").count(), 1);
+
+        // Re-stashing the applied file stores it without the stamp
+        assert!(commands::handle_stash(&commands::StashOptions::default()).is_ok());
+        assert_eq!(fs::read_to_string(&stash_path).unwrap(), stashed);
+
+        // The version stamp follows the origin and is stripped the same way
+        let options = commands::ApplyOptions { force: true, record_origin: true, stamp_version: true, ..Default::default() };
+        assert!(commands::handle_apply(&options).is_ok());
+        let applied = fs::read_to_string("AGENTS.md").unwrap();
+        assert!(applied.ends_with(&format!("{}\n", utils::version_stamp())), "{}", applied);
+        assert!(applied.contains(env!("CARGO_PKG_VERSION")));
+        assert!(commands::handle_stash(&commands::StashOptions::default()).is_ok());
+        assert_eq!(fs::read_to_string(&stash_path).unwrap(), stashed);
+    }
+
+    #[test]
+    #[serial]
+    fn test_handle_apply_no_create() {
+        // Create a temporary directory and change to it
+        let temp_dir = TempDir::new().unwrap();
+        let original_dir = env::current_dir().unwrap();
+        env::set_current_dir(&temp_dir).unwrap();
+        
+        // Ensure cleanup happens
+        let _cleanup = defer::defer(|| {
+            let _ = env::set_current_dir(&original_dir);
+        });
+
+        // Set up HOME environment variable to temp directory
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
+
+        fs::create_dir("service").unwrap();
+        fs::write("service/AGENTS.md", "# AGENTS\n\n- stashed rule\n").unwrap();
+        let stash_options = commands::StashOptions { force_dir: Some(PathBuf::from("service")), ..Default::default() };
+        assert!(commands::handle_stash(&stash_options).is_ok());
+        let apply = |dir: &str| {
+            commands::handle_apply(&commands::ApplyOptions {
+                force_dir: Some(PathBuf::from(dir)),
+                force: true,
+                no_create: true,
+                ..Default::default()
+            })
+        };
+
+        // A missing target directory is an error
+        assert!(apply("missing").is_err());
+        assert!(!Path::new("missing").exists());
+
+        // So is a missing AGENTS.md in an existing directory, and a dry run says so too
+        fs::remove_file("service/AGENTS.md").unwrap();
+        assert!(apply("service").unwrap_err().to_string().contains("--no-create"));
+        assert!(!Path::new("service/AGENTS.md").exists());
+        let dry_run = commands::ApplyOptions {
+            force_dir: Some(PathBuf::from("service")),
+            no_create: true,
+            dry_run: true,
+            ..Default::default()
+        };
+        assert!(commands::handle_apply(&dry_run).unwrap_err().to_string().contains("--no-create"));
+        assert!(commands::plan_apply(&dry_run).is_err());
+
+        // An existing file is updated
+        fs::write("service/AGENTS.md", "# AGENTS\n\n- local rule\n").unwrap();
+        assert_eq!(commands::plan_apply(&dry_run).unwrap().action, "overwrite");
+        assert!(apply("service").is_ok());
+        assert_eq!(fs::read_to_string("service/AGENTS.md").unwrap(), "# AGENTS\n\n- stashed rule\n");
+    }
+
+    #[test]
+    #[serial]
+    fn test_handle_apply_expect_project() {
+        // Create a temporary directory and change to it
+        let temp_dir = TempDir::new().unwrap();
+        let original_dir = env::current_dir().unwrap();
+        env::set_current_dir(&temp_dir).unwrap();
+        
+        // Ensure cleanup happens
+        let _cleanup = defer::defer(|| {
+            let _ = env::set_current_dir(&original_dir);
+        });
+
+        // Set up HOME environment variable to temp directory
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
+
+        fs::create_dir("checkout").unwrap();
+        fs::write("checkout/AGENTS.md", "# AGENTS\n\n- stashed rule\n").unwrap();
+        let stash_options = commands::StashOptions { force_dir: Some(PathBuf::from("checkout")), ..Default::default() };
+        assert!(commands::handle_stash(&stash_options).is_ok());
+        fs::remove_file("checkout/AGENTS.md").unwrap();
+        let apply = |expected: &str| {
+            commands::handle_apply(&commands::ApplyOptions {
+                force_dir: Some(PathBuf::from("checkout")),
+                expect_project: Some(expected.to_string()),
+                ..Default::default()
+            })
+        };
+
+        let err = apply("other-repo").unwrap_err();
+        assert!(err.to_string().contains("not the expected other-repo"));
+        assert!(!Path::new("checkout/AGENTS.md").exists());
+
+        assert!(apply("checkout").is_ok());
+        assert_eq!(fs::read_to_string("checkout/AGENTS.md").unwrap(), "# AGENTS\n\n- stashed rule\n");
+    }
+
+    #[test]
+    #[serial]
+    fn test_handle_apply_normalize_line_endings() {
+        // Create a temporary directory and change to it
+        let temp_dir = TempDir::new().unwrap();
+        let original_dir = env::current_dir().unwrap();
+        env::set_current_dir(&temp_dir).unwrap();
+        
+        // Ensure cleanup happens
+        let _cleanup = defer::defer(|| {
+            let _ = env::set_current_dir(&original_dir);
+        });
+
+        // Create a .git directory to establish project root
+        fs::create_dir(".git").unwrap();
+
+        // Set up HOME environment variable to temp directory
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
+
+        fs::write("AGENTS.md", "# AGENTS\n\n- stashed rule\n").unwrap();
+        assert!(commands::handle_stash(&commands::StashOptions::default()).is_ok());
+        let apply = |endings: Option<utils::LineEndings>| {
+            commands::handle_apply(&commands::ApplyOptions {
+                force: true,
+                normalize_line_endings: endings,
+                ..Default::default()
+            })
+        };
+
+        assert!(apply(Some(utils::LineEndings::Crlf)).is_ok());
+        assert_eq!(fs::read_to_string("AGENTS.md").unwrap(), "# AGENTS\r\n\r\n- stashed rule\r\n");
+
+        assert!(apply(Some(utils::LineEndings::Lf)).is_ok());
+        assert_eq!(fs::read_to_string("AGENTS.md").unwrap(), "# AGENTS\n\n- stashed rule\n");
+
+        // By default the stash's own endings are kept
+        let project_name = temp_dir.path().file_name().unwrap().to_str().unwrap();
+        fs::write(utils::get_stash_path(project_name).unwrap(), "# AGENTS\r\n- crlf rule\n").unwrap();
+        assert!(apply(None).is_ok());
+        assert_eq!(fs::read_to_string("AGENTS.md").unwrap(), "# AGENTS\r\n- crlf rule\n");
+    }
+
+    #[test]
+    #[serial]
+    fn test_handle_apply_lock_file() {
+        // Create a temporary directory and change to it
+        let temp_dir = TempDir::new().unwrap();
+        let original_dir = env::current_dir().unwrap();
+        env::set_current_dir(&temp_dir).unwrap();
+        
+        // Ensure cleanup happens
+        let _cleanup = defer::defer(|| {
+            let _ = env::set_current_dir(&original_dir);
+        });
+
+        // Create a .git directory to establish project root
+        fs::create_dir(".git").unwrap();
+
+        // Set up HOME environment variable to temp directory
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
+
+        fs::write("AGENTS.md", "# AGENTS\n\nLocked content").unwrap();
+        assert!(commands::handle_stash(&commands::StashOptions::default()).is_ok());
+        fs::remove_file("AGENTS.md").unwrap();
+
+        // While the external lock is held the apply refuses to proceed
+        let lock_path = temp_dir.path().join("deploy.lock");
+        let held = utils::acquire_lock(&lock_path, Duration::ZERO).unwrap();
+        let options = commands::ApplyOptions {
+            lock_file: Some(lock_path.clone()),
+            lock_timeout: Duration::from_millis(100),
+            ..Default::default()
+        };
+        let err = commands::handle_apply(&options).unwrap_err();
+        assert!(err.to_string().contains("Could not acquire lock"));
+        assert!(!Path::new("AGENTS.md").exists());
+
+        // Released, the apply goes ahead and gives the lock back afterwards
+        drop(held);
+        assert!(commands::handle_apply(&options).is_ok());
+        assert_eq!(fs::read_to_string("AGENTS.md").unwrap(), "# AGENTS\n\nLocked content");
+        assert!(utils::acquire_lock(&lock_path, Duration::ZERO).is_ok());
+
+        // The default lock file is created in the .agstash directory
+        fs::remove_dir_all(utils::get_agstash_dir().unwrap()).unwrap();
+        let options = commands::ApplyOptions {
+            lock_file: Some(utils::get_lock_path().unwrap()),
+            force: true,
+            ..Default::default()
+        };
+        assert!(commands::handle_apply(&options).is_ok());
+        assert!(utils::get_lock_path().unwrap().exists());
+    }
+
+    #[test]
+    #[serial]
+    fn test_handle_apply_expect_checksum() {
+        // Create a temporary directory and change to it
+        let temp_dir = TempDir::new().unwrap();
+        let original_dir = env::current_dir().unwrap();
+        env::set_current_dir(&temp_dir).unwrap();
+        
+        // Ensure cleanup happens
+        let _cleanup = defer::defer(|| {
+            let _ = env::set_current_dir(&original_dir);
+        });
+
+        // Create a .git directory to establish project root
+        fs::create_dir(".git").unwrap();
+
+        // Set up HOME environment variable to temp directory
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
+
+        fs::write("AGENTS.md", "# AGENTS\n\nVerified content").unwrap();
+        assert!(commands::handle_stash(&commands::StashOptions::default()).is_ok());
+        fs::remove_file("AGENTS.md").unwrap();
+        let project_name = temp_dir.path().file_name().unwrap().to_str().unwrap();
+        let checksum = utils::file_checksum(utils::get_stash_path(project_name).unwrap()).unwrap();
+
+        // A mismatching checksum aborts before anything is written
+        let options = commands::ApplyOptions {
+            expect_sha256: Some("0".repeat(64)),
+            ..Default::default()
+        };
+        let err = commands::handle_apply(&options).unwrap_err();
+        assert!(err.to_string().contains("Checksum mismatch"));
+        assert!(err.to_string().contains(&checksum));
+        assert!(!Path::new("AGENTS.md").exists());
+
+        // Malformed checksums are rejected
+        let options = commands::ApplyOptions {
+            expect_sha256: Some("abc123".to_string()),
+            ..Default::default()
+        };
+        assert!(commands::handle_apply(&options).unwrap_err().to_string().contains("Invalid SHA-256"));
+
+        // A matching checksum from a sha256sum-style file applies, in either case
+        let checksum_path = temp_dir.path().join("AGENTS.md.sha256");
+        fs::write(&checksum_path, format!("{}  AGENTS.md\n", checksum.to_uppercase())).unwrap();
+        let options = commands::ApplyOptions {
+            checksum_file: Some(checksum_path),
+            ..Default::default()
+        };
+        assert!(commands::handle_apply(&options).is_ok());
+        assert_eq!(fs::read_to_string("AGENTS.md").unwrap(), "# AGENTS\n\nVerified content");
+    }
+
+    #[test]
+    fn test_section_span() {
+        let content = "# AGENTS\n\nIntro\n\n## Shared\n- shared rule\n### Details\n- detail\n\n## Project-specific\n```sh\n# not a heading\n```\n- local rule\n";
+        let sections = utils::parse_agents_sections(content);
+
+        // A section spans its subsections up to the next heading of its level
+        assert_eq!(commands::section_span(&sections, "Shared"), Some(1..3));
+
+        // Matching ignores case, and the last section runs to the end
+        assert_eq!(commands::section_span(&sections, "project-specific"), Some(3..4));
+
+        assert_eq!(commands::section_span(&sections, "not a heading"), None);
+        assert_eq!(commands::section_span(&sections, "Missing"), None);
+    }
+
+    #[test]
+    fn test_preserve_local_sections() {
+        let stash = "# AGENTS\n\n## Shared\n- new shared rule\n\n## Project-specific\n- stash placeholder\n\n## Tail\n- tail\n";
+        let local = "# AGENTS\n\n## Shared\n- old shared rule\n\n## Project-specific\n- local rule\n\n## Notes\n- my notes";
+        let titles = vec!["Project-specific".to_string(), "Notes".to_string(), "Absent".to_string()];
+
+        // Sections in both are replaced in place, local-only ones appended, shared guidance updated
+        assert_eq!(
+            commands::preserve_local_sections(stash, local, &titles),
+            "# AGENTS\n\n## Shared\n- new shared rule\n\n## Project-specific\n- local rule\n\n## Tail\n- tail\n\n## Notes\n- my notes\n"
+        );
+
+        // Without matching local sections the stash is applied as is
+        assert_eq!(commands::preserve_local_sections(stash, "# AGENTS\n", &titles), stash);
+    }
+
+    #[test]
+    #[serial]
+    fn test_handle_apply_preserve_local_sections() {
+        // Create a temporary directory and change to it
+        let temp_dir = TempDir::new().unwrap();
+        let original_dir = env::current_dir().unwrap();
+        env::set_current_dir(&temp_dir).unwrap();
+        
+        // Ensure cleanup happens
+        let _cleanup = defer::defer(|| {
+            let _ = env::set_current_dir(&original_dir);
+        });
+
+        // Create a .git directory to establish project root
+        fs::create_dir(".git").unwrap();
+
+        // Set up HOME environment variable to temp directory
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
+
+        fs::write("AGENTS.md", "# AGENTS\n\n## Shared\n- updated guidance\n").unwrap();
+        assert!(commands::handle_stash(&commands::StashOptions::default()).is_ok());
+        fs::write(
+            "AGENTS.md",
+            "# AGENTS\n\n## Shared\n- old guidance\n\n## Project-specific\n- run make check\n",
+        )
+        .unwrap();
+
+        // The stash lacks the local section, which survives the overwrite
+        let options = commands::ApplyOptions {
+            force: true,
+            preserve_local_sections: vec!["Project-specific".to_string()],
+            ..Default::default()
+        };
+        assert!(commands::handle_apply(&options).is_ok());
+        assert_eq!(
+            fs::read_to_string("AGENTS.md").unwrap(),
+            "# AGENTS\n\n## Shared\n- updated guidance\n\n## Project-specific\n- run make check\n"
+        );
+    }
+
+    // serve_http starts a server on a free local port that answers each request with the given
+    // status line and body, and returns its base URL
+    fn serve_http(status: &'static str, body: &'static str) -> String {
+        use std::io::{BufRead, BufReader, Write};
+        use std::net::TcpListener;
+
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let url = format!("http://{}", listener.local_addr().unwrap());
+        std::thread::spawn(move || {
+            for stream in listener.incoming() {
+                let Ok(mut stream) = stream else { break };
+                // Read the request headers before answering
+                let mut reader = BufReader::new(stream.try_clone().unwrap());
+                let mut line = String::new();
+                while reader.read_line(&mut line).map(|n| n > 0).unwrap_or(false) && line != "\r\n" {
+                    line.clear();
+                }
+                let response = format!(
+                    "HTTP/1.1 {}\r\nContent-Length: {}\r\nConnection: close\r\n\r\n{}",
+                    status,
+                    body.len(),
+                    body
+                );
+                let _ = stream.write_all(response.as_bytes());
+            }
+        });
+        url
+    }
+
+    #[test]
+    #[serial]
+    fn test_handle_apply_from_url() {
+        // Create a temporary directory and change to it
+        let temp_dir = TempDir::new().unwrap();
+        let original_dir = env::current_dir().unwrap();
+        env::set_current_dir(&temp_dir).unwrap();
+        
+        // Ensure cleanup happens
+        let _cleanup = defer::defer(|| {
+            let _ = env::set_current_dir(&original_dir);
+        });
+
+        // Create a .git directory to establish project root
+        fs::create_dir(".git").unwrap();
+
+        // Set up HOME environment variable to temp directory
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
+
+        let project_name = temp_dir.path().file_name().unwrap().to_str().unwrap();
+        let stash_path = utils::get_stash_path(project_name).unwrap();
+
+        // The downloaded content is applied without touching the stash
+        let url = serve_http("200 OK", "# AGENTS\n\nCanonical content");
+        let options = commands::ApplyOptions {
+            from_url: Some(url.clone()),
+            ..Default::default()
+        };
+        assert!(commands::handle_apply(&options).is_ok());
+        assert_eq!(fs::read_to_string("AGENTS.md").unwrap(), "# AGENTS\n\nCanonical content");
+        assert!(!stash_path.exists());
+
+        // Overwriting still needs confirmation, and can save the download as the stash
+        fs::write("AGENTS.md", "# AGENTS\n\nLocal content").unwrap();
+        let options = commands::ApplyOptions {
+            from_url: Some(url.clone()),
+            no_prompt: true,
+            ..Default::default()
+        };
+        assert!(commands::handle_apply(&options).is_err());
+        let options = commands::ApplyOptions {
+            from_url: Some(url),
+            force: true,
+            stash_download: true,
+            ..Default::default()
+        };
+        assert!(commands::handle_apply(&options).is_ok());
+        assert_eq!(fs::read_to_string("AGENTS.md").unwrap(), "# AGENTS\n\nCanonical content");
+        assert_eq!(fs::read_to_string(&stash_path).unwrap(), "# AGENTS\n\nCanonical content");
+
+        // Failed and invalid downloads leave AGENTS.md alone
+        fs::write("AGENTS.md", "# AGENTS\n\nLocal content").unwrap();
+        let options = commands::ApplyOptions {
+            from_url: Some(serve_http("500 Internal Server Error", "oops")),
+            force: true,
+            ..Default::default()
+        };
+        let err = commands::handle_apply(&options).unwrap_err();
+        assert!(err.to_string().contains("500"));
+        let options = commands::ApplyOptions {
+            from_url: Some(serve_http("200 OK", "not an AGENTS file")),
+            force: true,
+            ..Default::default()
+        };
+        assert!(commands::handle_apply(&options).is_ok());
+        assert_eq!(fs::read_to_string("AGENTS.md").unwrap(), "# AGENTS\n\nLocal content");
+
+        // A read-only stash is not replaced by --stash-download without --force
+        fs::write("AGENTS.md", "# AGENTS\n\nProtected content").unwrap();
+        assert!(commands::handle_stash(&commands::StashOptions { read_only: true, force: true, ..Default::default() }).is_ok());
+        let url = serve_http("200 OK", "# AGENTS\n\nCanonical content");
+        let options = commands::ApplyOptions {
+            from_url: Some(url.clone()),
+            stash_download: true,
+            no_prompt: true,
+            ..Default::default()
+        };
+        let err = commands::handle_apply(&options).unwrap_err();
+        assert!(err.to_string().contains("read-only"));
+        assert_eq!(fs::read_to_string(&stash_path).unwrap(), "# AGENTS\n\nProtected content");
+        assert_eq!(fs::read_to_string("AGENTS.md").unwrap(), "# AGENTS\n\nProtected content");
+
+        // With --force it is, and it stays read-only
+        let options = commands::ApplyOptions { force: true, no_prompt: false, ..options };
+        assert!(commands::handle_apply(&options).is_ok());
+        assert_eq!(fs::read_to_string(&stash_path).unwrap(), "# AGENTS\n\nCanonical content");
+        assert!(fs::metadata(&stash_path).unwrap().permissions().readonly());
+    }
+
+    #[test]
+    #[serial]
+    #[cfg(unix)]
+    fn test_handle_apply_post_agents_hook() {
+        use std::os::unix::fs::PermissionsExt;
+
+        // Create a temporary directory and change to it
+        let temp_dir = TempDir::new().unwrap();
+        let original_dir = env::current_dir().unwrap();
+        env::set_current_dir(&temp_dir).unwrap();
+        
+        // Ensure cleanup happens
+        let _cleanup = defer::defer(|| {
+            let _ = env::set_current_dir(&original_dir);
+        });
+
+        // Create a .git directory to establish project root
+        fs::create_dir(".git").unwrap();
+
+        // Set up HOME environment variable to temp directory
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
+
+        fs::write("AGENTS.md", "# AGENTS\n\nHooked content").unwrap();
+        assert!(commands::handle_stash(&commands::StashOptions::default()).is_ok());
+
+        // The hook records the project directory it was given
+        let hook_path = temp_dir.path().join(".git").join("hooks").join("post-agents");
+        fs::create_dir_all(hook_path.parent().unwrap()).unwrap();
+        fs::write(&hook_path, "#!/bin/sh\nprintf '%s' \"$AGSTASH_PROJECT_DIR\" > hook-ran\n").unwrap();
+        fs::set_permissions(&hook_path, fs::Permissions::from_mode(0o755)).unwrap();
+
+        // Without the option the hook is not run
+        assert!(commands::handle_apply(&commands::ApplyOptions { force: true, ..Default::default() }).is_ok());
+        assert!(!Path::new("hook-ran").exists());
+
+        let options = commands::ApplyOptions {
+            force: true,
+            run_hooks: true,
+            ..Default::default()
+        };
+        assert!(commands::handle_apply(&options).is_ok());
+        let project_dir = fs::read_to_string("hook-ran").unwrap();
+        assert_eq!(fs::canonicalize(project_dir).unwrap(), fs::canonicalize(temp_dir.path()).unwrap());
+
+        // A hook that is not executable is skipped, and a failing one does not fail the apply
+        fs::remove_file("hook-ran").unwrap();
+        fs::set_permissions(&hook_path, fs::Permissions::from_mode(0o644)).unwrap();
+        assert!(commands::handle_apply(&options).is_ok());
+        assert!(!Path::new("hook-ran").exists());
+        fs::write(&hook_path, "#!/bin/sh\nexit 3\n").unwrap();
+        fs::set_permissions(&hook_path, fs::Permissions::from_mode(0o755)).unwrap();
+        assert!(commands::handle_apply(&options).is_ok());
+    }
+
+    #[test]
+    #[serial]
+    fn test_handle_apply_lockstep() {
+        // Create a temporary directory and change to it
+        let temp_dir = TempDir::new().unwrap();
+        let original_dir = env::current_dir().unwrap();
+        env::set_current_dir(&temp_dir).unwrap();
+        
+        // Ensure cleanup happens
+        let _cleanup = defer::defer(|| {
+            let _ = env::set_current_dir(&original_dir);
+        });
+
+        // Create a .git directory to establish project root
+        fs::create_dir(".git").unwrap();
+
+        // Set up HOME environment variable to temp directory
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
+
+        fs::write("AGENTS.md", "# AGENTS\n\nOriginal stash").unwrap();
+        assert!(commands::handle_stash(&commands::StashOptions::default()).is_ok());
+        fs::remove_file("AGENTS.md").unwrap();
+        let project_name = temp_dir.path().file_name().unwrap().to_str().unwrap();
+        let stash_path = utils::get_stash_path(project_name).unwrap();
+        let options = commands::ApplyOptions {
+            lockstep: true,
+            ..Default::default()
+        };
+
+        // The stash changes after its checksum was recorded, so the write is refused
+        let recorded = utils::file_checksum(&stash_path).unwrap();
+        fs::write(&stash_path, "# AGENTS\n\nChanged mid-apply").unwrap();
+        let agents_path = temp_dir.path().join("AGENTS.md");
+        let err = commands::apply_stash_content(&stash_path, &agents_path, project_name, &options, Some(&recorded)).unwrap_err();
+        assert!(err.to_string().contains("changed during the apply"));
+        assert!(!agents_path.exists());
+
+        // An unchanged stash applies normally
+        assert!(commands::handle_apply(&options).is_ok());
+        assert_eq!(fs::read_to_string("AGENTS.md").unwrap(), "# AGENTS\n\nChanged mid-apply");
+    }
+
+    #[test]
+    fn test_checksum_line() {
+        use sha2::{Digest, Sha256};
+
+        let temp_dir = TempDir::new().unwrap();
+        let path = temp_dir.path().join("AGENTS.md");
+        fs::write(&path, "# AGENTS\n\nChecked content").unwrap();
+
+        let expected: String = Sha256::digest(b"# AGENTS\n\nChecked content")
+            .iter()
+            .map(|byte| format!("{:02x}", byte))
+            .collect();
+        assert_eq!(
+            commands::checksum_line(&path).unwrap(),
+            format!("{}  {}", expected, path.display())
+        );
+    }
+
+    #[test]
+    #[serial]
+    fn test_handle_placeholder_report() {
+        // Create a temporary directory and change to it
+        let temp_dir = TempDir::new().unwrap();
+        let original_dir = env::current_dir().unwrap();
+        env::set_current_dir(&temp_dir).unwrap();
+        
+        // Ensure cleanup happens
+        let _cleanup = defer::defer(|| {
+            let _ = env::set_current_dir(&original_dir);
+        });
+
+        // Create a .git directory to establish project root
+        fs::create_dir(".git").unwrap();
+
+        // Set up HOME environment variable to temp directory
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
+
+        // No stash yet
+        assert!(commands::handle_placeholder_report(&commands::ApplyOptions::default()).is_ok());
+
+        let stashed = "# AGENTS\n\n{{TEAM}} owns {{SERVICE}}.\n- Page {{TEAM}} via {{ONCALL_CHANNEL}}\n- {{SERVICE}} deploys go through {{TEAM}}\n";
+        fs::write("AGENTS.md", stashed).unwrap();
+        assert!(commands::handle_stash(&commands::StashOptions::default()).is_ok());
+        fs::remove_file("AGENTS.md").unwrap();
+
+        let project_name = temp_dir.path().file_name().unwrap().to_str().unwrap();
+        let placeholders = utils::find_placeholders(stashed);
+        let report = commands::render_placeholder_report(&placeholders, project_name);
+        let lines: Vec<&str> = report.lines().collect();
+        assert!(lines[0].starts_with("3 placeholder(s) in the stash for"));
+        assert_eq!(&lines[1..], ["  {{ONCALL_CHANNEL}}  1", "  {{SERVICE}}         2", "  {{TEAM}}            3"]);
+
+        // Nothing is written
+        assert!(commands::handle_placeholder_report(&commands::ApplyOptions::default()).is_ok());
+        assert!(!Path::new("AGENTS.md").exists());
+        assert!(commands::render_placeholder_report(&Default::default(), project_name).starts_with("No placeholders"));
+    }
+
+    #[test]
+    fn test_verify_written_file() {
+        let temp_dir = TempDir::new().unwrap();
+        let path = temp_dir.path().join("AGENTS.md");
+        fs::write(&path, "# AGENTS\n\nWritten content").unwrap();
+
+        assert!(commands::verify_written_file(&path, "# AGENTS\n\nWritten content").is_ok());
+
+        // A file that reads back differently is caught
+        let err = commands::verify_written_file(&path, "# AGENTS\n\nIntended content").unwrap_err();
+        assert!(err.to_string().contains("does not match what was written"));
+
+        // So is content that matches but no longer validates
+        fs::write(&path, "").unwrap();
+        let err = commands::verify_written_file(&path, "").unwrap_err();
+        assert!(err.to_string().contains("is invalid"));
+    }
+
+    #[test]
+    #[serial]
+    fn test_handle_stash_auto() {
+        // Create a temporary directory and change to it
+        let temp_dir = TempDir::new().unwrap();
+        let original_dir = env::current_dir().unwrap();
+        env::set_current_dir(&temp_dir).unwrap();
+        
+        // Ensure cleanup happens
+        let _cleanup = defer::defer(|| {
+            let _ = env::set_current_dir(&original_dir);
+        });
+
+        // Create a .git directory to establish project root
+        fs::create_dir(".git").unwrap();
+
+        // Set up HOME environment variable to temp directory
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
+
+        let options = commands::StashOptions { auto: true, ..Default::default() };
+        let project_name = temp_dir.path().file_name().unwrap().to_str().unwrap();
+        let stash_path = utils::get_stash_path(project_name).unwrap();
+
+        // Missing AGENTS.md is skipped
+        assert!(commands::handle_stash(&options).is_ok());
+        assert!(!stash_path.exists());
+
+        // Valid content is stashed
+        fs::write("AGENTS.md", "# AGENTS\n\nSaved from the editor").unwrap();
+        assert!(commands::handle_stash(&options).is_ok());
+        assert_eq!(fs::read_to_string(&stash_path).unwrap(), "# AGENTS\n\nSaved from the editor");
+
+        // Unchanged content leaves the stash untouched
+        let old_mtime = std::time::SystemTime::UNIX_EPOCH + Duration::from_secs(1_600_000_000);
+        utils::set_modified_time(&stash_path, old_mtime).unwrap();
+        assert!(commands::handle_stash(&options).is_ok());
+        assert_eq!(fs::metadata(&stash_path).unwrap().modified().unwrap(), old_mtime);
+
+        // Invalid content is skipped and the last good stash is kept
+        fs::write("AGENTS.md", "half-typed edit").unwrap();
+        assert!(commands::handle_stash(&options).is_ok());
+        assert_eq!(fs::read_to_string(&stash_path).unwrap(), "# AGENTS\n\nSaved from the editor");
+
+        // Failures such as a read-only stash never surface as errors
+        fs::write("AGENTS.md", "# AGENTS\n\nNewer edit").unwrap();
+        utils::set_file_mode(&stash_path, 0o444).unwrap();
+        assert!(commands::handle_stash(&options).is_ok());
+        assert_eq!(fs::read_to_string(&stash_path).unwrap(), "# AGENTS\n\nSaved from the editor");
+        assert!(commands::handle_stash(&commands::StashOptions::default()).is_err());
+    }
+
+    #[test]
+    #[serial]
+    fn test_handle_stash_auto_silent() {
+        // Create a temporary directory and change to it
+        let temp_dir = TempDir::new().unwrap();
+        let original_dir = env::current_dir().unwrap();
+        env::set_current_dir(&temp_dir).unwrap();
+        
+        // Ensure cleanup happens
+        let _cleanup = defer::defer(|| {
+            let _ = env::set_current_dir(&original_dir);
+            utils::set_log_output(None);
+        });
+
+        // Create a .git directory to establish project root
+        fs::create_dir(".git").unwrap();
+
+        // Set up HOME environment variable to temp directory
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
+
+        let buffer = SharedBuffer::default();
+        utils::set_log_output(Some(Box::new(buffer.clone())));
+        let logged = || String::from_utf8(std::mem::take(&mut *buffer.0.lock().unwrap())).unwrap();
+        let options = commands::StashOptions { auto: true, ..Default::default() };
+        let project_name = temp_dir.path().file_name().unwrap().to_str().unwrap();
+        let stash_path = utils::get_stash_path(project_name).unwrap();
+
+        // Valid, unchanged and invalid content are all handled without logging anything
+        for content in ["# AGENTS\n\nSaved from the editor", "# AGENTS\n\nSaved from the editor", "half-typed edit"] {
+            fs::write("AGENTS.md", content).unwrap();
+            assert!(commands::handle_stash(&options).is_ok());
+            assert_eq!(logged(), "");
+        }
+        assert_eq!(fs::read_to_string(&stash_path).unwrap(), "# AGENTS\n\nSaved from the editor");
+
+        // So are a failed lint and a link
+        fs::write("AGENTS.md", "\n# AGENTS\n\nHeader after a blank line\n").unwrap();
+        assert!(commands::handle_stash(&commands::StashOptions { auto: true, lint: true, ..Default::default() }).is_ok());
+        assert_eq!(fs::read_to_string(&stash_path).unwrap(), "# AGENTS\n\nSaved from the editor");
+        assert!(commands::handle_stash(&commands::StashOptions { auto: true, link: true, ..Default::default() }).is_ok());
+        assert!(utils::is_symlink(&stash_path));
+        assert_eq!(logged(), "");
+
+        // The log is kept with verbose, and the usual output is restored afterwards
+        assert!(commands::handle_stash(&commands::StashOptions { auto: true, verbose: true, ..Default::default() }).is_ok());
+        assert!(logged().contains("INFO: Found project root"));
+        assert!(commands::handle_stash(&commands::StashOptions::default()).is_ok());
+        assert!(logged().contains("INFO: Stashing to path"));
+    }
+
+    #[test]
+    #[serial]
+    fn test_strict_header() {
+        // Create a temporary directory and change to it
+        let temp_dir = TempDir::new().unwrap();
+        let original_dir = env::current_dir().unwrap();
+        env::set_current_dir(&temp_dir).unwrap();
+        
+        // Ensure cleanup happens
+        let _cleanup = defer::defer(|| {
+            let _ = env::set_current_dir(&original_dir);
+        });
+
+        // Create a .git directory to establish project root
+        fs::create_dir(".git").unwrap();
+
+        // Set up HOME environment variable to temp directory
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
+
+        let project_name = temp_dir.path().file_name().unwrap().to_str().unwrap();
+        let stash_path = utils::get_stash_path(project_name).unwrap();
+        fs::write("AGENTS.md", "\n\n# AGENTS\n\nLeading blank lines\n").unwrap();
+
+        // Stash: rejected under strict mode, accepted once normalized
+        let err = commands::handle_stash(&commands::StashOptions { strict_header: true, ..Default::default() }).unwrap_err();
+        assert!(err.to_string().contains("--strict-header"));
+        assert!(!stash_path.exists());
+        let options = commands::StashOptions { strict_header: true, normalize_header: true, ..Default::default() };
+        assert!(commands::handle_stash(&options).is_ok());
+        assert_eq!(fs::read_to_string(&stash_path).unwrap(), "# AGENTS\n\nLeading blank lines\n");
+
+        // Apply: the same for a stash with leading blank lines
+        fs::write(&stash_path, "\n\n# AGENTS\n\nLeading blank lines\n").unwrap();
+        fs::remove_file("AGENTS.md").unwrap();
+        let err = commands::handle_apply(&commands::ApplyOptions { strict_header: true, ..Default::default() }).unwrap_err();
+        assert!(err.to_string().contains("--strict-header"));
+        assert!(!Path::new("AGENTS.md").exists());
+        let options = commands::ApplyOptions { strict_header: true, normalize_header: true, ..Default::default() };
+        assert!(commands::handle_apply(&options).is_ok());
+        assert_eq!(fs::read_to_string("AGENTS.md").unwrap(), "# AGENTS\n\nLeading blank lines\n");
+
+        // Without the flags leading blank lines are still fine
+        fs::remove_file("AGENTS.md").unwrap();
+        assert!(commands::handle_apply(&commands::ApplyOptions::default()).is_ok());
+        assert_eq!(fs::read_to_string("AGENTS.md").unwrap(), "\n\n# AGENTS\n\nLeading blank lines\n");
+    }
+
+    #[test]
+    #[serial]
+    fn test_handle_stash_verify() {
+        // Create a temporary directory and change to it
+        let temp_dir = TempDir::new().unwrap();
+        let original_dir = env::current_dir().unwrap();
+        env::set_current_dir(&temp_dir).unwrap();
+        
+        // Ensure cleanup happens
+        let _cleanup = defer::defer(|| {
+            let _ = env::set_current_dir(&original_dir);
+        });
+
+        // Create a .git directory to establish project root
+        fs::create_dir(".git").unwrap();
+
+        // Set up HOME environment variable to temp directory
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
+
+        fs::write("AGENTS.md", "# AGENTS\n\nVerified stash").unwrap();
+        let options = commands::StashOptions { verify: true, ..Default::default() };
+        assert!(commands::handle_stash(&options).is_ok());
+
+        // A truncated read-back is caught
+        let intended = "# AGENTS\n\nVerified stash";
+        let mut truncated: &[u8] = b"# AGENTS\n\nVeri";
+        let err = commands::verify_read_back(&mut truncated, intended, "stash").unwrap_err();
+        assert!(err.to_string().contains("stash does not match what was written"));
+
+        // So is a read that fails outright
+        struct FaultyReader;
+        impl io::Read for FaultyReader {
+            fn read(&mut self, _buf: &mut [u8]) -> io::Result<usize> {
+                Err(io::Error::other("injected read fault"))
+            }
+        }
+        let err = commands::verify_read_back(&mut FaultyReader, intended, "stash").unwrap_err();
+        assert!(err.to_string().contains("could not re-read stash: injected read fault"));
+
+        let mut intact: &[u8] = intended.as_bytes();
+        assert!(commands::verify_read_back(&mut intact, intended, "stash").is_ok());
+    }
+
+    #[test]
+    #[serial]
+    fn test_handle_apply_verify_after() {
+        // Create a temporary directory and change to it
+        let temp_dir = TempDir::new().unwrap();
+        let original_dir = env::current_dir().unwrap();
+        env::set_current_dir(&temp_dir).unwrap();
+        
+        // Ensure cleanup happens
+        let _cleanup = defer::defer(|| {
+            let _ = env::set_current_dir(&original_dir);
+        });
+
+        // Create a .git directory to establish project root
+        fs::create_dir(".git").unwrap();
+
+        // Set up HOME environment variable to temp directory
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
+
+        fs::write("AGENTS.md", "# AGENTS\n\nVerified content").unwrap();
+        assert!(commands::handle_stash(&commands::StashOptions::default()).is_ok());
+        fs::remove_file("AGENTS.md").unwrap();
+
+        let options = commands::ApplyOptions {
+            verify_after: true,
+            ..Default::default()
+        };
+        assert!(commands::handle_apply(&options).is_ok());
+        assert_eq!(fs::read_to_string("AGENTS.md").unwrap(), "# AGENTS\n\nVerified content");
+    }
+
+    #[test]
+    #[serial]
+    fn test_handle_apply_summary() {
+        // Create a temporary directory and change to it
+        let temp_dir = TempDir::new().unwrap();
+        let original_dir = env::current_dir().unwrap();
+        env::set_current_dir(&temp_dir).unwrap();
+        
+        // Ensure cleanup happens
+        let _cleanup = defer::defer(|| {
+            let _ = env::set_current_dir(&original_dir);
+        });
+
+        // Create a .git directory to establish project root
+        fs::create_dir(".git").unwrap();
+
+        // Set up HOME environment variable to temp directory
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
+
+        use commands::ApplyOutcome;
+        assert_eq!(
+            commands::apply_summary(ApplyOutcome::Created, "myproj", Some(512)),
+            "agstash: applied AGENTS.md for myproj (created, 512 B)"
+        );
+        assert_eq!(
+            commands::apply_summary(ApplyOutcome::Overwritten, "myproj", Some(1434)),
+            "agstash: applied AGENTS.md for myproj (overwrote, 1.4 KB)"
+        );
+        assert_eq!(
+            commands::apply_summary(ApplyOutcome::NoStash, "myproj", None),
+            "agstash: skipped AGENTS.md for myproj (no stash)"
+        );
+        assert_eq!(commands::format_size(3 * 1024 * 1024), "3.0 MB");
+        for outcome in [ApplyOutcome::Created, ApplyOutcome::Overwritten, ApplyOutcome::NoStash, ApplyOutcome::InvalidStash] {
+            assert_eq!(commands::apply_summary(outcome, "myproj", Some(1)).lines().count(), 1);
+        }
+
+        // Each outcome goes through handle_apply with --summary
+        let options = commands::ApplyOptions { summary: true, force: true, ..Default::default() };
+        assert!(commands::handle_apply(&options).is_ok());
+        assert!(!Path::new("AGENTS.md").exists());
+        fs::write("AGENTS.md", "# AGENTS\n\nSummarized").unwrap();
+        assert!(commands::handle_stash(&commands::StashOptions::default()).is_ok());
+        assert!(commands::handle_apply(&options).is_ok());
+        fs::remove_file("AGENTS.md").unwrap();
+        assert!(commands::handle_apply(&options).is_ok());
+        assert_eq!(fs::read_to_string("AGENTS.md").unwrap(), "# AGENTS\n\nSummarized");
+    }
+
+    #[test]
+    #[serial]
+    fn test_handle_apply_chain() {
+        // Create a temporary directory and change to it
+        let temp_dir = TempDir::new().unwrap();
+        let original_dir = env::current_dir().unwrap();
+        env::set_current_dir(&temp_dir).unwrap();
+        
+        // Ensure cleanup happens
+        let _cleanup = defer::defer(|| {
+            let _ = env::set_current_dir(&original_dir);
+        });
+
+        // Create a .git directory to establish project root
+        fs::create_dir(".git").unwrap();
 
-    let stash_file_path = utils::get_stash_path(project_name)?;
-    let agents_md_file_path = root.join("AGENTS.md");
+        // Set up HOME environment variable to temp directory
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
 
-    utils::log_info(&format!("Looking for stash at: {}", stash_file_path.display()));
+        let stashes_dir = temp_dir.path().join(".agstash").join("stashes");
+        fs::create_dir_all(&stashes_dir).unwrap();
+        fs::write(
+            stashes_dir.join("stash-org.md"),
+            "# AGENTS\n\nOrg intro.\n\n## Style\n\n- org style\n\n## Security\n\n- never log secrets\n",
+        )
+        .unwrap();
+        fs::write(stashes_dir.join("stash-team.md"), "# AGENTS\n\n## Style\n\n- team style\n\n### Naming\n\n- snake_case\n").unwrap();
+        fs::write(stashes_dir.join("stash-app.md"), "# AGENTS\n\nApp intro.\n\n## Testing\n\n- run cargo test\n").unwrap();
 
-    // Check if stash exists first
-    if !utils::file_exists(&stash_file_path) {
-        utils::log_info(&format!("No stash found for project: {}", project_name));
-        println!("No stash found for project {}", color_string(project_name, BOLD));
-        return Ok(());
-    }
+        let chain = |names: &[&str]| commands::ApplyOptions {
+            chain: names.iter().map(|name| name.to_string()).collect(),
+            force: true,
+            ..Default::default()
+        };
 
-    // Check if we need user confirmation
-    let needs_confirmation = utils::file_exists(&agents_md_file_path) && !force;
-    if needs_confirmation {
-        utils::log_info("AGENTS.md exists and force is false, prompting user");
-        println!(
-            "\n{} {} already exists in the current directory.",
-            color_string("WARNING:", &format!("{}{}", YELLOW, BOLD)),
-            color_string("AGENTS.md", BOLD)
+        // The team overrides Style, Security is kept from the org, the app appends Testing and its intro wins
+        assert!(commands::handle_apply(&chain(&["org", "team", "app"])).is_ok());
+        assert_eq!(
+            fs::read_to_string("AGENTS.md").unwrap(),
+            "# AGENTS\n\nApp intro.\n\n## Style\n\n- team style\n\n### Naming\n\n- snake_case\n## Security\n\n- never log secrets\n\n## Testing\n\n- run cargo test\n"
         );
-        println!("Do you want to replace it with the stashed version?");
-        println!("This action will permanently overwrite the current file.\n");
-        print!("Type 'yes' to confirm or 'no' to cancel [y/N]: ");
-        io::stdout().flush()?; // Ensure the prompt is displayed
 
-        let user_confirmed = get_user_confirmation()?;
-        if !user_confirmed {
-            utils::log_info("User declined to overwrite, aborting apply");
-            println!("\nOperation cancelled. {} was not modified.", color_string("AGENTS.md", BOLD));
-            return Ok(());
-        } else {
-            utils::log_info("User confirmed overwrite");
-            println!("\nConfirmed. Applying stashed {}...", color_string("AGENTS.md", BOLD));
-        }
-    } else {
-        utils::log_info("No existing AGENTS.md or force is true, proceeding with apply");
+        // Order matters: the org stash last overrides the team's Style again
+        assert!(commands::handle_apply(&chain(&["team", "org"])).is_ok());
+        let composed = fs::read_to_string("AGENTS.md").unwrap();
+        assert!(composed.contains("- org style"));
+        assert!(!composed.contains("- team style"));
+        assert!(!composed.contains("snake_case"));
+        assert!(composed.contains("Org intro."));
+
+        // Every stash must exist and be valid
+        fs::write(stashes_dir.join("stash-broken.md"), "no header").unwrap();
+        let err = commands::handle_apply(&chain(&["org", "missing"])).unwrap_err();
+        assert!(err.to_string().contains("No stash found for missing"));
+        let err = commands::handle_apply(&chain(&["org", "broken"])).unwrap_err();
+        assert!(err.to_string().contains("is invalid"));
+        assert_eq!(fs::read_to_string("AGENTS.md").unwrap(), composed);
     }
 
-    // Validate and apply the stash
-    apply_stash_content(&stash_file_path, &agents_md_file_path, project_name)
-}
+    #[test]
+    #[serial]
+    fn test_handle_apply_keep_mtime() {
+        // Create a temporary directory and change to it
+        let temp_dir = TempDir::new().unwrap();
+        let original_dir = env::current_dir().unwrap();
+        env::set_current_dir(&temp_dir).unwrap();
+        
+        // Ensure cleanup happens
+        let _cleanup = defer::defer(|| {
+            let _ = env::set_current_dir(&original_dir);
+        });
 
-fn get_user_confirmation() -> Result<bool, Box<dyn std::error::Error>> {
-    let mut input = String::new();
-    io::stdin().read_line(&mut input)?;
+        // Create a .git directory to establish project root
+        fs::create_dir(".git").unwrap();
 
-    let input = input.trim().to_lowercase();
-    // Accept various forms of "yes"
-    if ["y", "yes", "ye", "yep", "yeah"].contains(&input.as_str()) {
-        return Ok(true);
-    }
-    // Accept various forms of "no" or default to no
-    if ["n", "no", "nope", ""].contains(&input.as_str()) {
-        return Ok(false);
-    }
-    // If input doesn't match expected values, default to false (no)
-    Ok(false)
-}
+        // Set up HOME environment variable to temp directory
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
 
-// apply_stash_content validates the stashed content and copies it to the project's AGENTS.md file
-fn apply_stash_content(
-    stash_file_path: &Path,
-    agents_md_file_path: &Path,
-    project_name: &str,
-) -> Result<(), Box<dyn std::error::Error>> {
-    utils::log_info(&format!("Reading stash content from: {}", stash_file_path.display()));
-    let (err, stash_content) = utils::read_file(stash_file_path);
-    if let Some(error) = err {
-        return Err(error);
-    }
+        fs::write("AGENTS.md", "# AGENTS\n\nTimed content").unwrap();
+        assert!(commands::handle_stash(&commands::StashOptions::default()).is_ok());
+        fs::remove_file("AGENTS.md").unwrap();
 
-    if !utils::is_valid_agents(&stash_content) {
-        utils::log_warn("Stash content is invalid, apply aborted");
-        println!(
-            "{} {}",
-            color_string("Stash content is invalid (missing '# AGENTS' header).", YELLOW),
-            color_string("Apply aborted.", YELLOW)
-        );
-        return Ok(());
-    }
+        let project_name = temp_dir.path().file_name().unwrap().to_str().unwrap();
+        let stash_path = utils::get_stash_path(project_name).unwrap();
+        let stash_mtime = std::time::SystemTime::UNIX_EPOCH + std::time::Duration::from_secs(1_600_000_000);
+        fs::File::options().write(true).open(&stash_path).unwrap().set_modified(stash_mtime).unwrap();
 
-    utils::log_info(&format!("Applying stash to: {}", agents_md_file_path.display()));
-    if let Some(error) = utils::copy_file(stash_file_path, agents_md_file_path) {
-        return Err(error);
+        let options = commands::ApplyOptions {
+            keep_mtime: true,
+            chmod: Some(0o444),
+            ..Default::default()
+        };
+        assert!(commands::handle_apply(&options).is_ok());
+        let applied_mtime = fs::metadata("AGENTS.md").unwrap().modified().unwrap();
+        assert_eq!(applied_mtime, fs::metadata(&stash_path).unwrap().modified().unwrap());
+        assert_eq!(applied_mtime, stash_mtime);
     }
-    utils::log_info(&format!("AGENTS.md applied for project: {}", project_name));
-    println!(
-        "{} AGENTS.md for {}",
-        color_string("Applied", GREEN),
-        color_string(project_name, BOLD)
-    );
 
-    Ok(())
-}
-
-// HandleUninstall completely removes the .agstash directory and all its contents from the user's home directory
-pub fn handle_uninstall() -> Result<(), Box<dyn std::error::Error>> {
-    let agstash_dir = utils::get_agstash_dir()?;
+    #[test]
+    #[serial]
+    fn test_handle_apply_reflow() {
+        // Create a temporary directory and change to it
+        let temp_dir = TempDir::new().unwrap();
+        let original_dir = env::current_dir().unwrap();
+        env::set_current_dir(&temp_dir).unwrap();
+        
+        // Ensure cleanup happens
+        let _cleanup = defer::defer(|| {
+            let _ = env::set_current_dir(&original_dir);
+        });
 
-    utils::log_info(&format!("Located agstash directory at: {}", agstash_dir.display()));
+        // Create a .git directory to establish project root
+        fs::create_dir(".git").unwrap();
 
-    if utils::file_exists(&agstash_dir) {
-        utils::log_info(&format!("Removing agstash directory: {}", agstash_dir.display()));
-        fs::remove_dir_all(&agstash_dir)?;
-        utils::log_info("Successfully removed agstash directory");
-        println!("{} {}", color_string("Removed", RED), agstash_dir.display());
-    } else {
-        utils::log_info(&format!("agstash directory does not exist: {}", agstash_dir.display()));
-        println!(
-            "{} {}",
-            color_string(".agstash directory", BOLD),
-            color_string("does not exist.", YELLOW)
-        );
-    }
+        // Set up HOME environment variable to temp directory
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
 
-    Ok(())
-}
+        let stashed = "# AGENTS\n\nKeep changes small and focused on one thing.\n\n- never wrap this long bullet line\n\n```\nlong code line stays as it is\n```\n";
+        fs::write("AGENTS.md", stashed).unwrap();
+        assert!(commands::handle_stash(&commands::StashOptions::default()).is_ok());
+        fs::remove_file("AGENTS.md").unwrap();
 
-#[cfg(test)]
-mod tests {
-    use std::fs;
-    use std::env;
-    use std::path::{Path, PathBuf};
-    use tempfile::TempDir;
-    use serial_test::serial;
+        let options = commands::ApplyOptions {
+            reflow: Some(20),
+            ..Default::default()
+        };
+        assert!(commands::handle_apply(&options).is_ok());
+        assert_eq!(
+            fs::read_to_string("AGENTS.md").unwrap(),
+            "# AGENTS\n\nKeep changes small\nand focused on one\nthing.\n\n- never wrap this long bullet line\n\n```\nlong code line stays as it is\n```\n"
+        );
 
-    use crate::commands;
-    use crate::utils;
+        // The stash itself is unchanged
+        let project_name = temp_dir.path().file_name().unwrap().to_str().unwrap();
+        assert_eq!(fs::read_to_string(utils::get_stash_path(project_name).unwrap()).unwrap(), stashed);
+    }
 
     #[test]
     #[serial]
-    fn test_handle_init() {
+    fn test_plan_apply_json() {
         // Create a temporary directory and change to it
         let temp_dir = TempDir::new().unwrap();
         let original_dir = env::current_dir().unwrap();
@@ -289,27 +6082,106 @@ mod tests {
         // Create a .git directory to establish project root
         fs::create_dir(".git").unwrap();
 
-        // Run init command with force to bypass confirmation
-        let result = commands::handle_init(true);
-        assert!(result.is_ok());
+        // Set up HOME environment variable to temp directory
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
 
-        // Check if AGENTS.md was created
-        let agents_file = temp_dir.path().join("AGENTS.md");
-        assert!(agents_file.exists());
+        let options = commands::ApplyOptions {
+            dry_run: true,
+            json: true,
+            ..Default::default()
+        };
+        let plan_json = |options: &commands::ApplyOptions| -> serde_json::Value {
+            let plan = commands::plan_apply(options).unwrap();
+            serde_json::from_str(&commands::render_apply_plan(&plan, true).unwrap()).unwrap()
+        };
 
-        // Read the content and verify it
-        let content = fs::read_to_string(&agents_file).unwrap();
-        let expected_content = "# AGENTS\n\n\n";
-        assert_eq!(content, expected_content);
+        // Without a stash the plan is a skip, and nothing is created
+        let plan = plan_json(&options);
+        assert_eq!(plan["action"], "skip");
+        assert_eq!(plan["reason"], "no stash found");
+        assert!(!utils::get_stashes_dir().unwrap().exists());
 
-        // Try to init again - should overwrite with force=true
-        let result = commands::handle_init(true);
-        assert!(result.is_ok());
+        fs::write("AGENTS.md", "# AGENTS\n\n- stashed rule\n").unwrap();
+        assert!(commands::handle_stash(&commands::StashOptions::default()).is_ok());
+        let project_name = temp_dir.path().file_name().unwrap().to_str().unwrap();
+        let stash_path = utils::get_stash_path(project_name).unwrap();
+
+        // Create: every stash line is added
+        fs::remove_file("AGENTS.md").unwrap();
+        let plan = plan_json(&options);
+        assert_eq!(plan["action"], "create");
+        assert_eq!(plan["project"], project_name);
+        assert_eq!(plan["stash"], stash_path.display().to_string());
+        assert!(plan["destination"].as_str().unwrap().ends_with("AGENTS.md"));
+        assert_eq!(plan["differs"], true);
+        assert!(plan.get("reason").is_none());
+        let hunks = plan["hunks"].as_array().unwrap();
+        assert_eq!(hunks.len(), 1);
+        assert_eq!(hunks[0]["old_start"], 0);
+        assert_eq!(hunks[0]["old_lines"], 0);
+        assert_eq!(hunks[0]["new_start"], 1);
+        assert_eq!(hunks[0]["new_lines"], 3);
+        for line in hunks[0]["lines"].as_array().unwrap() {
+            assert_eq!(line["op"], "add");
+        }
+        assert!(!Path::new("AGENTS.md").exists());
+
+        // Overwrite: the local edit shows up as a remove/add pair and the file is left alone
+        fs::write("AGENTS.md", "# AGENTS\n\n- local rule\n").unwrap();
+        let plan = plan_json(&options);
+        assert_eq!(plan["action"], "overwrite");
+        assert_eq!(plan["differs"], true);
+        let lines = plan["hunks"][0]["lines"].as_array().unwrap();
+        assert_eq!(lines[0], serde_json::json!({ "op": "context", "text": "# AGENTS" }));
+        assert_eq!(lines[2], serde_json::json!({ "op": "remove", "text": "- local rule" }));
+        assert_eq!(lines[3], serde_json::json!({ "op": "add", "text": "- stashed rule" }));
+        assert_eq!(fs::read_to_string("AGENTS.md").unwrap(), "# AGENTS\n\n- local rule\n");
+        let text = commands::render_apply_plan(&commands::plan_apply(&options).unwrap(), false).unwrap();
+        assert!(text.starts_with("Would overwrite"));
+        assert!(text.contains("@@ -1,3 +1,3 @@"));
+
+        // Overwriting with identical content differs in nothing
+        fs::copy(&stash_path, "AGENTS.md").unwrap();
+        let plan = commands::plan_apply(&options).unwrap();
+        assert_eq!(plan.action, "overwrite");
+        assert!(!plan.differs);
+        assert!(plan.hunks.is_empty());
+        assert!(commands::handle_apply(&options).is_ok());
+
+        // Content-changing flags are planned the way the apply would write them
+        fs::write("AGENTS.md", "# AGENTS\r\n\r\n- stashed rule\r\n").unwrap();
+        assert_eq!(plan_json(&options)["differs"], true);
+        let crlf_options = commands::ApplyOptions {
+            normalize_line_endings: Some(utils::LineEndings::Crlf),
+            ..options
+        };
+        assert_eq!(plan_json(&crlf_options)["differs"], false);
+        let lf_options = commands::ApplyOptions {
+            normalize_line_endings: Some(utils::LineEndings::Lf),
+            ..crlf_options
+        };
+        assert_eq!(plan_json(&lf_options)["differs"], true);
+
+        // A check the apply would fail on fails the plan too
+        fs::write(&stash_path, "\n\n# AGENTS\n\n- stashed rule\n").unwrap();
+        let strict_options = commands::ApplyOptions { strict_header: true, ..lf_options };
+        assert!(commands::plan_apply(&strict_options).is_err());
+        let normalized_options = commands::ApplyOptions { normalize_header: true, ..strict_options };
+        fs::write("AGENTS.md", "# AGENTS\n\n- stashed rule\n").unwrap();
+        assert_eq!(plan_json(&normalized_options)["differs"], false);
     }
 
     #[test]
     #[serial]
-    fn test_handle_clean() {
+    fn test_handle_apply_report_diff_json() {
         // Create a temporary directory and change to it
         let temp_dir = TempDir::new().unwrap();
         let original_dir = env::current_dir().unwrap();
@@ -323,29 +6195,79 @@ mod tests {
         // Create a .git directory to establish project root
         fs::create_dir(".git").unwrap();
 
-        // Create an AGENTS.md file
-        let agents_file = "AGENTS.md";
-        let agents_content = "# AGENTS\n\nTest content";
-        fs::write(agents_file, agents_content).unwrap();
+        // Set up HOME environment variable to temp directory
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
 
-        // Verify the file exists
-        assert!(Path::new(agents_file).exists());
+        let options = commands::ApplyOptions {
+            dry_run: true,
+            report_diff_json: true,
+            ..Default::default()
+        };
+        let diff_json = || -> serde_json::Value {
+            let plan = commands::plan_apply(&options).unwrap();
+            serde_json::from_str(&commands::render_diff_json(&plan.hunks).unwrap()).unwrap()
+        };
 
-        // Run clean command
-        let result = commands::handle_clean();
-        assert!(result.is_ok());
+        fs::write("AGENTS.md", "# AGENTS\n\n- one\n- two\n").unwrap();
+        assert!(commands::handle_stash(&commands::StashOptions::default()).is_ok());
 
-        // Check if AGENTS.md was removed
-        assert!(!Path::new(agents_file).exists());
+        // Insertion: the stash adds a line the local file lacks
+        fs::write("AGENTS.md", "# AGENTS\n\n- one\n").unwrap();
+        let hunks = diff_json();
+        let hunks = hunks.as_array().unwrap();
+        assert_eq!(hunks.len(), 1);
+        assert_eq!(hunks[0]["old_start"], 1);
+        assert_eq!(hunks[0]["old_lines"], 3);
+        assert_eq!(hunks[0]["new_start"], 1);
+        assert_eq!(hunks[0]["new_lines"], 4);
+        assert_eq!(hunks[0]["lines"][3], serde_json::json!({ "op": "add", "text": "- two" }));
 
-        // Try to clean again - should not error
-        let result = commands::handle_clean();
-        assert!(result.is_ok());
+        // Deletion: the local file has a line the stash lacks
+        fs::write("AGENTS.md", "# AGENTS\n\n- one\n- two\n- local\n").unwrap();
+        let hunks = diff_json();
+        let hunk = &hunks[0];
+        assert_eq!(hunk["old_start"], 2);
+        assert_eq!(hunk["old_lines"], 4);
+        assert_eq!(hunk["new_start"], 2);
+        assert_eq!(hunk["new_lines"], 3);
+        let lines = hunk["lines"].as_array().unwrap();
+        assert_eq!(lines.last().unwrap(), &serde_json::json!({ "op": "remove", "text": "- local" }));
+        for line in &lines[..lines.len() - 1] {
+            assert_eq!(line["op"], "context");
+        }
+
+        // With --dry-run nothing is written; without it the apply goes ahead
+        assert!(commands::handle_apply(&options).is_ok());
+        assert_eq!(fs::read_to_string("AGENTS.md").unwrap(), "# AGENTS\n\n- one\n- two\n- local\n");
+        let options = commands::ApplyOptions { report_diff_json: true, force: true, ..Default::default() };
+        assert!(commands::handle_apply(&options).is_ok());
+        assert_eq!(fs::read_to_string("AGENTS.md").unwrap(), "# AGENTS\n\n- one\n- two\n");
+
+        // Identical content has no hunks
+        assert_eq!(diff_json(), serde_json::json!([]));
+
+        // The hunks describe the reflowed content that would be written, not the raw stash
+        fs::write("AGENTS.md", "# AGENTS\n\nA paragraph long enough to wrap\n").unwrap();
+        assert!(commands::handle_stash(&commands::StashOptions::default()).is_ok());
+        let reflow_options = commands::ApplyOptions { reflow: Some(10), ..options };
+        let plan = commands::plan_apply(&reflow_options).unwrap();
+        assert!(plan.differs);
+        let hunks = commands::hunks_json(&plan.hunks);
+        assert_eq!(hunks[0]["lines"][2], serde_json::json!({ "op": "remove", "text": "A paragraph long enough to wrap" }));
+        assert_eq!(hunks[0]["lines"][3], serde_json::json!({ "op": "add", "text": "A" }));
     }
 
     #[test]
     #[serial]
-    fn test_handle_stash() {
+    fn test_handle_apply_dry_run_exit_code() {
         // Create a temporary directory and change to it
         let temp_dir = TempDir::new().unwrap();
         let original_dir = env::current_dir().unwrap();
@@ -370,33 +6292,50 @@ mod tests {
             }
         });
 
-        // Create an AGENTS.md file with valid content
-        let agents_file = "AGENTS.md";
-        let agents_content = "# AGENTS\n\nTest content";
-        fs::write(agents_file, agents_content).unwrap();
+        fs::write("AGENTS.md", "# AGENTS\n\n- canonical rule\n").unwrap();
+        assert!(commands::handle_stash(&commands::StashOptions::default()).is_ok());
 
-        // Run stash command
-        let result = commands::handle_stash();
-        assert!(result.is_ok());
+        // As a pre-commit hook would run it
+        let check = || {
+            commands::handle_apply(&commands::ApplyOptions {
+                dry_run: true,
+                exit_code: true,
+                ..Default::default()
+            })
+        };
 
-        // Check if the file was stashed
-        let project_name = temp_dir.path().file_name().unwrap().to_str().unwrap();
-        let stash_path = dirs::home_dir()
-            .unwrap()
-            .join(".agstash")
-            .join("stashes")
-            .join(format!("stash-{}.md", project_name));
-            
-        assert!(stash_path.exists());
+        // The committed file matches the stash
+        assert!(check().is_ok());
 
-        // Read the stashed content and verify it
-        let stashed_content = fs::read_to_string(&stash_path).unwrap();
-        assert_eq!(stashed_content, agents_content);
+        // A local edit makes the hook fail, without touching the file
+        fs::write("AGENTS.md", "# AGENTS\n\n- drifted rule\n").unwrap();
+        let err = check().unwrap_err();
+        assert!(err.to_string().contains("would change"));
+        assert_eq!(fs::read_to_string("AGENTS.md").unwrap(), "# AGENTS\n\n- drifted rule\n");
+
+        // A CRLF checkout only matches once the hook normalizes line endings the same way
+        fs::write("AGENTS.md", "# AGENTS\r\n\r\n- canonical rule\r\n").unwrap();
+        assert!(check().is_err());
+        let normalized_check = commands::handle_apply(&commands::ApplyOptions {
+            dry_run: true,
+            exit_code: true,
+            normalize_line_endings: Some(utils::LineEndings::Crlf),
+            ..Default::default()
+        });
+        assert!(normalized_check.is_ok());
+
+        // A missing file fails the hook too
+        fs::remove_file("AGENTS.md").unwrap();
+        assert!(check().is_err());
+        assert!(!Path::new("AGENTS.md").exists());
     }
 
     #[test]
     #[serial]
-    fn test_handle_stash_invalid_content() {
+    #[cfg(unix)]
+    fn test_handle_apply_chmod() {
+        use std::os::unix::fs::PermissionsExt;
+
         // Create a temporary directory and change to it
         let temp_dir = TempDir::new().unwrap();
         let original_dir = env::current_dir().unwrap();
@@ -421,26 +6360,41 @@ mod tests {
             }
         });
 
-        // Create an AGENTS.md file with invalid content (missing header)
-        let agents_file = "AGENTS.md";
-        let agents_content = "Invalid content without header";
-        fs::write(agents_file, agents_content).unwrap();
+        fs::write("AGENTS.md", "# AGENTS\n\nMode content").unwrap();
+        assert!(commands::handle_stash(&commands::StashOptions::default()).is_ok());
 
-        // Run stash command - should not error but should not stash
-        let result = commands::handle_stash();
-        assert!(result.is_ok());
+        for mode in [0o600, 0o444] {
+            fs::remove_file("AGENTS.md").unwrap();
+            let result = commands::handle_apply(&commands::ApplyOptions {
+                chmod: Some(mode),
+                ..Default::default()
+            });
+            assert!(result.is_ok());
 
-        // Check that no stash was created
-        let project_name = temp_dir.path().file_name().unwrap().to_str().unwrap();
-        let stash_path = dirs::home_dir()
-            .unwrap()
-            .join(".agstash")
-            .join("stashes")
-            .join(format!("stash-{}.md", project_name));
-            
-        // The stash directory might still be created even if no file is stashed
-        // So we check if the specific stash file exists
-        assert!(!stash_path.exists());
+            let applied_mode = fs::metadata("AGENTS.md").unwrap().permissions().mode();
+            assert_eq!(applied_mode & 0o7777, mode);
+        }
+    }
+
+    #[test]
+    fn test_list_tree() {
+        let temp_dir = TempDir::new().unwrap();
+        let root = temp_dir.path().join(".agstash");
+        fs::create_dir_all(root.join("stashes")).unwrap();
+        fs::create_dir_all(root.join("snapshots")).unwrap();
+        fs::write(root.join("stashes").join("stash-a.md"), "# AGENTS\n").unwrap();
+        fs::write(root.join("stashes").join("stash-b.md"), "# AGENTS\n\nb\n").unwrap();
+
+        let entries = commands::list_tree(&root).unwrap();
+        let paths: Vec<PathBuf> = entries.iter().map(|(path, _)| path.clone()).collect();
+        assert_eq!(paths, vec![
+            root.clone(),
+            root.join("snapshots"),
+            root.join("stashes"),
+            root.join("stashes").join("stash-a.md"),
+            root.join("stashes").join("stash-b.md"),
+        ]);
+        assert_eq!(entries.iter().map(|(_, size)| size).sum::<u64>(), 21);
     }
 
     #[test]
@@ -469,15 +6423,22 @@ mod tests {
         // Verify the directory exists
         assert!(agstash_dir.exists());
 
+        // A dry run lists the directory and its contents but removes nothing
+        let entries = commands::list_tree(&agstash_dir).unwrap();
+        assert_eq!(entries, vec![(agstash_dir.clone(), 0), (test_file.clone(), 4)]);
+        let result = commands::handle_uninstall(true);
+        assert!(result.is_ok());
+        assert!(test_file.exists());
+
         // Run uninstall command
-        let result = commands::handle_uninstall();
+        let result = commands::handle_uninstall(false);
         assert!(result.is_ok());
 
         // Check if .agstash directory was removed
         assert!(!agstash_dir.exists());
 
         // Try to uninstall again - should not error
-        let result = commands::handle_uninstall();
+        let result = commands::handle_uninstall(false);
         assert!(result.is_ok());
     }
 }
\ No newline at end of file
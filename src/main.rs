@@ -1,4 +1,7 @@
-use clap::Parser;
+use std::path::PathBuf;
+use std::time::Duration;
+
+use clap::{ArgGroup, Parser};
 
 mod commands;
 mod utils;
@@ -9,6 +12,27 @@ mod utils;
 struct Args {
     #[arg(short, long, help = "Enable verbose output")]
     verbose: bool,
+
+    #[arg(long, default_value = "30s", value_parser = utils::parse_duration, help = "Maximum time external commands (e.g. clipboard utilities) and downloads may take, such as 500ms, 30s or 5m; 0 disables the timeout")]
+    timeout: Duration,
+
+    #[arg(long, help = "Print how long each filesystem operation takes to stderr")]
+    trace: bool,
+
+    #[arg(long, help = "Refuse to modify files outside a git repository")]
+    safe: bool,
+
+    #[arg(long = "root-marker", value_name = "NAME", help = "Treat directories containing NAME as project roots instead of the defaults (.git, .gitignore); repeatable")]
+    root_markers: Vec<String>,
+
+    #[arg(long = "add-root-marker", value_name = "NAME", help = "Treat directories containing NAME as project roots in addition to the other markers; repeatable")]
+    add_root_markers: Vec<String>,
+
+    #[arg(long, value_name = "PREFIX", help = "Warn about list items in AGENTS.md that do not start with PREFIX, such as \"- \"")]
+    bullet_prefix: Option<String>,
+
+    #[arg(long, help = "Warn about list items in AGENTS.md that end with a period")]
+    no_trailing_period: bool,
     
     #[command(subcommand)]
     command: Option<Commands>,
@@ -16,44 +40,352 @@ struct Args {
 
 #[derive(clap::Subcommand)]
 enum Commands {
-    /// Initialize a new empty AGENTS.md template in the current directory
+    /// Initialize a starter AGENTS.md template in the current directory
     Init {
         #[arg(short = 'f', long, help = "Overwrite existing AGENTS.md file without prompting for confirmation")]
         force: bool,
+        #[arg(long, value_name = "OCTAL", value_parser = utils::parse_file_mode, help = "Set the created file's permissions, e.g. 0644")]
+        chmod: Option<u32>,
+        #[arg(long, value_name = "PATH", help = "Append the content of PATH after the '# AGENTS' header, or after the --interactive answers")]
+        append: Option<PathBuf>,
+        #[arg(long, help = "Ask a few questions about the project and build AGENTS.md from the answers")]
+        interactive: bool,
+        #[arg(long, help = "Write the template even if the appended or interactive content holds nothing but the '# AGENTS' header")]
+        allow_empty: bool,
     },
     /// Remove the AGENTS.md file from the current directory
-    Clean,
+    #[command(group = ArgGroup::new("stash_check").args(["stash_first", "only_if_stashed"]))]
+    Clean {
+        #[arg(long, help = "Stash AGENTS.md first and only remove it if the stash succeeds")]
+        stash_first: bool,
+        #[arg(long, value_name = "NAME", requires = "stash_check", help = "Stash under NAME, or with --only-if-stashed check NAME's stash, instead of the project's")]
+        name: Option<String>,
+        #[arg(long, conflicts_with = "stash_first", help = "Only remove AGENTS.md if the project's stash has the same content")]
+        only_if_stashed: bool,
+    },
     /// Stash the AGENTS.md file to a global location for later retrieval
-    Stash,
+    Stash(Box<StashArgs>),
     /// Apply a previously stashed AGENTS.md file to the current directory
-    Apply {
-        #[arg(short = 'f', long, help = "Overwrite existing AGENTS.md file without prompting for confirmation")]
+    Apply(Box<ApplyArgs>),
+    /// Find identical stashes and optionally deduplicate them
+    Gc {
+        #[arg(long, help = "Replace duplicate stashes with hard links to a single shared copy")]
+        dedupe: bool,
+        #[arg(long, help = "Remove linked stashes whose AGENTS.md no longer exists")]
+        prune_dangling: bool,
+    },
+    /// Rename every stash whose project name matches a regular expression
+    RenameAll {
+        #[arg(long = "match", value_name = "REGEX", help = "Regular expression matched against stash project names")]
+        pattern: String,
+        #[arg(long = "replace", value_name = "TEMPLATE", help = "Replacement for the matched text; may reference capture groups such as $1")]
+        replacement: String,
+        #[arg(long, help = "Show the renames without performing them")]
+        dry_run: bool,
+        #[arg(long, help = "Rename read-only stashes too")]
         force: bool,
     },
+    /// Rename stashes whose file names predate the current naming scheme
+    RepairNames {
+        #[arg(long, help = "Show the renames without performing them")]
+        dry_run: bool,
+    },
+    /// Check an AGENTS.md file and report every problem found
+    Validate {
+        #[arg(value_name = "PATH", help = "File to check; reads standard input when omitted or -")]
+        path: Option<PathBuf>,
+    },
+    /// Capture AGENTS.md, other agent files and the current git commit as a restorable snapshot
+    Snapshot {
+        #[arg(long, help = "Name the snapshot instead of deriving an id from the project and time")]
+        name: Option<String>,
+        #[arg(long, value_name = "PATH", help = "Also capture PATH, relative to the project root; repeatable")]
+        include: Vec<PathBuf>,
+    },
+    /// Print where agstash stores its data
+    Whereis {
+        #[arg(long, help = "Print the locations as JSON")]
+        json: bool,
+    },
     /// Remove the global .agstash directory and all stashed files
-    Uninstall,
+    Uninstall {
+        #[arg(long, help = "List everything that would be removed, with the total size, without removing it")]
+        dry_run: bool,
+    },
+}
+
+// StashArgs holds the stash command's flags
+#[derive(clap::Args)]
+struct StashArgs {
+    #[arg(long, help = "Remove HTML comments (<!-- ... -->) from the stashed copy, leaving the local file untouched")]
+    strip_comments: bool,
+    #[arg(long, help = "Stash the content of the system clipboard instead of the local AGENTS.md")]
+    from_clipboard: bool,
+    #[arg(long, value_name = "DIR", help = "Stash DIR/AGENTS.md without project root detection, naming the stash after DIR")]
+    force_dir: Option<PathBuf>,
+    #[arg(long, conflicts_with = "from_clipboard", help = "Keep running and re-stash AGENTS.md each time it changes")]
+    watch: bool,
+    #[arg(long, value_name = "REF", conflicts_with_all = ["from_clipboard", "watch"], help = "Only stash if AGENTS.md changed since the git ref REF")]
+    since_commit: Option<String>,
+    #[arg(long = "exclude-section", value_name = "TITLE", help = "Leave the section with heading TITLE out of the stashed copy; repeatable")]
+    exclude_sections: Vec<String>,
+    #[arg(long, help = "Store the stash read-only so later stashes refuse to overwrite it")]
+    read_only: bool,
+    #[arg(long, help = "Overwrite the stash even if it is read-only")]
+    force: bool,
+    #[arg(long, conflicts_with = "watch", help = "Stash invalid content anyway, with a warning and a non-zero exit")]
+    quiet_validate: bool,
+    #[arg(long, visible_alias = "fail-on-warning", help = "Refuse to stash AGENTS.md if validation reports any warnings, including bullet style")]
+    lint: bool,
+    #[arg(long, conflicts_with = "read_only", help = "Link to another project's identical stash instead of storing a second copy")]
+    dedupe_global: bool,
+    #[arg(long, help = "Name the stash after the git remote.origin.url (owner/repo) instead of the project directory")]
+    project_from_gitconfig: bool,
+    #[arg(long = "link", visible_alias = "link-instead-of-copy", conflicts_with_all = ["strip_comments", "from_clipboard", "watch", "exclude_sections", "read_only", "quiet_validate", "dedupe_global"], help = "Store the stash as a symbolic link to AGENTS.md so it tracks the live file")]
+    link: bool,
+    #[arg(long, conflicts_with_all = ["quiet_validate", "link"], help = "Re-read the written stash and fail unless it matches and still validates")]
+    verify: bool,
+    #[arg(long, conflicts_with = "link", help = "Require '# AGENTS' to be the very first line, with nothing before it")]
+    strict_header: bool,
+    #[arg(long, conflicts_with = "link", help = "Trim blank lines and whitespace before the '# AGENTS' header")]
+    normalize_header: bool,
+    #[arg(long, conflicts_with_all = ["watch", "quiet_validate"], help = "For editor save hooks: stash silently if valid and changed, otherwise skip; never prompts or fails. Logs only with --verbose")]
+    auto: bool,
+}
+
+impl From<&StashArgs> for commands::StashOptions {
+    fn from(args: &StashArgs) -> Self {
+        commands::StashOptions {
+            strip_comments: args.strip_comments,
+            from_clipboard: args.from_clipboard,
+            force_dir: args.force_dir.clone(),
+            watch: args.watch,
+            since_commit: args.since_commit.clone(),
+            exclude_sections: args.exclude_sections.clone(),
+            read_only: args.read_only,
+            force: args.force,
+            quiet_validate: args.quiet_validate,
+            lint: args.lint,
+            dedupe_global: args.dedupe_global,
+            project_from_gitconfig: args.project_from_gitconfig,
+            link: args.link,
+            verify: args.verify,
+            strict_header: args.strict_header,
+            normalize_header: args.normalize_header,
+            auto: args.auto,
+            verbose: false,
+        }
+    }
+}
+
+// ApplyArgs holds the apply command's flags
+#[derive(clap::Args)]
+struct ApplyArgs {
+    #[arg(short = 'f', long, help = "Overwrite existing AGENTS.md file without prompting for confirmation")]
+    force: bool,
+    #[arg(long, help = "Copy the stashed AGENTS.md to the system clipboard instead of writing a file")]
+    to_clipboard: bool,
+    #[arg(long, help = "Print the diff between the existing AGENTS.md and the stash to stderr before overwriting it")]
+    print_diff_on_overwrite: bool,
+    #[arg(long, value_name = "DIR", help = "Apply into DIR without project root detection, using the stash named after DIR")]
+    force_dir: Option<PathBuf>,
+    #[arg(long, requires = "force_dir", help = "Create the --force-dir directory if it does not exist")]
+    create_dirs: bool,
+    #[arg(long, value_name = "FILE", help = "Append a JSON line describing the operation to FILE")]
+    report: Option<PathBuf>,
+    #[arg(long, value_name = "OCTAL", value_parser = utils::parse_file_mode, help = "Set the applied file's permissions, e.g. 0444")]
+    chmod: Option<u32>,
+    #[arg(long, help = "Validate the stash and report all issues without applying it")]
+    validate_only: bool,
+    #[arg(long, requires = "validate_only", help = "Validate this file instead of the project's stash")]
+    file: Option<PathBuf>,
+    #[arg(long, help = "Fail instead of prompting when AGENTS.md exists and --force is not set")]
+    no_prompt: bool,
+    #[arg(long, value_name = "TITLE", help = "Keep the section with heading TITLE from the existing AGENTS.md when overwriting it; repeatable")]
+    preserve_local_sections: Vec<String>,
+    #[arg(long, value_name = "HEX", help = "Abort unless the stash's SHA-256 checksum matches HEX")]
+    expect_sha256: Option<String>,
+    #[arg(long, value_name = "PATH", conflicts_with = "expect_sha256", help = "Abort unless the stash's SHA-256 checksum matches the one in PATH (sha256sum format)")]
+    checksum_file: Option<PathBuf>,
+    #[arg(long, value_name = "URL", conflicts_with_all = ["to_clipboard", "expect_sha256", "checksum_file"], help = "Apply AGENTS.md downloaded from URL instead of the stash")]
+    from_url: Option<String>,
+    #[arg(long, requires = "from_url", help = "Also save the downloaded AGENTS.md as the project's stash")]
+    stash_download: bool,
+    #[arg(long, help = "Fail if the stash changes while the apply is in progress")]
+    lockstep: bool,
+    #[arg(long, help = "Re-read the written AGENTS.md and fail unless it matches the stash and still validates")]
+    verify_after: bool,
+    #[arg(long, help = "Print the applied file's SHA-256 in sha256sum format")]
+    report_checksum: bool,
+    #[arg(long = "ensure-executable-hooks", help = "After applying, run the repository's .git/hooks/post-agents if it is executable")]
+    run_hooks: bool,
+    #[arg(long, value_name = "PATH", num_args = 0..=1, help = "Hold an advisory lock on PATH (default ~/.agstash/apply.lock) while applying, failing if it cannot be acquired")]
+    lock_file: Option<Option<PathBuf>>,
+    #[arg(long, visible_alias = "retry-on-lock", default_value = "10s", value_parser = utils::parse_duration, requires = "lock_file", help = "How long to keep retrying, with backoff, while --lock-file is held, such as 500ms or 30s; 0 tries once")]
+    lock_timeout: Duration,
+    #[arg(long, conflicts_with_all = ["to_clipboard", "report", "validate_only", "from_url"], help = "Show what would be applied, with a diff, without changing any files")]
+    dry_run: bool,
+    #[arg(long, requires = "dry_run", help = "Print the dry-run plan as JSON")]
+    json: bool,
+    #[arg(long, help = "Refuse to apply if the local AGENTS.md exists and is already valid")]
+    only_if_valid_local: bool,
+    #[arg(long, requires = "dry_run", help = "Print a one-line summary and exit non-zero if the apply would change AGENTS.md")]
+    exit_code: bool,
+    #[arg(long, help = "Abort if the stash content has validation warnings")]
+    fail_on_warning: bool,
+    #[arg(long, value_name = "ID", conflicts_with_all = ["to_clipboard", "from_url", "dry_run", "validate_only"], help = "Restore the files captured by the snapshot ID instead of applying the stash")]
+    snapshot: Option<String>,
+    #[arg(long, help = "Append a comment to AGENTS.md naming the stash, its SHA-256 and the time of the apply")]
+    record_origin: bool,
+    #[arg(long, conflicts_with_all = ["create_dirs", "to_clipboard"], help = "Only update an existing AGENTS.md; fail instead of creating it or its directory")]
+    no_create: bool,
+    #[arg(long, value_name = "NAME", help = "Abort unless the resolved project is named NAME")]
+    expect_project: Option<String>,
+    #[arg(long, value_name = "STYLE", value_parser = utils::parse_line_endings, help = "Write AGENTS.md with lf or crlf line endings instead of the stash's own")]
+    normalize_line_endings: Option<utils::LineEndings>,
+    #[arg(long, help = "Append a comment to AGENTS.md naming the agstash version that applied it")]
+    stamp_version: bool,
+    #[arg(long, help = "Find the stash by the git remote.origin.url (owner/repo) instead of the project directory")]
+    project_from_gitconfig: bool,
+    #[arg(long, conflicts_with_all = ["to_clipboard", "from_url", "snapshot", "dry_run", "validate_only"], help = "Give the applied AGENTS.md the stash file's modification time")]
+    keep_mtime: bool,
+    #[arg(long, conflicts_with_all = ["json", "to_clipboard", "from_url", "snapshot", "validate_only"], help = "Print the diff the apply introduces as a JSON array of hunks; with --dry-run nothing is written")]
+    report_diff_json: bool,
+    #[arg(long, value_name = "WIDTH", value_parser = utils::parse_reflow_width, conflicts_with_all = ["to_clipboard", "validate_only"], help = "Wrap paragraph text to WIDTH columns, leaving headings, lists and code blocks as they are")]
+    reflow: Option<usize>,
+    #[arg(long, value_name = "PROJECTS", value_delimiter = ',', conflicts_with_all = ["to_clipboard", "from_url", "snapshot", "dry_run", "validate_only", "keep_mtime", "report_diff_json", "expect_sha256", "checksum_file", "lockstep"], help = "Compose AGENTS.md from a comma-separated list of stashes, each overriding or extending the sections of those before it")]
+    chain: Vec<String>,
+    #[arg(long, conflicts_with_all = ["dry_run", "to_clipboard", "validate_only"], help = "Print one plain status line, e.g. 'agstash: applied AGENTS.md for app (overwrote, 1.4 KB)'")]
+    summary: bool,
+    #[arg(long, conflicts_with_all = ["validate_only", "dry_run", "to_clipboard", "from_url", "snapshot", "chain"], help = "List the {{NAME}} placeholders in the stash, with counts, without applying it")]
+    placeholder_report: bool,
+    #[arg(long, conflicts_with = "to_clipboard", help = "Require '# AGENTS' to be the very first line, with nothing before it")]
+    strict_header: bool,
+    #[arg(long, conflicts_with = "to_clipboard", help = "Trim blank lines and whitespace before the '# AGENTS' header")]
+    normalize_header: bool,
+}
+
+impl TryFrom<&ApplyArgs> for commands::ApplyOptions {
+    type Error = Box<dyn std::error::Error>;
+
+    fn try_from(args: &ApplyArgs) -> Result<Self, Self::Error> {
+        Ok(commands::ApplyOptions {
+            force: args.force,
+            to_clipboard: args.to_clipboard,
+            print_diff_on_overwrite: args.print_diff_on_overwrite,
+            force_dir: args.force_dir.clone(),
+            create_dirs: args.create_dirs,
+            report: args.report.clone(),
+            chmod: args.chmod,
+            no_prompt: args.no_prompt,
+            preserve_local_sections: args.preserve_local_sections.clone(),
+            expect_sha256: args.expect_sha256.clone(),
+            checksum_file: args.checksum_file.clone(),
+            from_url: args.from_url.clone(),
+            stash_download: args.stash_download,
+            lockstep: args.lockstep,
+            verify_after: args.verify_after,
+            report_checksum: args.report_checksum,
+            run_hooks: args.run_hooks,
+            lock_file: match &args.lock_file {
+                Some(None) => Some(utils::get_lock_path()?),
+                lock_file => lock_file.clone().flatten(),
+            },
+            lock_timeout: args.lock_timeout,
+            dry_run: args.dry_run,
+            json: args.json,
+            only_if_valid_local: args.only_if_valid_local,
+            exit_code: args.exit_code,
+            fail_on_warning: args.fail_on_warning,
+            snapshot: args.snapshot.clone(),
+            record_origin: args.record_origin,
+            no_create: args.no_create,
+            expect_project: args.expect_project.clone(),
+            normalize_line_endings: args.normalize_line_endings,
+            stamp_version: args.stamp_version,
+            project_from_gitconfig: args.project_from_gitconfig,
+            keep_mtime: args.keep_mtime,
+            report_diff_json: args.report_diff_json,
+            reflow: args.reflow,
+            chain: args.chain.clone(),
+            summary: args.summary,
+            strict_header: args.strict_header,
+            normalize_header: args.normalize_header,
+        })
+    }
 }
 
 fn main() -> Result<(), Box<dyn std::error::Error>> {
     let args = Args::parse();
     
     utils::setup_logging(args.verbose);
+    utils::set_subprocess_timeout(args.timeout);
+    utils::set_root_markers(root_markers(&args));
+    utils::set_safe_mode(args.safe);
+    if args.bullet_prefix.is_some() || args.no_trailing_period {
+        utils::set_bullet_style(Some(utils::BulletStyle {
+            prefix: args.bullet_prefix.clone(),
+            no_trailing_period: args.no_trailing_period,
+        }));
+    }
+    if args.trace {
+        utils::set_trace_output(Some(Box::new(std::io::stderr())));
+    }
     
     match &args.command {
-        Some(Commands::Init { force }) => {
-            commands::handle_init(*force)?;
+        Some(Commands::Init { force, chmod, append, interactive, allow_empty }) => {
+            commands::handle_init(&commands::InitOptions {
+                force: *force,
+                chmod: *chmod,
+                append: append.clone(),
+                interactive: *interactive,
+                allow_empty: *allow_empty,
+            })?;
+        }
+        Some(Commands::Clean { stash_first, name, only_if_stashed }) => {
+            commands::handle_clean(&commands::CleanOptions {
+                stash_first: *stash_first,
+                name: name.clone(),
+                only_if_stashed: *only_if_stashed,
+            })?;
+        }
+        Some(Commands::Stash(stash_args)) => {
+            let options = commands::StashOptions { verbose: args.verbose, ..commands::StashOptions::from(stash_args.as_ref()) };
+            commands::handle_stash(&options)?;
+        }
+        Some(Commands::Apply(apply_args)) => {
+            let options = commands::ApplyOptions::try_from(apply_args.as_ref())?;
+            if apply_args.validate_only {
+                commands::handle_validate_only(apply_args.file.as_deref(), &options)?;
+            } else if apply_args.placeholder_report {
+                commands::handle_placeholder_report(&options)?;
+            } else {
+                commands::handle_apply(&options)?;
+            }
+        }
+        Some(Commands::Gc { dedupe, prune_dangling }) => {
+            commands::handle_gc(*dedupe, *prune_dangling)?;
         }
-        Some(Commands::Clean) => {
-            commands::handle_clean()?;
+        Some(Commands::RenameAll { pattern, replacement, dry_run, force }) => {
+            commands::handle_rename_all(pattern, replacement, *dry_run, *force)?;
         }
-        Some(Commands::Stash) => {
-            commands::handle_stash()?;
+        Some(Commands::RepairNames { dry_run }) => {
+            commands::handle_repair_names(*dry_run)?;
         }
-        Some(Commands::Apply { force }) => {
-            commands::handle_apply(*force)?;
+        Some(Commands::Validate { path }) => {
+            commands::handle_validate(path.as_deref())?;
         }
-        Some(Commands::Uninstall) => {
-            commands::handle_uninstall()?;
+        Some(Commands::Snapshot { name, include }) => {
+            commands::handle_snapshot(&commands::SnapshotOptions {
+                name: name.clone(),
+                include: include.clone(),
+            })?;
+        }
+        Some(Commands::Whereis { json }) => {
+            commands::handle_whereis(*json)?;
+        }
+        Some(Commands::Uninstall { dry_run }) => {
+            commands::handle_uninstall(*dry_run)?;
         }
         None => {
             // Print usage when no command is provided
@@ -64,17 +396,34 @@ fn main() -> Result<(), Box<dyn std::error::Error>> {
     Ok(())
 }
 
+// root_markers combines --root-marker (or the default markers) with any --add-root-marker values
+fn root_markers(args: &Args) -> Vec<String> {
+    let mut markers = if args.root_markers.is_empty() {
+        utils::DEFAULT_ROOT_MARKERS.iter().map(|marker| marker.to_string()).collect()
+    } else {
+        args.root_markers.clone()
+    };
+    markers.extend(args.add_root_markers.iter().cloned());
+    markers
+}
+
 fn print_usage() {
     let usage = r#"
 Usage: agstash <command> [options]
 
 Available Commands:
-  init        Initialize a new empty AGENTS.md template in the current directory
-  clean       Remove the AGENTS.md file from the current directory
-  stash       Stash the AGENTS.md file to a global location for later retrieval
-  apply       Apply a previously stashed AGENTS.md file to the current directory
-  uninstall   Remove the global .agstash directory and all stashed files
-  help        Show this help message
+  init          Initialize a starter AGENTS.md template in the current directory
+  clean         Remove the AGENTS.md file from the current directory
+  stash         Stash the AGENTS.md file to a global location for later retrieval
+  apply         Apply a previously stashed AGENTS.md file to the current directory
+  gc            Find identical stashes and optionally deduplicate them
+  rename-all    Rename every stash whose project name matches a regular expression
+  repair-names  Rename stashes whose file names predate the current naming scheme
+  validate      Check an AGENTS.md file and report every problem found
+  snapshot      Capture agent files and the current git commit as a restorable snapshot
+  whereis       Print where agstash stores its data
+  uninstall     Remove the global .agstash directory and all stashed files
+  help          Show this help message
 "#;
     println!("{}", usage);
 }
\ No newline at end of file
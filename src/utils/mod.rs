@@ -1,6 +1,15 @@
+use std::collections::BTreeMap;
 use std::env;
 use std::fs;
+use std::io::{self, Read, Write};
 use std::path::{Path, PathBuf};
+use std::process::{Child, Command, ExitStatus, Stdio};
+use std::sync::atomic::{AtomicBool, AtomicU64, Ordering};
+use std::sync::{Mutex, RwLock};
+use std::thread;
+use std::time::{Duration, Instant, SystemTime, UNIX_EPOCH};
+
+use sha2::{Digest, Sha256};
 
 // SetupLogging configures the logging based on the verbose flag
 pub fn setup_logging(verbose: bool) {
@@ -11,14 +20,82 @@ pub fn setup_logging(verbose: bool) {
     }
 }
 
+// Where log lines go instead of stderr, when redirected
+static LOG_OUTPUT: Mutex<Option<Box<dyn Write + Send>>> = Mutex::new(None);
+
+// SetLogOutput sends log lines to output, or back to stderr when output is None, and returns where
+// they went before so the caller can restore it
+pub fn set_log_output(output: Option<Box<dyn Write + Send>>) -> Option<Box<dyn Write + Send>> {
+    std::mem::replace(&mut *LOG_OUTPUT.lock().unwrap_or_else(|e| e.into_inner()), output)
+}
+
+// log writes one log line with its level to the log output
+fn log(level: &str, message: &str) {
+    let mut output = LOG_OUTPUT.lock().unwrap_or_else(|e| e.into_inner());
+    match output.as_mut() {
+        Some(output) => {
+            let _ = writeln!(output, "{}: {}", level, message);
+        }
+        None => eprintln!("{}: {}", level, message),
+    }
+}
+
 // LogInfo logs an info message
 pub fn log_info(message: &str) {
-    eprintln!("INFO: {}", message);
+    log("INFO", message);
 }
 
 // LogWarn logs a warning message
 pub fn log_warn(message: &str) {
-    eprintln!("WARN: {}", message);
+    log("WARN", message);
+}
+
+// Where trace lines go when tracing is on
+static TRACE_OUTPUT: Mutex<Option<Box<dyn Write + Send>>> = Mutex::new(None);
+
+// SetTraceOutput turns on tracing of filesystem operations, writing one line per operation with its
+// duration to output, or turns it off when output is None
+pub fn set_trace_output(output: Option<Box<dyn Write + Send>>) {
+    *TRACE_OUTPUT.lock().unwrap_or_else(|e| e.into_inner()) = output;
+}
+
+// traced runs operation on target and, when tracing is on, records how long it took
+fn traced<T>(operation: &str, target: &dyn std::fmt::Display, run: impl FnOnce() -> T) -> T {
+    let started = Instant::now();
+    let result = run();
+
+    let mut output = TRACE_OUTPUT.lock().unwrap_or_else(|e| e.into_inner());
+    if let Some(output) = output.as_mut() {
+        let _ = writeln!(output, "TRACE: {} {} took {:?}", operation, target, started.elapsed());
+    }
+    result
+}
+
+// Content at or above this size is considered too large to process safely
+const MAX_CONTENT_SIZE: usize = 10_000_000;
+
+// Severity of a validation issue; errors make content unusable, warnings are advisory
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Severity {
+    Warning,
+    Error,
+}
+
+// ValidationIssue describes a single problem found by ValidateAgents
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct ValidationIssue {
+    pub severity: Severity,
+    pub message: String,
+}
+
+impl ValidationIssue {
+    fn error(message: &str) -> Self {
+        ValidationIssue { severity: Severity::Error, message: message.to_string() }
+    }
+
+    fn warning(message: &str) -> Self {
+        ValidationIssue { severity: Severity::Warning, message: message.to_string() }
+    }
 }
 
 // IsValidAgents validates that the content starts with "# AGENTS"
@@ -29,245 +106,2579 @@ pub fn is_valid_agents(content: &str) -> bool {
     }
 
     // Check if content is too large to process safely
-    if content.len() >= 10_000_000 {
+    if content.len() >= MAX_CONTENT_SIZE {
         panic!("Content too large to process safely");
     }
 
     basic_validation(content)
 }
 
+// IsHeaderOnly reports whether content has nothing but "# AGENTS" headers and blank lines
+pub fn is_header_only(content: &str) -> bool {
+    content
+        .lines()
+        .map(str::trim)
+        .filter(|line| !line.is_empty())
+        .all(|line| line == "# AGENTS")
+}
+
+// HasStrictHeader reports whether content starts with the "# AGENTS" header on its very first line,
+// with nothing before it
+pub fn has_strict_header(content: &str) -> bool {
+    content.starts_with("# AGENTS")
+}
+
+// NormalizeHeader trims the blank lines and whitespace before the "# AGENTS" header so that it becomes
+// the first line. Content without the header is returned as it is.
+pub fn normalize_header(content: &str) -> String {
+    if !basic_validation(content) {
+        return content.to_string();
+    }
+    content.trim_start_matches([' ', '\t', '\n', '\r']).to_string()
+}
+
 fn basic_validation(content: &str) -> bool {
     let trimmed_start = content.trim_start_matches(|c: char| c == ' ' || c == '\t' || c == '\n' || c == '\r');
     trimmed_start.starts_with("# AGENTS")
 }
 
-// GetProjectRoot finds the project root by looking for .git or .gitignore
-pub fn get_project_root() -> Result<PathBuf, Box<dyn std::error::Error>> {
-    let mut current_path = env::current_dir()?;
+// ValidateAgents runs the full set of checks over the content and returns every issue found,
+// in the order they were detected. An empty list means the content is valid with no warnings.
+pub fn validate_agents(content: &str) -> Vec<ValidationIssue> {
+    if content.trim().is_empty() {
+        return vec![ValidationIssue::error("Content is empty")];
+    }
 
-    loop {
-        // Check if .git directory or .gitignore file exists
-        let git_dir = current_path.join(".git");
-        let git_ignore_file = current_path.join(".gitignore");
+    // Reject oversized content up front rather than panicking like IsValidAgents
+    if content.len() >= MAX_CONTENT_SIZE {
+        return vec![ValidationIssue::error("Content too large to process safely")];
+    }
 
-        if git_dir.is_dir() || git_ignore_file.is_file() {
-            return Ok(current_path);
-        }
+    if !basic_validation(content) {
+        return vec![ValidationIssue::error("Missing '# AGENTS' header")];
+    }
 
-        // Move up to parent directory
-        match current_path.parent() {
-            Some(parent) => {
-                current_path = parent.to_path_buf();
-            }
-            None => {
-                // We've reached the root directory
-                break;
+    let mut issues = Vec::new();
+
+    if !content.starts_with("# AGENTS") {
+        issues.push(ValidationIssue::warning("'# AGENTS' header is not on the first line"));
+    }
+
+    // Skip the rest of the header line and look for any non-blank line after it
+    let has_body = content
+        .trim_start()
+        .strip_prefix("# AGENTS")
+        .unwrap_or_default()
+        .lines()
+        .skip(1)
+        .any(|line| !line.trim().is_empty());
+    if !has_body {
+        issues.push(ValidationIssue::warning("No content after the '# AGENTS' header"));
+    }
+
+    if let Some(style) = BULLET_STYLE.read().unwrap_or_else(|e| e.into_inner()).as_ref() {
+        issues.extend(lint_bullets(content, style));
+    }
+
+    issues
+}
+
+// BulletStyle is the convention list items must follow when bullet linting is enabled
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct BulletStyle {
+    // Marker every list item must start with, such as "- "
+    pub prefix: Option<String>,
+    // Flag list items that end with a period
+    pub no_trailing_period: bool,
+}
+
+// Bullet style set for this run; None leaves bullets unchecked
+static BULLET_STYLE: RwLock<Option<BulletStyle>> = RwLock::new(None);
+
+// SetBulletStyle makes ValidateAgents check list items against style, or stop checking them with None
+pub fn set_bullet_style(style: Option<BulletStyle>) {
+    *BULLET_STYLE.write().unwrap_or_else(|e| e.into_inner()) = style;
+}
+
+// fence_marker returns the character and length of the run of ``` or ~~~ a fence line starts with
+fn fence_marker(line: &str) -> Option<(char, usize)> {
+    let trimmed = line.trim_start();
+    let marker = trimmed.chars().next().filter(|c| *c == '`' || *c == '~')?;
+    let length = trimmed.chars().take_while(|c| *c == marker).count();
+    if length >= 3 {
+        Some((marker, length))
+    } else {
+        None
+    }
+}
+
+// track_fence updates the open fence for line and reports whether line opened or closed one. As in
+// CommonMark, only a run of the opening character at least as long, with nothing after it, closes
+// the fence, so a ~~~ block inside a ``` block (or a shorter run) stays part of the code.
+fn track_fence(open: &mut Option<(char, usize)>, line: &str) -> bool {
+    let (marker, length) = match fence_marker(line) {
+        Some(fence) => fence,
+        None => return false,
+    };
+    match *open {
+        None => {
+            *open = Some((marker, length));
+            true
+        }
+        Some((open_marker, open_length)) => {
+            let closes = marker == open_marker
+                && length >= open_length
+                && line.trim_start()[length..].trim().is_empty();
+            if closes {
+                *open = None;
             }
+            closes
         }
     }
+}
+
+// LintBullets returns a warning for each list item outside code blocks that breaks the style
+pub fn lint_bullets(content: &str, style: &BulletStyle) -> Vec<ValidationIssue> {
+    let mut issues = Vec::new();
+    let mut fence = None;
+    for (index, line) in content.lines().enumerate() {
+        let item = line.trim();
+        if track_fence(&mut fence, item) {
+            continue;
+        }
+        if fence.is_some() || !is_list_item(item) {
+            continue;
+        }
 
-    Err("Project root not found".into())
+        if let Some(prefix) = &style.prefix {
+            if !line.trim_start().starts_with(prefix.as_str()) {
+                issues.push(ValidationIssue::warning(&format!(
+                    "Line {}: list item does not start with '{}'",
+                    index + 1,
+                    prefix
+                )));
+            }
+        }
+        if style.no_trailing_period && item.ends_with('.') {
+            issues.push(ValidationIssue::warning(&format!("Line {}: list item ends with a period", index + 1)));
+        }
+    }
+    issues
 }
 
-// GetStashPath returns the path where the project's AGENTS.md should be stashed
-pub fn get_stash_path(project_name: &str) -> Result<PathBuf, Box<dyn std::error::Error>> {
-    if project_name.is_empty() {
-        panic!("Project name should not be empty");
+// is_list_item reports whether a trimmed line is a Markdown bullet or numbered list item
+fn is_list_item(line: &str) -> bool {
+    if let Some(rest) = line.strip_prefix(['-', '*', '+']) {
+        return rest.is_empty() || rest.starts_with(' ');
     }
+    let digits = line.chars().take_while(|c| c.is_ascii_digit()).count();
+    digits > 0 && (line[digits..].starts_with(". ") || line[digits..].starts_with(") "))
+}
 
-    let home_dir = dirs::home_dir().ok_or("Could not find home directory")?;
-    let stash_dir = home_dir.join(".agstash").join("stashes");
+// ParseReflowWidth parses the column width --reflow wraps paragraphs to, a positive number
+pub fn parse_reflow_width(value: &str) -> Result<usize, String> {
+    match value.trim().parse::<usize>() {
+        Ok(width) if width > 0 => Ok(width),
+        _ => Err(format!("invalid width '{}' (expected a positive number of columns)", value)),
+    }
+}
 
-    // Create the stash directory if it doesn't exist
-    fs::create_dir_all(&stash_dir)?;
+// Reflow wraps paragraph text to at most width columns, joining each paragraph's lines before
+// wrapping. Headings, list items, block quotes, tables, HTML, indented lines, horizontal rules and
+// fenced code blocks are left as they are. A word longer than width gets a line of its own.
+pub fn reflow(content: &str, width: usize) -> String {
+    let mut reflowed = String::with_capacity(content.len());
+    let mut paragraph: Vec<&str> = Vec::new();
+    let mut fence = None;
+    for line in content.split_inclusive('\n') {
+        let text = line.trim_end_matches(['\r', '\n']);
+        let trimmed = text.trim();
+        if !track_fence(&mut fence, trimmed) && fence.is_none() && is_prose_line(text) {
+            paragraph.push(line);
+            continue;
+        }
 
-    let stash_path = stash_dir.join(format!("stash-{}.md", project_name));
-    Ok(stash_path)
+        wrap_paragraph(&paragraph, width, &mut reflowed);
+        paragraph.clear();
+        reflowed.push_str(line);
+    }
+    wrap_paragraph(&paragraph, width, &mut reflowed);
+    reflowed
 }
 
-// GetAgstashDir returns the path to the global .agstash directory
-pub fn get_agstash_dir() -> Result<PathBuf, Box<dyn std::error::Error>> {
-    let home_dir = dirs::home_dir().ok_or("Could not find home directory")?;
-    let agstash_dir = home_dir.join(".agstash");
-    Ok(agstash_dir)
+// is_prose_line reports whether a line (without its terminator) is paragraph text that may be rewrapped
+fn is_prose_line(line: &str) -> bool {
+    let trimmed = line.trim();
+    if trimmed.is_empty() || line.starts_with([' ', '\t']) {
+        return false;
+    }
+    if trimmed.starts_with(['#', '>', '|', '<']) || is_list_item(trimmed) {
+        return false;
+    }
+    // Horizontal rules and setext heading underlines
+    !trimmed.chars().all(|c| matches!(c, '-' | '=' | '*' | '_' | ' '))
 }
 
-// ReadFile reads the content of a file - returns (error, content)
-pub fn read_file<P: AsRef<Path>>(path: P) -> (Option<Box<dyn std::error::Error>>, String) {
-    match fs::read_to_string(path) {
-        Ok(content) => (None, content),
-        Err(e) => (Some(Box::new(e)), String::new()),
+// wrap_paragraph appends the words of the paragraph's lines to out, wrapped at width. Lines are
+// terminated like the paragraph's first line, except the last, which keeps the paragraph's final
+// terminator.
+fn wrap_paragraph(lines: &[&str], width: usize, out: &mut String) {
+    let (Some(first), Some(last)) = (lines.first(), lines.last()) else {
+        return;
+    };
+    let ending = if first.ends_with("\r\n") { "\r\n" } else { "\n" };
+    let final_ending = &last[last.trim_end_matches(['\r', '\n']).len()..];
+
+    let mut wrapped = Vec::new();
+    let mut current = String::new();
+    for word in lines.iter().flat_map(|line| line.split_whitespace()) {
+        if !current.is_empty() && current.chars().count() + 1 + word.chars().count() > width {
+            wrapped.push(std::mem::take(&mut current));
+        }
+        if !current.is_empty() {
+            current.push(' ');
+        }
+        current.push_str(word);
+    }
+    wrapped.push(current);
+
+    let count = wrapped.len();
+    for (index, line) in wrapped.iter().enumerate() {
+        out.push_str(line);
+        out.push_str(if index + 1 == count { final_ending } else { ending });
     }
 }
 
-// WriteFile writes content to a file - returns error
-pub fn write_file<P: AsRef<Path>>(path: P, content: &str) -> Option<Box<dyn std::error::Error>> {
-    match fs::write(path, content) {
-        Ok(_) => None,
-        Err(e) => Some(Box::new(e)),
+// FindPlaceholders counts each distinct {{NAME}} placeholder in content, keyed by the name with
+// surrounding whitespace trimmed
+pub fn find_placeholders(content: &str) -> BTreeMap<String, usize> {
+    let placeholder = regex::Regex::new(r"\{\{([^{}]+)\}\}").expect("placeholder pattern is valid");
+    let mut counts = BTreeMap::new();
+    for captures in placeholder.captures_iter(content) {
+        let name = captures[1].trim();
+        if !name.is_empty() {
+            *counts.entry(name.to_string()).or_insert(0) += 1;
+        }
     }
+    counts
 }
 
-// FileExists checks if a file exists
-pub fn file_exists<P: AsRef<Path>>(path: P) -> bool {
-    Path::new(path.as_ref()).exists()
+// DiffLine is a single line of a line-based diff
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum DiffLine {
+    Unchanged(String),
+    Added(String),
+    Removed(String),
 }
 
-// RemoveFile removes a file
-pub fn remove_file<P: AsRef<Path>>(path: P) -> Result<(), Box<dyn std::error::Error>> {
-    fs::remove_file(path)?;
-    Ok(())
+// Above this many line comparisons the diff falls back to replacing the differing block wholesale
+const MAX_DIFF_CELLS: usize = 4_000_000;
+
+// LineDiff computes a line-based diff that turns old into new, using the longest common subsequence
+// of lines so unchanged lines are kept in place
+pub fn line_diff(old: &str, new: &str) -> Vec<DiffLine> {
+    let old_lines: Vec<&str> = old.lines().collect();
+    let new_lines: Vec<&str> = new.lines().collect();
+
+    // Common leading and trailing lines need no comparison table
+    let prefix = old_lines
+        .iter()
+        .zip(&new_lines)
+        .take_while(|(a, b)| a == b)
+        .count();
+    let suffix = old_lines[prefix..]
+        .iter()
+        .rev()
+        .zip(new_lines[prefix..].iter().rev())
+        .take_while(|(a, b)| a == b)
+        .count();
+    let old_middle = &old_lines[prefix..old_lines.len() - suffix];
+    let new_middle = &new_lines[prefix..new_lines.len() - suffix];
+
+    let mut diff = Vec::with_capacity(old_lines.len().max(new_lines.len()));
+    diff.extend(old_lines[..prefix].iter().map(|line| DiffLine::Unchanged(line.to_string())));
+
+    let (n, m) = (old_middle.len(), new_middle.len());
+    if n.saturating_mul(m) > MAX_DIFF_CELLS {
+        diff.extend(old_middle.iter().map(|line| DiffLine::Removed(line.to_string())));
+        diff.extend(new_middle.iter().map(|line| DiffLine::Added(line.to_string())));
+    } else {
+        // lcs[i][j] holds the LCS length of old_middle[i..] and new_middle[j..]
+        let mut lcs = vec![vec![0usize; m + 1]; n + 1];
+        for i in (0..n).rev() {
+            for j in (0..m).rev() {
+                lcs[i][j] = if old_middle[i] == new_middle[j] {
+                    lcs[i + 1][j + 1] + 1
+                } else {
+                    lcs[i + 1][j].max(lcs[i][j + 1])
+                };
+            }
+        }
+
+        let (mut i, mut j) = (0, 0);
+        while i < n && j < m {
+            if old_middle[i] == new_middle[j] {
+                diff.push(DiffLine::Unchanged(old_middle[i].to_string()));
+                i += 1;
+                j += 1;
+            } else if lcs[i + 1][j] >= lcs[i][j + 1] {
+                diff.push(DiffLine::Removed(old_middle[i].to_string()));
+                i += 1;
+            } else {
+                diff.push(DiffLine::Added(new_middle[j].to_string()));
+                j += 1;
+            }
+        }
+        diff.extend(old_middle[i..].iter().map(|line| DiffLine::Removed(line.to_string())));
+        diff.extend(new_middle[j..].iter().map(|line| DiffLine::Added(line.to_string())));
+    }
+
+    diff.extend(
+        old_lines[old_lines.len() - suffix..]
+            .iter()
+            .map(|line| DiffLine::Unchanged(line.to_string())),
+    );
+    diff
 }
 
-// CopyFile copies a file from source to destination - returns error
-pub fn copy_file<S: AsRef<Path>, D: AsRef<Path>>(src: S, dst: D) -> Option<Box<dyn std::error::Error>> {
-    match fs::copy(src, dst) {
-        Ok(_) => None,
-        Err(e) => Some(Box::new(e)),
+// LineEndings describes which line terminators a piece of content uses
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum LineEndings {
+    // No line breaks at all, e.g. empty or single-line content
+    None,
+    Lf,
+    Crlf,
+    // Both LF and CRLF line breaks
+    Mixed,
+}
+
+impl LineEndings {
+    // as_str returns the name used for the line endings in messages and reports
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            LineEndings::None => "none",
+            LineEndings::Lf => "lf",
+            LineEndings::Crlf => "crlf",
+            LineEndings::Mixed => "mixed",
+        }
     }
 }
 
-#[cfg(test)]
-mod tests {
-    use std::fs;
-    use std::env;
-    use std::path::Path;
-    use tempfile::TempDir;
-    use serial_test::serial;
-    use crate::utils;
+// DetectLineEndings reports whether content uses LF or CRLF line breaks, or a mix of both
+pub fn detect_line_endings(content: &str) -> LineEndings {
+    let line_breaks = content.matches('\n').count();
+    let crlf_breaks = content.matches("\r\n").count();
 
-    #[test]
-    fn test_is_valid_agents() {
-        // Valid cases
-        assert!(utils::is_valid_agents("# AGENTS"));
-        assert!(utils::is_valid_agents("# AGENTS\n"));
-        assert!(utils::is_valid_agents("  # AGENTS")); // Leading spaces
-        assert!(utils::is_valid_agents("# AGENTS\n\n- content"));
+    match (line_breaks, crlf_breaks) {
+        (0, _) => LineEndings::None,
+        (total, crlf) if crlf == total => LineEndings::Crlf,
+        (_, 0) => LineEndings::Lf,
+        _ => LineEndings::Mixed,
+    }
+}
 
-        // Invalid cases
-        assert!(!utils::is_valid_agents(""));
-        assert!(!utils::is_valid_agents("# AGENT")); // Wrong header
-        assert!(!utils::is_valid_agents("- content")); // No header
-        assert!(!utils::is_valid_agents(" # AGENT")); // Space before #
-        assert!(!utils::is_valid_agents("AGENTS")); // Missing #
+// ParseLineEndings parses the line endings an apply should write, "lf" or "crlf"
+pub fn parse_line_endings(value: &str) -> Result<LineEndings, String> {
+    match value.to_ascii_lowercase().as_str() {
+        "lf" => Ok(LineEndings::Lf),
+        "crlf" => Ok(LineEndings::Crlf),
+        _ => Err(format!("invalid line endings '{}' (expected lf or crlf)", value)),
     }
+}
 
-    #[test]
-    #[serial]
-    fn test_get_stash_path() {
-        // Create a temporary directory to use as home
-        let temp_dir = TempDir::new().unwrap();
-        let original_home = env::var("HOME").unwrap_or_default();
-        env::set_var("HOME", temp_dir.path());
-        
-        // Ensure cleanup happens
-        let _cleanup_home = defer::defer(move || {
-            if !original_home.is_empty() {
-                env::set_var("HOME", original_home);
-            }
-        });
+// NormalizeLineEndings rewrites every line break in content as LF or CRLF. Other values of endings
+// leave the content as it is.
+pub fn normalize_line_endings(content: &str, endings: LineEndings) -> String {
+    match endings {
+        LineEndings::Lf => content.replace("\r\n", "\n"),
+        LineEndings::Crlf => content.replace("\r\n", "\n").replace('\n', "\r\n"),
+        LineEndings::None | LineEndings::Mixed => content.to_string(),
+    }
+}
 
-        // Test with a sample project name
-        let project_name = "test-project";
-        let stash_path_result = utils::get_stash_path(project_name);
+// DiffStats counts the lines a LineDiff adds, removes and keeps unchanged
+pub fn diff_stats(diff: &[DiffLine]) -> (usize, usize, usize) {
+    let (mut added, mut removed, mut unchanged) = (0, 0, 0);
+    for line in diff {
+        match line {
+            DiffLine::Added(_) => added += 1,
+            DiffLine::Removed(_) => removed += 1,
+            DiffLine::Unchanged(_) => unchanged += 1,
+        }
+    }
+    (added, removed, unchanged)
+}
 
-        assert!(stash_path_result.is_ok());
-        let stash_path = stash_path_result.unwrap();
+// DiffHunk is a run of changed lines from a line diff together with surrounding context. Line
+// numbers are 1-based; as in unified diffs, a side with no lines starts at the line before the hunk.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct DiffHunk {
+    pub old_start: usize,
+    pub old_lines: usize,
+    pub new_start: usize,
+    pub new_lines: usize,
+    pub lines: Vec<DiffLine>,
+}
 
-        let expected_path = temp_dir.path().join(".agstash").join("stashes").join("stash-test-project.md");
-        assert_eq!(stash_path, expected_path);
+// DiffHunks groups a line diff into hunks, keeping up to context unchanged lines around each change
+// and merging changes whose context would touch or overlap
+pub fn diff_hunks(diff: &[DiffLine], context: usize) -> Vec<DiffHunk> {
+    let changed: Vec<usize> = diff
+        .iter()
+        .enumerate()
+        .filter(|(_, line)| !matches!(line, DiffLine::Unchanged(_)))
+        .map(|(index, _)| index)
+        .collect();
 
-        // Check if the stash directory was created
-        let stash_dir = temp_dir.path().join(".agstash").join("stashes");
-        assert!(stash_dir.exists());
+    // Merge changes into [start, end) ranges of diff indices
+    let mut ranges: Vec<(usize, usize)> = Vec::new();
+    for &index in &changed {
+        let start = index.saturating_sub(context);
+        let end = (index + context + 1).min(diff.len());
+        match ranges.last_mut() {
+            Some(last) if start <= last.1 => last.1 = end,
+            _ => ranges.push((start, end)),
+        }
     }
 
-    #[test]
-    #[serial]
-    fn test_get_agstash_dir() {
-        // Create a temporary directory to use as home
-        let temp_dir = TempDir::new().unwrap();
-        let original_home = env::var("HOME").unwrap_or_default();
-        env::set_var("HOME", temp_dir.path());
-        
-        // Ensure cleanup happens
-        let _cleanup_home = defer::defer(move || {
-            if !original_home.is_empty() {
-                env::set_var("HOME", original_home);
+    ranges
+        .into_iter()
+        .map(|(start, end)| {
+            let counts = |lines: &[DiffLine]| {
+                let old = lines.iter().filter(|line| !matches!(line, DiffLine::Added(_))).count();
+                let new = lines.iter().filter(|line| !matches!(line, DiffLine::Removed(_))).count();
+                (old, new)
+            };
+            let (old_before, new_before) = counts(&diff[..start]);
+            let (old_lines, new_lines) = counts(&diff[start..end]);
+            DiffHunk {
+                old_start: if old_lines == 0 { old_before } else { old_before + 1 },
+                old_lines,
+                new_start: if new_lines == 0 { new_before } else { new_before + 1 },
+                new_lines,
+                lines: diff[start..end].to_vec(),
             }
-        });
+        })
+        .collect()
+}
 
-        let agstash_dir_result = utils::get_agstash_dir();
+// Section is one heading of an AGENTS.md file and the lines up to the next heading. Content before
+// the first heading forms a section with level 0 and an empty heading.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Section {
+    // Heading level, 1 for "#" through 6 for "######"
+    pub level: usize,
+    // Heading text without the leading #s and surrounding whitespace
+    pub title: String,
+    // The heading line exactly as written, including its line break
+    pub heading: String,
+    // Everything after the heading line up to the next heading
+    pub body: String,
+}
 
-        assert!(agstash_dir_result.is_ok());
-        let agstash_dir = agstash_dir_result.unwrap();
+// ParseAgentsSections splits content into its ATX-heading sections in order. Headings inside fenced
+// code blocks are treated as body text. RenderAgentsSections reassembles the exact original content.
+pub fn parse_agents_sections(content: &str) -> Vec<Section> {
+    let mut sections = Vec::new();
+    let mut current = Section {
+        level: 0,
+        title: String::new(),
+        heading: String::new(),
+        body: String::new(),
+    };
+    let mut fence = None;
 
-        let expected_path = temp_dir.path().join(".agstash");
-        assert_eq!(agstash_dir, expected_path);
+    for line in content.split_inclusive('\n') {
+        track_fence(&mut fence, line);
+        let heading = if fence.is_some() { None } else { parse_heading(line) };
+
+        match heading {
+            Some((level, title)) => {
+                let previous = std::mem::replace(
+                    &mut current,
+                    Section {
+                        level,
+                        title: title.to_string(),
+                        heading: line.to_string(),
+                        body: String::new(),
+                    },
+                );
+                // Only keep the leading level-0 section if there was anything before the first heading
+                if previous.level > 0 || !previous.body.is_empty() {
+                    sections.push(previous);
+                }
+            }
+            None => current.body.push_str(line),
+        }
     }
 
-    #[test]
-    fn test_file_exists() {
-        // Create a temporary file
-        let temp_dir = TempDir::new().unwrap();
-        let temp_file = temp_dir.path().join("test.txt");
-        fs::write(&temp_file, "test").unwrap();
+    if current.level > 0 || !current.body.is_empty() {
+        sections.push(current);
+    }
+    sections
+}
 
-        // Test existing file
-        assert!(utils::file_exists(&temp_file));
+// RenderAgentsSections joins sections back into AGENTS.md content
+pub fn render_agents_sections(sections: &[Section]) -> String {
+    let mut content = String::new();
+    for section in sections {
+        content.push_str(&section.heading);
+        content.push_str(&section.body);
+    }
+    content
+}
 
-        // Test non-existing file
-        let non_existing_file = temp_dir.path().join("non-existing.txt");
-        assert!(!utils::file_exists(&non_existing_file));
+// parse_heading returns the level and title of an ATX markdown heading line such as "## Notes"
+fn parse_heading(line: &str) -> Option<(usize, &str)> {
+    let line = line.trim_end();
+    let level = line.chars().take_while(|&c| c == '#').count();
+    let rest = &line[level..];
+    if !(1..=6).contains(&level) || !(rest.is_empty() || rest.starts_with([' ', '\t'])) {
+        return None;
     }
+    Some((level, rest.trim()))
+}
 
-    #[test]
-    fn test_read_file() {
-        // Create a temporary file
-        let temp_dir = TempDir::new().unwrap();
-        let temp_file = temp_dir.path().join("test.txt");
-        let content = "test content";
-        fs::write(&temp_file, content).unwrap();
+// Start of the comments apply --record-origin and --stamp-version append to AGENTS.md
+const PROVENANCE_PREFIX: &str = "<!-- agstash: applied ";
 
-        let (err, read_content) = utils::read_file(&temp_file);
-        assert!(err.is_none());
-        assert_eq!(read_content, content);
-    }
+// ProvenanceStamp returns the comment line apply --record-origin appends, naming the project's stash,
+// the SHA-256 of its content and the time of the apply
+pub fn provenance_stamp(project_name: &str, checksum: &str, time: SystemTime) -> String {
+    format!("{}from stash {} sha256:{} at {} -->", PROVENANCE_PREFIX, project_name, checksum, format_timestamp(time))
+}
 
-    #[test]
-    fn test_write_file() {
-        let temp_dir = TempDir::new().unwrap();
-        let temp_file = temp_dir.path().join("test.txt");
-        let content = "test content";
+// VersionStamp returns the comment line apply --stamp-version appends, naming this agstash version
+// and, when AGSTASH_BUILD_COMMIT was set at build time, the commit it was built from
+pub fn version_stamp() -> String {
+    let commit = option_env!("AGSTASH_BUILD_COMMIT")
+        .map(|commit| format!(" ({})", commit))
+        .unwrap_or_default();
+    format!("{}by agstash {}{} -->", PROVENANCE_PREFIX, env!("CARGO_PKG_VERSION"), commit)
+}
 
-        let err = utils::write_file(&temp_file, content);
-        assert!(err.is_none());
+// StripProvenance removes every line holding a provenance or version stamp, so re-stashing an
+// applied file does not accumulate them
+pub fn strip_provenance(content: &str) -> String {
+    content
+        .split_inclusive('\n')
+        .filter(|line| {
+            let line = line.trim();
+            !(line.starts_with(PROVENANCE_PREFIX) && line.ends_with("-->"))
+        })
+        .collect()
+}
 
-        // Verify the file was written correctly
-        let (read_err, read_content) = utils::read_file(&temp_file);
-        assert!(read_err.is_none());
-        assert_eq!(read_content, content);
-    }
+// StripHtmlComments removes HTML-style comments (<!-- ... -->) from the content, including
+// multi-line ones. As in HTML, comments don't nest: each ends at the first "-->" after it opens.
+// Comments that occupy whole lines are removed along with their line break so no stray blank lines
+// are left behind. An unterminated comment and everything after it is left untouched.
+pub fn strip_html_comments(content: &str) -> String {
+    const OPEN: &str = "<!--";
+    const CLOSE: &str = "-->";
 
-    #[test]
-    fn test_copy_file() {
-        // Create source file
-        let temp_dir = TempDir::new().unwrap();
-        let src_file = temp_dir.path().join("source.txt");
-        let src_content = "source content";
-        fs::write(&src_file, src_content).unwrap();
+    let mut result = String::with_capacity(content.len());
+    let mut rest = content;
 
-        // Create destination file path
-        let dst_file = temp_dir.path().join("destination.txt");
+    while let Some(start) = rest.find(OPEN) {
+        // With no close left there is nothing more to strip
+        let end = match rest[start + OPEN.len()..].find(CLOSE) {
+            Some(offset) => start + OPEN.len() + offset + CLOSE.len(),
+            None => break,
+        };
 
-        // Copy the file
-        let err = utils::copy_file(&src_file, &dst_file);
-        assert!(err.is_none());
+        result.push_str(&rest[..start]);
+        rest = &rest[end..];
 
-        // Verify the destination file has the correct content
-        let (read_err, dst_content) = utils::read_file(&dst_file);
-        assert!(read_err.is_none());
-        assert_eq!(dst_content, src_content);
+        // Drop the line break too if the comment was the only thing on its line
+        let line_start = result.rfind('\n').map_or(0, |i| i + 1);
+        let only_comment_on_line = result[line_start..].trim().is_empty();
+        if only_comment_on_line {
+            if let Some(stripped) = rest.strip_prefix("\r\n").or_else(|| rest.strip_prefix('\n')) {
+                result.truncate(line_start);
+                rest = stripped;
+            }
+        }
+    }
+
+    result.push_str(rest);
+    result
+}
+
+// Entries whose presence marks a directory as the project root, unless overridden
+pub const DEFAULT_ROOT_MARKERS: &[&str] = &[".git", ".gitignore"];
+
+// Root markers set for this run; empty means DEFAULT_ROOT_MARKERS
+static ROOT_MARKERS: RwLock<Vec<String>> = RwLock::new(Vec::new());
+
+// SetRootMarkers overrides the markers GetProjectRoot looks for. An empty list restores the defaults.
+pub fn set_root_markers(markers: Vec<String>) {
+    *ROOT_MARKERS.write().unwrap_or_else(|e| e.into_inner()) = markers;
+}
+
+// RootMarkers returns the markers GetProjectRoot currently looks for
+pub fn root_markers() -> Vec<String> {
+    let markers = ROOT_MARKERS.read().unwrap_or_else(|e| e.into_inner());
+    if markers.is_empty() {
+        return DEFAULT_ROOT_MARKERS.iter().map(|marker| marker.to_string()).collect();
+    }
+    markers.clone()
+}
+
+// GetProjectRoot finds the project root by looking upwards from the current directory for a root
+// marker (.git or .gitignore by default)
+pub fn get_project_root() -> Result<PathBuf, Box<dyn std::error::Error>> {
+    let current_dir = env::current_dir()?;
+    traced("find project root", &current_dir.display(), || {
+        find_project_root(&current_dir, &root_markers())
+    })
+}
+
+// FindProjectRoot walks up from start and returns the first directory containing any of the markers
+pub fn find_project_root(start: &Path, markers: &[String]) -> Result<PathBuf, Box<dyn std::error::Error>> {
+    let mut current_path = start.to_path_buf();
+
+    loop {
+        // Check if any marker file or directory exists here
+        if markers.iter().any(|marker| current_path.join(marker).exists()) {
+            return Ok(current_path);
+        }
+
+        // Move up to parent directory
+        match current_path.parent() {
+            Some(parent) => {
+                current_path = parent.to_path_buf();
+            }
+            None => {
+                // We've reached the root directory
+                break;
+            }
+        }
+    }
+
+    Err(format!("Project root not found (looked for {})", markers.join(", ")).into())
+}
+
+// Whether commands may only modify files inside a git repository
+static SAFE_MODE: AtomicBool = AtomicBool::new(false);
+
+// SetSafeMode turns on or off the check EnsureSafeTarget makes before files are modified
+pub fn set_safe_mode(enabled: bool) {
+    SAFE_MODE.store(enabled, Ordering::Relaxed);
+}
+
+// EnsureSafeTarget fails in safe mode unless dir is inside a git repository (a directory with .git
+// at or above it), so a stray invocation cannot write into places like $HOME or /tmp
+pub fn ensure_safe_target(dir: &Path) -> Result<(), Box<dyn std::error::Error>> {
+    if !SAFE_MODE.load(Ordering::Relaxed) {
+        return Ok(());
+    }
+
+    let dir = env::current_dir()?.join(dir);
+    if dir.ancestors().any(|ancestor| ancestor.join(".git").exists()) {
+        return Ok(());
+    }
+    Err(format!(
+        "Refusing to modify files in {}: it is not inside a git repository (run without --safe to allow this)",
+        dir.display()
+    )
+    .into())
+}
+
+// GetStashPath returns the path where the project's AGENTS.md should be stashed
+pub fn get_stash_path(project_name: &str) -> Result<PathBuf, Box<dyn std::error::Error>> {
+    if project_name.is_empty() {
+        panic!("Project name should not be empty");
+    }
+
+    let stash_dir = get_stashes_dir()?;
+
+    // A regular file in the way would otherwise surface as an obscure create_dir_all error
+    if stash_dir.exists() && !stash_dir.is_dir() {
+        return Err(format!(
+            "Stash directory {} is occupied by a file, not a directory. Move or remove that file and try again.",
+            stash_dir.display()
+        )
+        .into());
+    }
+
+    // Create the stash directory if it doesn't exist
+    fs::create_dir_all(&stash_dir)?;
+
+    let stash_path = stash_dir.join(stash_file_name(project_name));
+    Ok(stash_path)
+}
+
+// StashFileName returns the file name used for a project's stash, sanitizing the project name
+pub fn stash_file_name(project_name: &str) -> String {
+    format!("stash-{}.md", sanitize_file_name(project_name))
+}
+
+// SanitizeFileName makes a name safe to embed in a file name. Characters other than letters, digits,
+// '-', '_' and '.' are replaced with '-', runs of '-' are collapsed, and leading or trailing '-' and
+// '.' are trimmed. A name with nothing usable left becomes "unnamed".
+pub fn sanitize_file_name(name: &str) -> String {
+    let mut sanitized = String::with_capacity(name.len());
+    for c in name.chars() {
+        let replacement = if c.is_alphanumeric() || c == '_' || c == '.' { c } else { '-' };
+        if replacement == '-' && sanitized.ends_with('-') {
+            continue;
+        }
+        sanitized.push(replacement);
+    }
+
+    let trimmed = sanitized.trim_matches(['-', '.']);
+    if trimmed.is_empty() {
+        return "unnamed".to_string();
+    }
+    trimmed.to_string()
+}
+
+// ProjectNameFromStashFile extracts the project name from a stash file path (stash-<name>.md)
+pub fn project_name_from_stash_file(path: &Path) -> Option<&str> {
+    path.file_name()?
+        .to_str()?
+        .strip_prefix("stash-")?
+        .strip_suffix(".md")
+        .filter(|name| !name.is_empty())
+}
+
+// GetAgstashDir returns the path to the global .agstash directory
+pub fn get_agstash_dir() -> Result<PathBuf, Box<dyn std::error::Error>> {
+    let home_dir = dirs::home_dir().ok_or("Could not find home directory")?;
+    let agstash_dir = home_dir.join(".agstash");
+    Ok(agstash_dir)
+}
+
+// GetStashesDir returns the path to the directory holding all stash files, without creating it
+pub fn get_stashes_dir() -> Result<PathBuf, Box<dyn std::error::Error>> {
+    Ok(get_agstash_dir()?.join("stashes"))
+}
+
+// GetSnapshotsDir returns the path to the directory holding project snapshots, without creating it
+pub fn get_snapshots_dir() -> Result<PathBuf, Box<dyn std::error::Error>> {
+    Ok(get_agstash_dir()?.join("snapshots"))
+}
+
+// GetLockPath returns the path apply --lock-file locks when given no path, without creating it
+pub fn get_lock_path() -> Result<PathBuf, Box<dyn std::error::Error>> {
+    Ok(get_agstash_dir()?.join("apply.lock"))
+}
+
+// OpenStashReader opens the named project's stash for reading. Callers should read through the
+// returned reader rather than the stash path, so they keep working if the on-disk format changes.
+pub fn open_stash_reader(project_name: &str) -> Result<Box<dyn Read>, Box<dyn std::error::Error>> {
+    let stash_path = get_stashes_dir()?.join(stash_file_name(project_name));
+    match fs::File::open(&stash_path) {
+        Ok(file) => Ok(Box::new(io::BufReader::new(file))),
+        Err(e) if e.kind() == io::ErrorKind::NotFound => {
+            Err(format!("No stash found for project {}", project_name).into())
+        }
+        Err(e) => Err(format!("Could not open stash {}: {}", stash_path.display(), e).into()),
+    }
+}
+
+// ListStashFiles returns the stash files (stash-*.md) in the given directory, sorted by name.
+// A missing directory yields an empty list.
+pub fn list_stash_files<P: AsRef<Path>>(stashes_dir: P) -> Result<Vec<PathBuf>, Box<dyn std::error::Error>> {
+    let entries = match fs::read_dir(stashes_dir) {
+        Ok(entries) => entries,
+        Err(e) if e.kind() == io::ErrorKind::NotFound => return Ok(Vec::new()),
+        Err(e) => return Err(Box::new(e)),
+    };
+
+    let mut stash_files = Vec::new();
+    for entry in entries {
+        let path = entry?.path();
+        if project_name_from_stash_file(&path).is_some() && path.is_file() {
+            stash_files.push(path);
+        }
+    }
+
+    stash_files.sort();
+    Ok(stash_files)
+}
+
+// FileChecksum returns the hex-encoded SHA-256 checksum of a file's content
+pub fn file_checksum<P: AsRef<Path>>(path: P) -> Result<String, Box<dyn std::error::Error>> {
+    let mut file = fs::File::open(path)?;
+    reader_checksum(&mut file)
+}
+
+// ReaderChecksum returns the hex-encoded SHA-256 checksum of everything left in reader, reading it
+// in chunks rather than all at once
+pub fn reader_checksum(reader: &mut dyn Read) -> Result<String, Box<dyn std::error::Error>> {
+    let mut hasher = Sha256::new();
+    let mut buffer = [0u8; 8192];
+
+    loop {
+        let read = reader.read(&mut buffer)?;
+        if read == 0 {
+            break;
+        }
+        hasher.update(&buffer[..read]);
+    }
+
+    Ok(hex_digest(&hasher.finalize()))
+}
+
+// ContentChecksum returns the hex-encoded SHA-256 digest of content, matching FileChecksum for a file
+// holding the same bytes
+pub fn content_checksum(content: &[u8]) -> String {
+    hex_digest(&Sha256::digest(content))
+}
+
+// hex_digest formats digest bytes as lowercase hex
+fn hex_digest(digest: &[u8]) -> String {
+    digest.iter().map(|byte| format!("{:02x}", byte)).collect()
+}
+
+// FindDuplicateStashes groups the stash files in the given directory by checksum and read-only state
+// and returns only the groups containing more than one file. Groups and their members are sorted by name.
+pub fn find_duplicate_stashes<P: AsRef<Path>>(stashes_dir: P) -> Result<Vec<Vec<PathBuf>>, Box<dyn std::error::Error>> {
+    let mut by_checksum: BTreeMap<(bool, String), Vec<PathBuf>> = BTreeMap::new();
+    for path in list_stash_files(stashes_dir)? {
+        // A linked stash tracks a live file, and hard-linking it would break that
+        if is_symlink(&path) {
+            continue;
+        }
+        // Hard links share one set of permissions, so read-only and writable stashes never pair up
+        let read_only = fs::metadata(&path)?.permissions().readonly();
+        let checksum = file_checksum(&path)?;
+        by_checksum.entry((read_only, checksum)).or_default().push(path);
+    }
+
+    let mut duplicates: Vec<Vec<PathBuf>> = by_checksum
+        .into_values()
+        .filter(|paths| paths.len() > 1)
+        .collect();
+    duplicates.sort();
+    Ok(duplicates)
+}
+
+// IsSameFile reports whether two paths refer to the same underlying file (e.g. hard links)
+pub fn is_same_file<A: AsRef<Path>, B: AsRef<Path>>(a: A, b: B) -> Result<bool, Box<dyn std::error::Error>> {
+    #[cfg(unix)]
+    {
+        use std::os::unix::fs::MetadataExt;
+
+        let a_meta = fs::metadata(a)?;
+        let b_meta = fs::metadata(b)?;
+        Ok(a_meta.dev() == b_meta.dev() && a_meta.ino() == b_meta.ino())
+    }
+
+    #[cfg(not(unix))]
+    {
+        Ok(fs::canonicalize(a)? == fs::canonicalize(b)?)
+    }
+}
+
+// ReplaceWithHardLink replaces the file at path with a hard link to target
+pub fn replace_with_hard_link<T: AsRef<Path>, P: AsRef<Path>>(target: T, path: P) -> Result<(), Box<dyn std::error::Error>> {
+    let path = path.as_ref();
+    let temp_path = temp_sibling_path(path);
+
+    fs::hard_link(target, &temp_path)?;
+    if let Err(e) = fs::rename(&temp_path, path) {
+        let _ = fs::remove_file(&temp_path);
+        return Err(Box::new(e));
+    }
+
+    Ok(())
+}
+
+// ReplaceWithSymlink replaces the file at path with a symbolic link to target
+pub fn replace_with_symlink<T: AsRef<Path>, P: AsRef<Path>>(target: T, path: P) -> Result<(), Box<dyn std::error::Error>> {
+    let path = path.as_ref();
+    let temp_path = temp_sibling_path(path);
+
+    #[cfg(unix)]
+    std::os::unix::fs::symlink(target, &temp_path)?;
+    #[cfg(windows)]
+    std::os::windows::fs::symlink_file(target, &temp_path)?;
+    if let Err(e) = fs::rename(&temp_path, path) {
+        let _ = fs::remove_file(&temp_path);
+        return Err(Box::new(e));
+    }
+
+    Ok(())
+}
+
+// IsSymlink reports whether path itself is a symbolic link, whether or not its target exists
+pub fn is_symlink<P: AsRef<Path>>(path: P) -> bool {
+    fs::symlink_metadata(path).map(|metadata| metadata.file_type().is_symlink()).unwrap_or(false)
+}
+
+// ListDanglingStashLinks returns the linked stashes (stash-*.md symlinks) in the given directory whose
+// target no longer exists, sorted by name. list_stash_files skips these.
+pub fn list_dangling_stash_links<P: AsRef<Path>>(stashes_dir: P) -> Result<Vec<PathBuf>, Box<dyn std::error::Error>> {
+    let entries = match fs::read_dir(stashes_dir) {
+        Ok(entries) => entries,
+        Err(e) if e.kind() == io::ErrorKind::NotFound => return Ok(Vec::new()),
+        Err(e) => return Err(Box::new(e)),
+    };
+
+    let mut dangling = Vec::new();
+    for entry in entries {
+        let path = entry?.path();
+        if project_name_from_stash_file(&path).is_some() && is_symlink(&path) && !path.exists() {
+            dangling.push(path);
+        }
+    }
+
+    dangling.sort();
+    Ok(dangling)
+}
+
+// temp_sibling_path returns a temporary path in the same directory as path, so a rename onto path stays atomic
+fn temp_sibling_path(path: &Path) -> PathBuf {
+    let file_name = path
+        .file_name()
+        .map(|name| name.to_string_lossy().into_owned())
+        .unwrap_or_default();
+    path.with_file_name(format!(".{}.tmp-{}", file_name, std::process::id()))
+}
+
+// ReadFile reads the content of a file - returns (error, content)
+pub fn read_file<P: AsRef<Path>>(path: P) -> (Option<Box<dyn std::error::Error>>, String) {
+    let path = path.as_ref();
+    match traced("read", &path.display(), || fs::read_to_string(path)) {
+        Ok(content) => (None, content),
+        Err(e) => (Some(Box::new(e)), String::new()),
+    }
+}
+
+// WriteFile writes content to a file - returns error
+pub fn write_file<P: AsRef<Path>>(path: P, content: &str) -> Option<Box<dyn std::error::Error>> {
+    let path = path.as_ref();
+    match traced("write", &path.display(), || fs::write(path, content)) {
+        Ok(_) => None,
+        Err(e) => Some(Box::new(e)),
+    }
+}
+
+// WriteFileAtomic writes content to a temporary file next to path and renames it into place - returns error.
+// Readers never observe a partially written file, and an existing hard link at path is replaced rather than modified.
+pub fn write_file_atomic<P: AsRef<Path>>(path: P, content: &str) -> Option<Box<dyn std::error::Error>> {
+    let path = path.as_ref();
+    let temp_path = temp_sibling_path(path);
+
+    let result = traced("atomic write", &path.display(), || {
+        fs::File::create(&temp_path)
+            .and_then(|mut file| {
+                file.write_all(content.as_bytes())?;
+                file.sync_all()
+            })
+            .and_then(|_| fs::rename(&temp_path, path))
+    });
+
+    match result {
+        Ok(_) => None,
+        Err(e) => {
+            let _ = fs::remove_file(&temp_path);
+            Some(Box::new(e))
+        }
+    }
+}
+
+// ParseFileMode parses an octal permission string such as "644", "0444" or "0o600"
+pub fn parse_file_mode(value: &str) -> Result<u32, String> {
+    let digits = value.trim().trim_start_matches("0o");
+    if digits.is_empty() || !digits.chars().all(|c| ('0'..='7').contains(&c)) {
+        return Err(format!("invalid octal mode '{}'", value));
+    }
+
+    let mode = u32::from_str_radix(digits, 8).map_err(|_| format!("invalid octal mode '{}'", value))?;
+    if mode > 0o7777 {
+        return Err(format!("mode '{}' is out of range (maximum 7777)", value));
+    }
+    Ok(mode)
+}
+
+// SetFileMode sets a file's permission bits. On platforms without Unix permissions only the
+// read-only flag is applied, derived from the owner write bit.
+pub fn set_file_mode<P: AsRef<Path>>(path: P, mode: u32) -> Result<(), Box<dyn std::error::Error>> {
+    #[cfg(unix)]
+    {
+        use std::os::unix::fs::PermissionsExt;
+
+        fs::set_permissions(path, fs::Permissions::from_mode(mode))?;
+    }
+
+    #[cfg(not(unix))]
+    {
+        let mut permissions = fs::metadata(&path)?.permissions();
+        permissions.set_readonly(mode & 0o200 == 0);
+        fs::set_permissions(path, permissions)?;
+    }
+
+    Ok(())
+}
+
+// SetModifiedTime sets a file's modification time
+pub fn set_modified_time<P: AsRef<Path>>(path: P, time: SystemTime) -> Result<(), Box<dyn std::error::Error>> {
+    let file = fs::File::options().write(true).open(path)?;
+    file.set_modified(time)?;
+    Ok(())
+}
+
+// FileExists checks if a file exists
+pub fn file_exists<P: AsRef<Path>>(path: P) -> bool {
+    Path::new(path.as_ref()).exists()
+}
+
+// RemoveFile removes a file
+pub fn remove_file<P: AsRef<Path>>(path: P) -> Result<(), Box<dyn std::error::Error>> {
+    fs::remove_file(path)?;
+    Ok(())
+}
+
+// How long AcquireLock first waits while another process holds the lock; the wait doubles after each
+// attempt up to LOCK_MAX_RETRY_INTERVAL
+const LOCK_RETRY_INTERVAL: Duration = Duration::from_millis(50);
+const LOCK_MAX_RETRY_INTERVAL: Duration = Duration::from_secs(1);
+
+// AcquireLock takes an exclusive advisory lock on path, creating the file if needed, and retries with
+// backoff until timeout has passed (a zero timeout tries once). The lock is held until the returned
+// file is dropped.
+pub fn acquire_lock(path: &Path, timeout: Duration) -> Result<fs::File, Box<dyn std::error::Error>> {
+    let file = fs::OpenOptions::new()
+        .create(true)
+        .truncate(false)
+        .write(true)
+        .open(path)
+        .map_err(|e| format!("Could not open lock file {}: {}", path.display(), e))?;
+
+    let deadline = Instant::now() + timeout;
+    let mut interval = LOCK_RETRY_INTERVAL;
+    loop {
+        match file.try_lock() {
+            Ok(()) => return Ok(file),
+            Err(fs::TryLockError::WouldBlock) if Instant::now() < deadline => {
+                // Never sleep past the deadline, so the last attempt happens on time
+                thread::sleep(interval.min(deadline.saturating_duration_since(Instant::now())));
+                interval = (interval * 2).min(LOCK_MAX_RETRY_INTERVAL);
+            }
+            Err(fs::TryLockError::WouldBlock) => {
+                return Err(format!("Could not acquire lock on {} within {:?}", path.display(), timeout).into());
+            }
+            Err(fs::TryLockError::Error(e)) => {
+                return Err(format!("Could not lock {}: {}", path.display(), e).into());
+            }
+        }
+    }
+}
+
+// FormatTimestamp formats a point in time as an RFC 3339 UTC timestamp (e.g. 2024-05-01T12:30:00Z)
+pub fn format_timestamp(time: SystemTime) -> String {
+    let seconds = time.duration_since(UNIX_EPOCH).map(|d| d.as_secs()).unwrap_or(0);
+    let (days, seconds_of_day) = (seconds / 86_400, seconds % 86_400);
+
+    // Convert days since the epoch to a civil date (Howard Hinnant's days_from_civil inverse)
+    let z = days as i64 + 719_468;
+    let era = z.div_euclid(146_097);
+    let day_of_era = z.rem_euclid(146_097);
+    let year_of_era = (day_of_era - day_of_era / 1_460 + day_of_era / 36_524 - day_of_era / 146_096) / 365;
+    let day_of_year = day_of_era - (365 * year_of_era + year_of_era / 4 - year_of_era / 100);
+    let month_index = (5 * day_of_year + 2) / 153;
+    let day = day_of_year - (153 * month_index + 2) / 5 + 1;
+    let month = if month_index < 10 { month_index + 3 } else { month_index - 9 };
+    let year = year_of_era + era * 400 + if month <= 2 { 1 } else { 0 };
+
+    format!(
+        "{:04}-{:02}-{:02}T{:02}:{:02}:{:02}Z",
+        year,
+        month,
+        day,
+        seconds_of_day / 3_600,
+        seconds_of_day % 3_600 / 60,
+        seconds_of_day % 60
+    )
+}
+
+// Clipboard utilities tried in order for the current platform, as (program, args)
+#[cfg(target_os = "macos")]
+const CLIPBOARD_COPY_COMMANDS: &[(&str, &[&str])] = &[("pbcopy", &[])];
+#[cfg(target_os = "macos")]
+const CLIPBOARD_PASTE_COMMANDS: &[(&str, &[&str])] = &[("pbpaste", &[])];
+
+#[cfg(windows)]
+const CLIPBOARD_COPY_COMMANDS: &[(&str, &[&str])] = &[("clip.exe", &[])];
+#[cfg(windows)]
+const CLIPBOARD_PASTE_COMMANDS: &[(&str, &[&str])] =
+    &[("powershell.exe", &["-NoProfile", "-Command", "Get-Clipboard"])];
+
+#[cfg(not(any(target_os = "macos", windows)))]
+const CLIPBOARD_COPY_COMMANDS: &[(&str, &[&str])] = &[
+    ("xclip", &["-selection", "clipboard"]),
+    ("xsel", &["--clipboard", "--input"]),
+    ("wl-copy", &[]),
+];
+#[cfg(not(any(target_os = "macos", windows)))]
+const CLIPBOARD_PASTE_COMMANDS: &[(&str, &[&str])] = &[
+    ("xclip", &["-selection", "clipboard", "-o"]),
+    ("xsel", &["--clipboard", "--output"]),
+    ("wl-paste", &["--no-newline"]),
+];
+
+// find_executable searches PATH for the named program
+fn find_executable(name: &str) -> Option<PathBuf> {
+    let paths = env::var_os("PATH")?;
+    env::split_paths(&paths)
+        .map(|dir| dir.join(name))
+        .find(|candidate| candidate.is_file())
+}
+
+// find_clipboard_command picks the first available clipboard utility from the candidates
+fn find_clipboard_command(
+    candidates: &[(&str, &'static [&'static str])],
+) -> Result<(PathBuf, &'static [&'static str]), Box<dyn std::error::Error>> {
+    for (name, args) in candidates {
+        if let Some(program) = find_executable(name) {
+            return Ok((program, args));
+        }
+    }
+
+    let names: Vec<&str> = candidates.iter().map(|(name, _)| *name).collect();
+    Err(format!("No clipboard utility found (tried: {})", names.join(", ")).into())
+}
+
+// Default bound on how long a subprocess may run before it is killed
+pub const DEFAULT_SUBPROCESS_TIMEOUT: Duration = Duration::from_secs(30);
+
+// Subprocess timeout in milliseconds; zero means no timeout
+static SUBPROCESS_TIMEOUT_MS: AtomicU64 = AtomicU64::new(DEFAULT_SUBPROCESS_TIMEOUT.as_millis() as u64);
+
+// SetSubprocessTimeout bounds how long subprocesses (such as clipboard utilities) may run.
+// A zero duration disables the timeout.
+pub fn set_subprocess_timeout(timeout: Duration) {
+    SUBPROCESS_TIMEOUT_MS.store(timeout.as_millis() as u64, Ordering::Relaxed);
+}
+
+// SubprocessTimeout returns the configured subprocess timeout, or None if timeouts are disabled
+pub fn subprocess_timeout() -> Option<Duration> {
+    match SUBPROCESS_TIMEOUT_MS.load(Ordering::Relaxed) {
+        0 => None,
+        millis => Some(Duration::from_millis(millis)),
+    }
+}
+
+// ParseDuration parses durations such as "500ms", "30s", "5m" or "1h". A bare number is taken as
+// seconds, so "0" means zero.
+pub fn parse_duration(value: &str) -> Result<Duration, String> {
+    let value = value.trim();
+    let split_at = value
+        .find(|c: char| !c.is_ascii_digit())
+        .unwrap_or(value.len());
+    let (number, unit) = value.split_at(split_at);
+
+    let amount: u64 = number
+        .parse()
+        .map_err(|_| format!("invalid duration '{}'", value))?;
+
+    match unit {
+        "ms" => Ok(Duration::from_millis(amount)),
+        "" | "s" => Ok(Duration::from_secs(amount)),
+        "m" => Ok(Duration::from_secs(amount * 60)),
+        "h" => Ok(Duration::from_secs(amount * 60 * 60)),
+        _ => Err(format!("invalid duration unit '{}' (expected ms, s, m or h)", unit)),
+    }
+}
+
+// TimeoutError is returned when a subprocess outlives the configured subprocess timeout
+#[derive(Debug)]
+pub struct TimeoutError {
+    pub command: String,
+    pub timeout: Duration,
+}
+
+impl std::fmt::Display for TimeoutError {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "{} timed out after {:?}", self.command, self.timeout)
+    }
+}
+
+impl std::error::Error for TimeoutError {}
+
+// wait_with_timeout waits for the child to exit, killing it if it outlives the subprocess timeout
+fn wait_with_timeout(child: &mut Child, program: &Path) -> Result<ExitStatus, Box<dyn std::error::Error>> {
+    let timeout = match subprocess_timeout() {
+        Some(timeout) => timeout,
+        None => return Ok(child.wait()?),
+    };
+
+    let deadline = Instant::now() + timeout;
+    loop {
+        if let Some(status) = child.try_wait()? {
+            return Ok(status);
+        }
+
+        if Instant::now() >= deadline {
+            let _ = child.kill();
+            let _ = child.wait();
+            return Err(Box::new(TimeoutError {
+                command: program.display().to_string(),
+                timeout,
+            }));
+        }
+
+        thread::sleep(Duration::from_millis(10));
+    }
+}
+
+// GitFileChangedSince reports whether file in the git work tree at dir differs from its version at
+// git_ref, using `git diff --quiet`. An untracked file always counts as changed. Fails if git is
+// unavailable, dir is not in a repository, or the ref does not name a commit.
+pub fn git_file_changed_since(dir: &Path, git_ref: &str, file: &str) -> Result<bool, Box<dyn std::error::Error>> {
+    // Outside a repository git diff silently compares files instead, so check the ref first
+    let commit = format!("{}^{{commit}}", git_ref);
+    if !run_git(dir, &["rev-parse", "--verify", "--quiet", &commit])?.success() {
+        return Err(format!("{} is not a commit in a git repository at {}", git_ref, dir.display()).into());
+    }
+
+    // git diff ignores untracked files, so it would report one as unchanged
+    if !run_git(dir, &["ls-files", "--error-unmatch", "--", file])?.success() {
+        return Ok(true);
+    }
+
+    let status = run_git(dir, &["diff", "--quiet", git_ref, "--", file])?;
+    match status.code() {
+        Some(0) => Ok(false),
+        Some(1) => Ok(true),
+        _ => Err(format!("git diff against {} failed: {}", git_ref, status).into()),
+    }
+}
+
+// IsExecutable reports whether path is a file the current user could run. Without Unix permissions
+// any file counts.
+pub fn is_executable(path: &Path) -> bool {
+    #[cfg(unix)]
+    {
+        use std::os::unix::fs::PermissionsExt;
+        fs::metadata(path)
+            .map(|metadata| metadata.is_file() && metadata.permissions().mode() & 0o111 != 0)
+            .unwrap_or(false)
+    }
+
+    #[cfg(not(unix))]
+    {
+        path.is_file()
+    }
+}
+
+// RunHook runs the hook program in dir with the extra environment variables, letting it write to
+// the terminal, and returns its exit status. The hook is killed if it outlives the subprocess timeout.
+pub fn run_hook(hook: &Path, dir: &Path, vars: &[(&str, &Path)]) -> Result<ExitStatus, Box<dyn std::error::Error>> {
+    let mut command = Command::new(hook);
+    command.current_dir(dir).stdin(Stdio::null());
+    for (name, value) in vars {
+        command.env(name, value);
+    }
+
+    let mut child = command
+        .spawn()
+        .map_err(|e| format!("Could not run hook {}: {}", hook.display(), e))?;
+    wait_with_timeout(&mut child, hook)
+}
+
+// GitHeadCommit returns the commit HEAD points at in the repository containing dir, or None if dir
+// is not in a git repository or the repository has no commits yet
+pub fn git_head_commit(dir: &Path) -> Result<Option<String>, Box<dyn std::error::Error>> {
+    let (status, stdout) = run_git_output(dir, &["rev-parse", "--verify", "--quiet", "HEAD"])?;
+    if !status.success() {
+        return Ok(None);
+    }
+    Ok(Some(stdout.trim().to_string()))
+}
+
+// GitRemoteProject returns the owner/repo name of the origin remote of the repository containing dir,
+// or None if dir is not in a repository or has no origin remote
+pub fn git_remote_project(dir: &Path) -> Result<Option<String>, Box<dyn std::error::Error>> {
+    let (status, stdout) = run_git_output(dir, &["config", "--get", "remote.origin.url"])?;
+    if !status.success() {
+        return Ok(None);
+    }
+    Ok(parse_remote_project(&stdout))
+}
+
+// ParseRemoteProject extracts owner/repo from a git remote URL such as https://github.com/owner/repo.git
+// or git@github.com:owner/repo.git. Returns None if the URL has fewer than two path segments.
+pub fn parse_remote_project(url: &str) -> Option<String> {
+    let path = url.trim().trim_end_matches('/');
+    let path = path.strip_suffix(".git").unwrap_or(path);
+    // scp-like remotes separate the host from the path with ':'
+    let mut segments = path.rsplit(['/', ':']);
+    let repo = segments.next().filter(|segment| !segment.is_empty())?;
+    let owner = segments.next().filter(|segment| !segment.is_empty())?;
+    Some(format!("{}/{}", owner, repo))
+}
+
+// run_git_output runs git like run_git but captures its standard output. Meant for commands that
+// print a line or two; a large output would fill the pipe before git exits.
+fn run_git_output(dir: &Path, args: &[&str]) -> Result<(ExitStatus, String), Box<dyn std::error::Error>> {
+    let program = Path::new("git");
+    let mut child = Command::new(program)
+        .args(args)
+        .current_dir(dir)
+        .stdin(Stdio::null())
+        .stdout(Stdio::piped())
+        .stderr(Stdio::null())
+        .spawn()
+        .map_err(|e| format!("Could not run git: {}", e))?;
+
+    let status = wait_with_timeout(&mut child, program)?;
+    let mut stdout = String::new();
+    if let Some(mut pipe) = child.stdout.take() {
+        pipe.read_to_string(&mut stdout)?;
+    }
+    Ok((status, stdout))
+}
+
+// run_git runs git with args in dir, discarding its output, and returns its exit status
+fn run_git(dir: &Path, args: &[&str]) -> Result<ExitStatus, Box<dyn std::error::Error>> {
+    let program = Path::new("git");
+    let mut child = Command::new(program)
+        .args(args)
+        .current_dir(dir)
+        .stdin(Stdio::null())
+        .stdout(Stdio::null())
+        .stderr(Stdio::null())
+        .spawn()
+        .map_err(|e| format!("Could not run git: {}", e))?;
+
+    wait_with_timeout(&mut child, program)
+}
+
+// FetchUrl downloads the body of url over HTTP(S) as text, bounded by the subprocess timeout. Fails
+// on non-success statuses and on bodies larger than max_size bytes.
+pub fn fetch_url(url: &str, max_size: u64) -> Result<String, Box<dyn std::error::Error>> {
+    let mut builder = reqwest::blocking::Client::builder();
+    if let Some(timeout) = subprocess_timeout() {
+        builder = builder.timeout(timeout);
+    }
+    let client = builder.build()?;
+
+    let response = client
+        .get(url)
+        .send()
+        .map_err(|e| format!("Could not fetch {}: {}", url, e))?;
+    if !response.status().is_success() {
+        return Err(format!("Could not fetch {}: server returned {}", url, response.status()).into());
+    }
+    if response.content_length().is_some_and(|length| length > max_size) {
+        return Err(format!("Could not fetch {}: content is larger than {} bytes", url, max_size).into());
+    }
+
+    // The declared length may be missing or wrong, so cap what is actually read
+    let mut body = Vec::new();
+    response
+        .take(max_size + 1)
+        .read_to_end(&mut body)
+        .map_err(|e| format!("Could not fetch {}: {}", url, e))?;
+    if body.len() as u64 > max_size {
+        return Err(format!("Could not fetch {}: content is larger than {} bytes", url, max_size).into());
+    }
+
+    String::from_utf8(body).map_err(|_| format!("Could not fetch {}: content is not valid UTF-8", url).into())
+}
+
+// ReadClipboard returns the current contents of the system clipboard
+pub fn read_clipboard() -> Result<String, Box<dyn std::error::Error>> {
+    let (program, args) = find_clipboard_command(CLIPBOARD_PASTE_COMMANDS)?;
+
+    let mut child = Command::new(&program)
+        .args(args)
+        .stdin(Stdio::null())
+        .stdout(Stdio::piped())
+        .stderr(Stdio::null())
+        .spawn()?;
+
+    // Drain stdout on a separate thread so a stalled command cannot block the timeout
+    let mut stdout = child.stdout.take().ok_or("Could not capture clipboard command output")?;
+    let reader = thread::spawn(move || {
+        let mut output = Vec::new();
+        stdout.read_to_end(&mut output).map(|_| output)
+    });
+
+    let status = wait_with_timeout(&mut child, &program)?;
+    if !status.success() {
+        return Err(format!("Clipboard command {} failed: {}", program.display(), status).into());
+    }
+
+    let output = reader
+        .join()
+        .map_err(|_| "Clipboard output reader panicked")??;
+    Ok(String::from_utf8(output)?)
+}
+
+// WriteClipboard replaces the contents of the system clipboard with the given content
+pub fn write_clipboard(content: &str) -> Result<(), Box<dyn std::error::Error>> {
+    let (program, args) = find_clipboard_command(CLIPBOARD_COPY_COMMANDS)?;
+
+    // Clipboard utilities such as xclip fork to serve the selection, so stdout is not captured
+    let mut child = Command::new(&program)
+        .args(args)
+        .stdin(Stdio::piped())
+        .stdout(Stdio::null())
+        .stderr(Stdio::null())
+        .spawn()?;
+
+    // Feed stdin on a separate thread so a command that never reads cannot block the timeout
+    let mut stdin = child.stdin.take().ok_or("Could not open clipboard command input")?;
+    let content = content.to_string();
+    let writer = thread::spawn(move || stdin.write_all(content.as_bytes()));
+
+    let status = wait_with_timeout(&mut child, &program)?;
+    writer
+        .join()
+        .map_err(|_| "Clipboard input writer panicked")??;
+    if !status.success() {
+        return Err(format!("Clipboard command {} failed: {}", program.display(), status).into());
+    }
+
+    Ok(())
+}
+
+// install_clipboard_stub puts fake clipboard utilities (xclip, pbcopy, pbpaste) backed by a file at the
+// front of PATH, for tests, and returns that file
+#[cfg(all(test, unix))]
+pub(crate) fn install_clipboard_stub(dir: &Path) -> PathBuf {
+    use std::os::unix::fs::PermissionsExt;
+
+    let bin_dir = dir.join("bin");
+    fs::create_dir_all(&bin_dir).unwrap();
+    let clipboard_file = dir.join("clipboard.txt");
+
+    // Reading when "-o" is passed (xclip) or when invoked as pbpaste, writing otherwise
+    let script = format!(
+        "#!/bin/sh\ncase \"$0 $*\" in\n  *pbpaste*|*-o*) cat \"{0}\" ;;\n  *) cat > \"{0}\" ;;\nesac\n",
+        clipboard_file.display()
+    );
+    for name in ["xclip", "pbcopy", "pbpaste"] {
+        let stub = bin_dir.join(name);
+        fs::write(&stub, &script).unwrap();
+        fs::set_permissions(&stub, fs::Permissions::from_mode(0o755)).unwrap();
+    }
+
+    let original_path = env::var_os("PATH").unwrap_or_default();
+    let mut paths = vec![bin_dir];
+    paths.extend(env::split_paths(&original_path));
+    env::set_var("PATH", env::join_paths(paths).unwrap());
+
+    clipboard_file
+}
+
+#[cfg(test)]
+mod tests {
+    use std::fs;
+    use std::env;
+    use std::path::Path;
+    use std::time::Duration;
+    use tempfile::TempDir;
+    use serial_test::serial;
+    use crate::utils;
+
+    #[test]
+    fn test_is_valid_agents() {
+        // Valid cases
+        assert!(utils::is_valid_agents("# AGENTS"));
+        assert!(utils::is_valid_agents("# AGENTS\n"));
+        assert!(utils::is_valid_agents("  # AGENTS")); // Leading spaces
+        assert!(utils::is_valid_agents("# AGENTS\n\n- content"));
+
+        // Invalid cases
+        assert!(!utils::is_valid_agents(""));
+        assert!(!utils::is_valid_agents("# AGENT")); // Wrong header
+        assert!(!utils::is_valid_agents("- content")); // No header
+        assert!(!utils::is_valid_agents(" # AGENT")); // Space before #
+        assert!(!utils::is_valid_agents("AGENTS")); // Missing #
+    }
+
+    #[test]
+    fn test_find_project_root_default_markers() {
+        let temp_dir = TempDir::new().unwrap();
+        let project_dir = temp_dir.path().join("project");
+        let nested_dir = project_dir.join("src").join("deep");
+        fs::create_dir_all(&nested_dir).unwrap();
+        fs::create_dir(project_dir.join(".git")).unwrap();
+
+        let markers = utils::root_markers();
+        assert_eq!(markers, vec![".git".to_string(), ".gitignore".to_string()]);
+        assert_eq!(utils::find_project_root(&nested_dir, &markers).unwrap(), project_dir);
+    }
+
+    #[test]
+    fn test_find_project_root_custom_marker() {
+        let temp_dir = TempDir::new().unwrap();
+        let workspace_dir = temp_dir.path().join("workspace");
+        let nested_dir = workspace_dir.join("member");
+        fs::create_dir_all(&nested_dir).unwrap();
+        fs::write(workspace_dir.join(".workspace"), "").unwrap();
+
+        // Default markers are absent, the custom marker is found
+        let markers = vec![".workspace".to_string()];
+        assert_eq!(utils::find_project_root(&nested_dir, &markers).unwrap(), workspace_dir);
+
+        // A custom marker replaces the defaults, so a closer .git is ignored
+        fs::create_dir(nested_dir.join(".git")).unwrap();
+        assert_eq!(utils::find_project_root(&nested_dir, &markers).unwrap(), workspace_dir);
+
+        // Added to the defaults, the closer .git wins
+        let markers = vec![".git".to_string(), ".gitignore".to_string(), ".workspace".to_string()];
+        assert_eq!(utils::find_project_root(&nested_dir, &markers).unwrap(), nested_dir);
+    }
+
+    #[test]
+    fn test_find_project_root_not_found() {
+        let temp_dir = TempDir::new().unwrap();
+        let markers = vec![".agstash-test-marker-that-does-not-exist".to_string()];
+
+        let err = utils::find_project_root(temp_dir.path(), &markers).unwrap_err();
+        assert!(err.to_string().contains("Project root not found"));
+        assert!(err.to_string().contains(".agstash-test-marker-that-does-not-exist"));
+    }
+
+    #[test]
+    #[serial]
+    fn test_ensure_safe_target() {
+        let temp_dir = TempDir::new().unwrap();
+        let repo_dir = temp_dir.path().join("repo");
+        let nested_dir = repo_dir.join("nested");
+        fs::create_dir_all(&nested_dir).unwrap();
+        fs::create_dir(repo_dir.join(".git")).unwrap();
+        let _cleanup = defer::defer(|| utils::set_safe_mode(false));
+
+        // Without safe mode anything goes
+        assert!(utils::ensure_safe_target(temp_dir.path()).is_ok());
+
+        utils::set_safe_mode(true);
+        assert!(utils::ensure_safe_target(&repo_dir).is_ok());
+        assert!(utils::ensure_safe_target(&nested_dir).is_ok());
+        let err = utils::ensure_safe_target(temp_dir.path()).unwrap_err();
+        assert!(err.to_string().contains("not inside a git repository"));
+        assert!(err.to_string().contains("--safe"));
+    }
+
+    #[test]
+    #[serial]
+    fn test_get_project_root_with_root_markers() {
+        // Create a temporary directory and change to it
+        let temp_dir = TempDir::new().unwrap();
+        let original_dir = env::current_dir().unwrap();
+        fs::write(temp_dir.path().join(".workspace"), "").unwrap();
+        env::set_current_dir(&temp_dir).unwrap();
+
+        // Ensure cleanup happens
+        let _cleanup = defer::defer(|| {
+            let _ = env::set_current_dir(&original_dir);
+            utils::set_root_markers(Vec::new());
+        });
+
+        utils::set_root_markers(vec![".workspace".to_string()]);
+        assert_eq!(utils::root_markers(), vec![".workspace".to_string()]);
+        let root = utils::get_project_root().unwrap();
+        assert_eq!(fs::canonicalize(root).unwrap(), fs::canonicalize(temp_dir.path()).unwrap());
+
+        // An empty list restores the defaults
+        utils::set_root_markers(Vec::new());
+        assert_eq!(utils::root_markers().len(), 2);
+    }
+
+    #[test]
+    #[serial]
+    fn test_get_stash_path() {
+        // Create a temporary directory to use as home
+        let temp_dir = TempDir::new().unwrap();
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
+
+        // Test with a sample project name
+        let project_name = "test-project";
+        let stash_path_result = utils::get_stash_path(project_name);
+
+        assert!(stash_path_result.is_ok());
+        let stash_path = stash_path_result.unwrap();
+
+        let expected_path = temp_dir.path().join(".agstash").join("stashes").join("stash-test-project.md");
+        assert_eq!(stash_path, expected_path);
+
+        // Check if the stash directory was created
+        let stash_dir = temp_dir.path().join(".agstash").join("stashes");
+        assert!(stash_dir.exists());
+    }
+
+    #[test]
+    fn test_sanitize_file_name() {
+        // Already safe names are unchanged
+        assert_eq!(utils::sanitize_file_name("my-project_v2.0"), "my-project_v2.0");
+
+        // Spaces and runs of disallowed characters become a single '-'
+        assert_eq!(utils::sanitize_file_name("my project"), "my-project");
+        assert_eq!(utils::sanitize_file_name("my   cool -- project"), "my-cool-project");
+
+        // Path separators never survive
+        assert_eq!(utils::sanitize_file_name("team/api"), "team-api");
+        assert_eq!(utils::sanitize_file_name("team\\api"), "team-api");
+        assert_eq!(utils::sanitize_file_name("../../etc"), "etc");
+
+        // Unicode letters are kept, symbols are replaced
+        assert_eq!(utils::sanitize_file_name("café"), "café");
+        assert_eq!(utils::sanitize_file_name("日本語 プロジェクト"), "日本語-プロジェクト");
+        assert_eq!(utils::sanitize_file_name("rocket🚀app"), "rocket-app");
+
+        // Leading and trailing dots and dashes are trimmed
+        assert_eq!(utils::sanitize_file_name(".hidden."), "hidden");
+        assert_eq!(utils::sanitize_file_name("--name--"), "name");
+
+        // Nothing usable left
+        assert_eq!(utils::sanitize_file_name("..."), "unnamed");
+        assert_eq!(utils::sanitize_file_name(""), "unnamed");
+    }
+
+    #[test]
+    #[serial]
+    fn test_get_stash_path_occupied_by_file() {
+        // Create a temporary directory to use as home
+        let temp_dir = TempDir::new().unwrap();
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
+
+        // A regular file where the stashes directory should be
+        let agstash_dir = temp_dir.path().join(".agstash");
+        fs::create_dir_all(&agstash_dir).unwrap();
+        fs::write(agstash_dir.join("stashes"), "not a directory").unwrap();
+
+        let err = utils::get_stash_path("test-project").unwrap_err();
+        let message = err.to_string();
+        assert!(message.contains("is occupied by a file"));
+        assert!(message.contains(&agstash_dir.join("stashes").display().to_string()));
+    }
+
+    #[test]
+    #[serial]
+    fn test_get_stash_path_sanitizes_name() {
+        // Create a temporary directory to use as home
+        let temp_dir = TempDir::new().unwrap();
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
+
+        let stash_path = utils::get_stash_path("My Project").unwrap();
+        let expected_path = temp_dir.path().join(".agstash").join("stashes").join("stash-My-Project.md");
+        assert_eq!(stash_path, expected_path);
+    }
+
+    #[test]
+    fn test_project_name_from_stash_file() {
+        let stash_file = Path::new("/tmp/stashes").join(utils::stash_file_name("my-project"));
+        assert_eq!(utils::project_name_from_stash_file(&stash_file), Some("my-project"));
+
+        assert_eq!(utils::project_name_from_stash_file(Path::new("stash-.md")), None);
+        assert_eq!(utils::project_name_from_stash_file(Path::new("notes.md")), None);
+        assert_eq!(utils::project_name_from_stash_file(Path::new("stash-project.txt")), None);
+    }
+
+    #[test]
+    #[serial]
+    fn test_get_agstash_dir() {
+        // Create a temporary directory to use as home
+        let temp_dir = TempDir::new().unwrap();
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
+
+        let agstash_dir_result = utils::get_agstash_dir();
+
+        assert!(agstash_dir_result.is_ok());
+        let agstash_dir = agstash_dir_result.unwrap();
+
+        let expected_path = temp_dir.path().join(".agstash");
+        assert_eq!(agstash_dir, expected_path);
+    }
+
+    #[test]
+    fn test_file_exists() {
+        // Create a temporary file
+        let temp_dir = TempDir::new().unwrap();
+        let temp_file = temp_dir.path().join("test.txt");
+        fs::write(&temp_file, "test").unwrap();
+
+        // Test existing file
+        assert!(utils::file_exists(&temp_file));
+
+        // Test non-existing file
+        let non_existing_file = temp_dir.path().join("non-existing.txt");
+        assert!(!utils::file_exists(&non_existing_file));
+    }
+
+    #[test]
+    fn test_read_file() {
+        // Create a temporary file
+        let temp_dir = TempDir::new().unwrap();
+        let temp_file = temp_dir.path().join("test.txt");
+        let content = "test content";
+        fs::write(&temp_file, content).unwrap();
+
+        let (err, read_content) = utils::read_file(&temp_file);
+        assert!(err.is_none());
+        assert_eq!(read_content, content);
+    }
+
+    #[test]
+    fn test_write_file() {
+        let temp_dir = TempDir::new().unwrap();
+        let temp_file = temp_dir.path().join("test.txt");
+        let content = "test content";
+
+        let err = utils::write_file(&temp_file, content);
+        assert!(err.is_none());
+
+        // Verify the file was written correctly
+        let (read_err, read_content) = utils::read_file(&temp_file);
+        assert!(read_err.is_none());
+        assert_eq!(read_content, content);
+    }
+
+    #[test]
+    fn test_write_file_atomic() {
+        let temp_dir = TempDir::new().unwrap();
+        let temp_file = temp_dir.path().join("test.txt");
+        fs::write(&temp_file, "old content").unwrap();
+
+        let err = utils::write_file_atomic(&temp_file, "new content");
+        assert!(err.is_none());
+        assert_eq!(fs::read_to_string(&temp_file).unwrap(), "new content");
+
+        // No temporary files are left behind
+        let entries: Vec<_> = fs::read_dir(temp_dir.path()).unwrap().collect();
+        assert_eq!(entries.len(), 1);
+    }
+
+    #[test]
+    fn test_write_file_atomic_breaks_hard_link() {
+        let temp_dir = TempDir::new().unwrap();
+        let original = temp_dir.path().join("original.txt");
+        let linked = temp_dir.path().join("linked.txt");
+        fs::write(&original, "shared content").unwrap();
+        fs::hard_link(&original, &linked).unwrap();
+
+        let err = utils::write_file_atomic(&linked, "updated content");
+        assert!(err.is_none());
+
+        // The other link keeps its content
+        assert_eq!(fs::read_to_string(&original).unwrap(), "shared content");
+        assert_eq!(fs::read_to_string(&linked).unwrap(), "updated content");
+    }
+
+    #[test]
+    fn test_file_checksum() {
+        let temp_dir = TempDir::new().unwrap();
+        let temp_file = temp_dir.path().join("test.txt");
+        fs::write(&temp_file, "abc").unwrap();
+
+        let checksum = utils::file_checksum(&temp_file).unwrap();
+        assert_eq!(checksum, "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad");
+
+        // Missing files are reported as errors
+        assert!(utils::file_checksum(temp_dir.path().join("missing.txt")).is_err());
+
+        // Hashing content directly gives the same digest
+        assert_eq!(utils::content_checksum(b"abc"), checksum);
+    }
+
+    #[test]
+    #[serial]
+    fn test_open_stash_reader() {
+        use std::io::{BufRead, BufReader};
+
+        // Set up HOME environment variable to temp directory
+        let temp_dir = TempDir::new().unwrap();
+        let original_home = env::var("HOME").unwrap_or_default();
+        env::set_var("HOME", temp_dir.path());
+        
+        // Ensure cleanup happens
+        let _cleanup_home = defer::defer(move || {
+            if !original_home.is_empty() {
+                env::set_var("HOME", original_home);
+            }
+        });
+
+        let stash_path = utils::get_stash_path("reader-project").unwrap();
+        fs::write(&stash_path, "# AGENTS\n- one\n- two\n").unwrap();
+
+        // The stash can be consumed line by line
+        let reader = utils::open_stash_reader("reader-project").unwrap();
+        let lines: Vec<String> = BufReader::new(reader).lines().map(|line| line.unwrap()).collect();
+        assert_eq!(lines, vec!["# AGENTS", "- one", "- two"]);
+
+        let err = utils::open_stash_reader("missing-project").err().unwrap();
+        assert_eq!(err.to_string(), "No stash found for project missing-project");
+    }
+
+    #[test]
+    fn test_list_stash_files() {
+        let temp_dir = TempDir::new().unwrap();
+        fs::write(temp_dir.path().join("stash-b.md"), "# AGENTS").unwrap();
+        fs::write(temp_dir.path().join("stash-a.md"), "# AGENTS").unwrap();
+        fs::write(temp_dir.path().join("notes.txt"), "not a stash").unwrap();
+        fs::create_dir(temp_dir.path().join("stash-dir.md")).unwrap();
+
+        let stash_files = utils::list_stash_files(temp_dir.path()).unwrap();
+        assert_eq!(
+            stash_files,
+            vec![temp_dir.path().join("stash-a.md"), temp_dir.path().join("stash-b.md")]
+        );
+
+        // A missing directory has no stashes
+        let missing = utils::list_stash_files(temp_dir.path().join("missing")).unwrap();
+        assert!(missing.is_empty());
+    }
+
+    #[test]
+    fn test_find_duplicate_stashes() {
+        let temp_dir = TempDir::new().unwrap();
+        fs::write(temp_dir.path().join("stash-a.md"), "# AGENTS\n\nshared").unwrap();
+        fs::write(temp_dir.path().join("stash-b.md"), "# AGENTS\n\nunique").unwrap();
+        fs::write(temp_dir.path().join("stash-c.md"), "# AGENTS\n\nshared").unwrap();
+
+        let duplicates = utils::find_duplicate_stashes(temp_dir.path()).unwrap();
+        assert_eq!(
+            duplicates,
+            vec![vec![temp_dir.path().join("stash-a.md"), temp_dir.path().join("stash-c.md")]]
+        );
+
+        // Remove the duplicate and nothing is reported
+        fs::remove_file(temp_dir.path().join("stash-c.md")).unwrap();
+        assert!(utils::find_duplicate_stashes(temp_dir.path()).unwrap().is_empty());
+
+        // A read-only copy is not a duplicate of a writable one, only of another read-only one
+        let set_read_only = |name: &str| {
+            let path = temp_dir.path().join(name);
+            let mut permissions = fs::metadata(&path).unwrap().permissions();
+            permissions.set_readonly(true);
+            fs::set_permissions(&path, permissions).unwrap();
+        };
+        fs::write(temp_dir.path().join("stash-c.md"), "# AGENTS\n\nshared").unwrap();
+        fs::write(temp_dir.path().join("stash-d.md"), "# AGENTS\n\nshared").unwrap();
+        set_read_only("stash-c.md");
+        set_read_only("stash-d.md");
+        let duplicates = utils::find_duplicate_stashes(temp_dir.path()).unwrap();
+        assert_eq!(
+            duplicates,
+            vec![vec![temp_dir.path().join("stash-c.md"), temp_dir.path().join("stash-d.md")]]
+        );
+    }
+
+    #[test]
+    fn test_replace_with_hard_link() {
+        let temp_dir = TempDir::new().unwrap();
+        let target = temp_dir.path().join("target.txt");
+        let duplicate = temp_dir.path().join("duplicate.txt");
+        fs::write(&target, "same").unwrap();
+        fs::write(&duplicate, "same").unwrap();
+        assert!(!utils::is_same_file(&target, &duplicate).unwrap());
+
+        utils::replace_with_hard_link(&target, &duplicate).unwrap();
+        assert!(utils::is_same_file(&target, &duplicate).unwrap());
+        assert_eq!(fs::read_to_string(&duplicate).unwrap(), "same");
+    }
+
+    #[test]
+    fn test_parse_file_mode() {
+        assert_eq!(utils::parse_file_mode("644"), Ok(0o644));
+        assert_eq!(utils::parse_file_mode("0444"), Ok(0o444));
+        assert_eq!(utils::parse_file_mode("0o600"), Ok(0o600));
+        assert_eq!(utils::parse_file_mode("4755"), Ok(0o4755));
+
+        assert!(utils::parse_file_mode("").is_err());
+        assert!(utils::parse_file_mode("rw-r--r--").is_err());
+        assert!(utils::parse_file_mode("0888").is_err());
+        assert!(utils::parse_file_mode("17777").is_err());
+    }
+
+    #[test]
+    #[cfg(unix)]
+    fn test_set_file_mode() {
+        use std::os::unix::fs::PermissionsExt;
+
+        let temp_dir = TempDir::new().unwrap();
+        let temp_file = temp_dir.path().join("test.txt");
+        fs::write(&temp_file, "test").unwrap();
+
+        utils::set_file_mode(&temp_file, 0o640).unwrap();
+        let mode = fs::metadata(&temp_file).unwrap().permissions().mode();
+        assert_eq!(mode & 0o7777, 0o640);
+    }
+
+    #[test]
+    fn test_validate_agents_valid() {
+        let issues = utils::validate_agents("# AGENTS\n\n- Use tabs\n");
+        assert!(issues.is_empty());
+    }
+
+    #[test]
+    fn test_validate_agents_warnings() {
+        // Header only
+        let issues = utils::validate_agents("# AGENTS\n\n\n");
+        assert_eq!(issues.len(), 1);
+        assert_eq!(issues[0].severity, utils::Severity::Warning);
+        assert!(issues[0].message.contains("No content"));
+
+        // Header preceded by blank lines
+        let issues = utils::validate_agents("\n\n# AGENTS\n- content\n");
+        assert_eq!(issues.len(), 1);
+        assert_eq!(issues[0].severity, utils::Severity::Warning);
+        assert!(issues[0].message.contains("first line"));
+
+        // Both at once
+        let issues = utils::validate_agents("  # AGENTS");
+        assert_eq!(issues.len(), 2);
+        assert!(issues.iter().all(|issue| issue.severity == utils::Severity::Warning));
+    }
+
+    #[test]
+    fn test_lint_bullets() {
+        let style = utils::BulletStyle { prefix: Some("- ".to_string()), no_trailing_period: true };
+
+        let compliant = "# AGENTS\n\n- Use tabs\n  - Even in YAML\n\nSentences outside lists may end with a period.\n---\n";
+        assert!(utils::lint_bullets(compliant, &style).is_empty());
+
+        let content = "# AGENTS\n\n* Use tabs\n- Run the tests.\n1. Commit\n```\n* not a list item.\n```\n";
+        let messages: Vec<String> = utils::lint_bullets(content, &style).into_iter().map(|issue| issue.message).collect();
+        assert_eq!(messages, vec![
+            "Line 3: list item does not start with '- '",
+            "Line 4: list item ends with a period",
+            "Line 5: list item does not start with '- '",
+        ]);
+
+        // Only the configured rules apply
+        let style = utils::BulletStyle { no_trailing_period: true, ..Default::default() };
+        assert_eq!(utils::lint_bullets(content, &style).len(), 1);
+
+        // A ~~~ fence inside a ``` block does not end it
+        let content = "# AGENTS\n\n```md\n~~~\n~~~\n* code.\n```\n";
+        assert!(utils::lint_bullets(content, &style).is_empty());
+    }
+
+    #[test]
+    #[serial]
+    fn test_validate_agents_bullet_style() {
+        let _cleanup = defer::defer(|| utils::set_bullet_style(None));
+        let content = "# AGENTS\n\n* Use tabs.\n";
+        assert!(utils::validate_agents(content).is_empty());
+
+        utils::set_bullet_style(Some(utils::BulletStyle { prefix: Some("- ".to_string()), no_trailing_period: true }));
+        let issues = utils::validate_agents(content);
+        assert_eq!(issues.len(), 2);
+        assert!(issues.iter().all(|issue| issue.severity == utils::Severity::Warning));
+    }
+
+    #[test]
+    fn test_validate_agents_errors() {
+        let issues = utils::validate_agents("");
+        assert_eq!(issues, vec![utils::ValidationIssue {
+            severity: utils::Severity::Error,
+            message: "Content is empty".to_string(),
+        }]);
+
+        let issues = utils::validate_agents("- content without header");
+        assert_eq!(issues.len(), 1);
+        assert_eq!(issues[0].severity, utils::Severity::Error);
+        assert!(issues[0].message.contains("Missing '# AGENTS' header"));
+
+        // Oversized content is reported instead of panicking
+        let large_content = "# AGENTS\n".to_string() + &"a".repeat(10_000_000);
+        let issues = utils::validate_agents(&large_content);
+        assert_eq!(issues.len(), 1);
+        assert_eq!(issues[0].severity, utils::Severity::Error);
+    }
+
+    #[test]
+    fn test_line_diff() {
+        use utils::DiffLine::{Added, Removed, Unchanged};
+
+        let old = "# AGENTS\n- keep\n- old rule\n- tail\n";
+        let new = "# AGENTS\n- keep\n- new rule\n- tail\n- extra\n";
+        assert_eq!(
+            utils::line_diff(old, new),
+            vec![
+                Unchanged("# AGENTS".to_string()),
+                Unchanged("- keep".to_string()),
+                Removed("- old rule".to_string()),
+                Added("- new rule".to_string()),
+                Unchanged("- tail".to_string()),
+                Added("- extra".to_string()),
+            ]
+        );
+    }
+
+    #[test]
+    fn test_strict_header() {
+        assert!(utils::has_strict_header("# AGENTS\n\ncontent"));
+        assert!(!utils::has_strict_header("\n\n# AGENTS\n\ncontent"));
+        assert!(!utils::has_strict_header("  # AGENTS\n"));
+        assert!(utils::is_valid_agents("\n\n# AGENTS\n\ncontent"));
+
+        assert_eq!(utils::normalize_header("\r\n\n  \t# AGENTS\n\ncontent"), "# AGENTS\n\ncontent");
+        assert_eq!(utils::normalize_header("# AGENTS\n"), "# AGENTS\n");
+        assert_eq!(utils::normalize_header("\nno header"), "\nno header");
+        assert!(utils::has_strict_header(&utils::normalize_header("\n\n# AGENTS\n")));
+    }
+
+    #[test]
+    fn test_find_placeholders() {
+        let content = "# AGENTS\n\n{{PROJECT}} uses {{ LANGUAGE }}.\n- Ask {{OWNER}} about {{PROJECT}}\n- {{PROJECT}}\n{{}} and { {SPACED} } are not placeholders\n";
+        let placeholders = utils::find_placeholders(content);
+        assert_eq!(
+            placeholders.into_iter().collect::<Vec<_>>(),
+            vec![("LANGUAGE".to_string(), 1), ("OWNER".to_string(), 1), ("PROJECT".to_string(), 3)]
+        );
+        assert!(utils::find_placeholders("# AGENTS\n\nNothing to fill in").is_empty());
+    }
+
+    #[test]
+    fn test_diff_stats() {
+        let stats = |old: &str, new: &str| utils::diff_stats(&utils::line_diff(old, new));
+
+        // Identical
+        assert_eq!(stats("a\nb\nc\n", "a\nb\nc\n"), (0, 0, 3));
+
+        // Disjoint
+        assert_eq!(stats("a\nb\n", "x\ny\nz\n"), (3, 2, 0));
+
+        // Partially overlapping
+        let old = "# AGENTS\n- keep\n- old rule\n- tail\n";
+        let new = "# AGENTS\n- keep\n- new rule\n- tail\n- extra\n";
+        assert_eq!(stats(old, new), (2, 1, 3));
+
+        // Empty inputs are all added or all removed
+        assert_eq!(stats("", "a\nb"), (2, 0, 0));
+        assert_eq!(stats("a\nb", ""), (0, 2, 0));
+        assert_eq!(stats("", ""), (0, 0, 0));
+    }
+
+    #[test]
+    fn test_line_diff_edge_cases() {
+        use utils::DiffLine::{Added, Removed, Unchanged};
+
+        // Identical content has no changes
+        let same = utils::line_diff("a\nb\n", "a\nb\n");
+        assert_eq!(same, vec![Unchanged("a".to_string()), Unchanged("b".to_string())]);
+
+        // Empty inputs produce all-added or all-removed diffs
+        assert_eq!(utils::line_diff("", "a\nb"), vec![Added("a".to_string()), Added("b".to_string())]);
+        assert_eq!(utils::line_diff("a\nb", ""), vec![Removed("a".to_string()), Removed("b".to_string())]);
+        assert!(utils::line_diff("", "").is_empty());
+
+        // Moved lines keep the longest common run in place
+        let moved = utils::line_diff("a\nb\nc", "b\nc\na");
+        assert_eq!(
+            moved,
+            vec![
+                Removed("a".to_string()),
+                Unchanged("b".to_string()),
+                Unchanged("c".to_string()),
+                Added("a".to_string()),
+            ]
+        );
+    }
+
+    #[test]
+    fn test_detect_line_endings() {
+        use utils::LineEndings;
+
+        assert_eq!(utils::detect_line_endings("# AGENTS\n\n- rule\n"), LineEndings::Lf);
+        assert_eq!(utils::detect_line_endings("# AGENTS\r\n\r\n- rule\r\n"), LineEndings::Crlf);
+        assert_eq!(utils::detect_line_endings("# AGENTS\r\n- rule\n"), LineEndings::Mixed);
+        assert_eq!(utils::detect_line_endings(""), LineEndings::None);
+        assert_eq!(utils::detect_line_endings("# AGENTS"), LineEndings::None);
+
+        // A lone carriage return is not a line break
+        assert_eq!(utils::detect_line_endings("a\rb\n"), LineEndings::Lf);
+        assert_eq!(LineEndings::Mixed.as_str(), "mixed");
+    }
+
+    #[test]
+    fn test_reflow() {
+        let content = concat!(
+            "# AGENTS with a heading that is far too long to fit\n",
+            "\n",
+            "Prose that runs on well past the width\n",
+            "and continues here.\n",
+            "\n",
+            "- a bullet that is also longer than the width\n",
+            "  with an indented continuation\n",
+            "\n",
+            "```\n",
+            "code that must never be wrapped by reflow\n",
+            "```\n",
+            "Short\n",
+            "---\n",
+            "unbreakablewordlongerthanwidth end",
+        );
+        let expected = concat!(
+            "# AGENTS with a heading that is far too long to fit\n",
+            "\n",
+            "Prose that runs on\n",
+            "well past the width\n",
+            "and continues here.\n",
+            "\n",
+            "- a bullet that is also longer than the width\n",
+            "  with an indented continuation\n",
+            "\n",
+            "```\n",
+            "code that must never be wrapped by reflow\n",
+            "```\n",
+            "Short\n",
+            "---\n",
+            "unbreakablewordlongerthanwidth\n",
+            "end",
+        );
+        assert_eq!(utils::reflow(content, 20), expected);
+
+        // CRLF paragraphs stay CRLF
+        assert_eq!(utils::reflow("one two three\r\n", 7), "one two\r\nthree\r\n");
+
+        // A ~~~ fence inside a ``` block does not end it
+        let content = "```md\n~~~\n~~~\ncode that must never be wrapped\n```\n";
+        assert_eq!(utils::reflow(content, 7), content);
+
+        assert_eq!(utils::parse_reflow_width("80"), Ok(80));
+        assert!(utils::parse_reflow_width("0").is_err());
+        assert!(utils::parse_reflow_width("wide").is_err());
+    }
+
+    #[test]
+    fn test_normalize_line_endings() {
+        use utils::LineEndings;
+
+        let mixed = "# AGENTS\r\n\n- rule\n- other\r\n";
+        assert_eq!(utils::normalize_line_endings(mixed, LineEndings::Lf), "# AGENTS\n\n- rule\n- other\n");
+        assert_eq!(utils::normalize_line_endings(mixed, LineEndings::Crlf), "# AGENTS\r\n\r\n- rule\r\n- other\r\n");
+        assert_eq!(utils::normalize_line_endings(mixed, LineEndings::Mixed), mixed);
+
+        assert_eq!(utils::parse_line_endings("CRLF"), Ok(LineEndings::Crlf));
+        assert_eq!(utils::parse_line_endings("lf"), Ok(LineEndings::Lf));
+        assert!(utils::parse_line_endings("cr").is_err());
+    }
+
+    #[test]
+    fn test_diff_hunks() {
+        use utils::DiffLine::{Added, Removed, Unchanged};
+
+        let old = "# AGENTS\na\nb\nc\nd\ne\nf\ng\nh\n";
+        let new = "# AGENTS\na\nB\nc\nd\ne\nf\ng\nh\ni\n";
+        let hunks = utils::diff_hunks(&utils::line_diff(old, new), 1);
+        assert_eq!(
+            hunks,
+            vec![
+                utils::DiffHunk {
+                    old_start: 2,
+                    old_lines: 3,
+                    new_start: 2,
+                    new_lines: 3,
+                    lines: vec![
+                        Unchanged("a".to_string()),
+                        Removed("b".to_string()),
+                        Added("B".to_string()),
+                        Unchanged("c".to_string()),
+                    ],
+                },
+                utils::DiffHunk {
+                    old_start: 9,
+                    old_lines: 1,
+                    new_start: 9,
+                    new_lines: 2,
+                    lines: vec![Unchanged("h".to_string()), Added("i".to_string())],
+                },
+            ]
+        );
+
+        // Wider context merges nearby changes into one hunk
+        assert_eq!(utils::diff_hunks(&utils::line_diff(old, new), 3).len(), 1);
+
+        // No changes, no hunks; a diff from nothing starts the old side at line 0
+        assert!(utils::diff_hunks(&utils::line_diff(old, old), 3).is_empty());
+        let created = utils::diff_hunks(&utils::line_diff("", "a\nb"), 3);
+        assert_eq!((created[0].old_start, created[0].old_lines), (0, 0));
+        assert_eq!((created[0].new_start, created[0].new_lines), (1, 2));
+    }
+
+    #[test]
+    fn test_parse_agents_sections() {
+        let content = "Preamble line\n\n# AGENTS\n\nIntro\n## Style\n- tabs\n### Go\n- gofmt\n## Testing\n- table tests";
+        let sections = utils::parse_agents_sections(content);
+
+        let outline: Vec<(usize, &str)> = sections.iter().map(|s| (s.level, s.title.as_str())).collect();
+        assert_eq!(outline, vec![(0, ""), (1, "AGENTS"), (2, "Style"), (3, "Go"), (2, "Testing")]);
+
+        // Content before the first heading has no heading line
+        assert_eq!(sections[0].heading, "");
+        assert_eq!(sections[0].body, "Preamble line\n\n");
+        assert_eq!(sections[1].heading, "# AGENTS\n");
+        assert_eq!(sections[1].body, "\nIntro\n");
+
+        // Nested headings split sections; the last body keeps its missing final newline
+        assert_eq!(sections[3].body, "- gofmt\n");
+        assert_eq!(sections[4].body, "- table tests");
+    }
+
+    #[test]
+    fn test_parse_agents_sections_edge_cases() {
+        // No leading section when the content starts with a heading
+        let sections = utils::parse_agents_sections("# AGENTS\n");
+        assert_eq!(sections.len(), 1);
+        assert_eq!(sections[0].body, "");
+        assert!(utils::parse_agents_sections("").is_empty());
+
+        // Headings in fenced code blocks and lines like "#tag" stay in the body
+        let content = "# AGENTS\n```sh\n# comment\n```\n#tag\n####### seven\n##\n";
+        let sections = utils::parse_agents_sections(content);
+        assert_eq!(sections.len(), 2);
+        assert_eq!(sections[0].body, "```sh\n# comment\n```\n#tag\n####### seven\n");
+        assert_eq!((sections[1].level, sections[1].title.as_str()), (2, ""));
+
+        // Tilde fences count too
+        let content = "# AGENTS\n~~~\n## not a section\n~~~\n";
+        let sections = utils::parse_agents_sections(content);
+        assert_eq!(sections.len(), 1);
+        assert_eq!(sections[0].body, "~~~\n## not a section\n~~~\n");
+
+        // A fence only closes on the same character, at least as long, so nested fences stay code
+        let content = "# AGENTS\n```md\n~~~\n## one\n~~~\n``\n## two\n```\n````\n## three\n```\n## four\n````\n## Five\n";
+        let sections = utils::parse_agents_sections(content);
+        assert_eq!(sections.len(), 2);
+        assert_eq!(sections[1].title, "Five");
+        assert_eq!(utils::render_agents_sections(&sections), content);
+
+        // Titles are trimmed while the heading line is kept verbatim
+        let sections = utils::parse_agents_sections("##   Notes  \r\nbody\r\n");
+        assert_eq!(sections[0].title, "Notes");
+        assert_eq!(sections[0].heading, "##   Notes  \r\n");
+    }
+
+    #[test]
+    fn test_render_agents_sections_round_trip() {
+        let samples = [
+            "",
+            "# AGENTS\n",
+            "no headings at all",
+            "Preamble\n# AGENTS\n\n## A\n- a\n### A.1\n\n## B\n- b",
+            "# AGENTS\r\n\r\n## Windows\r\n- crlf\r\n",
+            "# AGENTS\n```\n## inside fence\n```\n## After\n\n\n",
+        ];
+        for sample in samples {
+            let sections = utils::parse_agents_sections(sample);
+            assert_eq!(utils::render_agents_sections(&sections), sample);
+        }
+    }
+
+    #[test]
+    fn test_strip_provenance() {
+        use std::time::UNIX_EPOCH;
+
+        let stamp = utils::provenance_stamp("demo", "abc123", UNIX_EPOCH);
+        assert_eq!(stamp, "<!-- agstash: applied from stash demo sha256:abc123 at 1970-01-01T00:00:00Z -->");
+
+        let content = format!("# AGENTS\n\n- rule\n{}\n", stamp);
+        assert_eq!(utils::strip_provenance(&content), "# AGENTS\n\n- rule\n");
+        assert_eq!(utils::strip_provenance(&format!("# AGENTS\n{}\r\n{}", stamp, stamp)), "# AGENTS\n");
+
+        let version = utils::version_stamp();
+        assert!(version.starts_with(&format!("<!-- agstash: applied by agstash {}", env!("CARGO_PKG_VERSION"))));
+        assert_eq!(utils::strip_provenance(&format!("# AGENTS\n{}\n{}\n", stamp, version)), "# AGENTS\n");
+
+        // Other comments are kept
+        let plain = "# AGENTS\n<!-- agstash: a note -->\n";
+        assert_eq!(utils::strip_provenance(plain), plain);
+    }
+
+    #[test]
+    fn test_strip_html_comments_single_line() {
+        let content = "# AGENTS\n\n<!-- TODO: tidy up -->\n- Use tabs <!-- not spaces -->\n";
+        let stripped = utils::strip_html_comments(content);
+        assert_eq!(stripped, "# AGENTS\n\n- Use tabs \n");
+
+        // Content without comments is returned unchanged
+        let plain = "# AGENTS\n\n- content\n";
+        assert_eq!(utils::strip_html_comments(plain), plain);
+    }
+
+    #[test]
+    fn test_strip_html_comments_multi_line() {
+        let content = "# AGENTS\n<!--\nTODO:\n- draft rule\n-->\n- Keep functions small\n";
+        let stripped = utils::strip_html_comments(content);
+        assert_eq!(stripped, "# AGENTS\n- Keep functions small\n");
+
+        // CRLF line endings are handled the same way
+        let crlf = "# AGENTS\r\n<!-- note -->\r\n- rule\r\n";
+        assert_eq!(utils::strip_html_comments(crlf), "# AGENTS\r\n- rule\r\n");
+    }
+
+    #[test]
+    fn test_strip_html_comments_nested() {
+        // Comments don't nest, so a second opener inside one is just comment text
+        let content = "# AGENTS\n<!-- a <!-- b -->\n- rule\n<!-- later -->\n- more\n";
+        let stripped = utils::strip_html_comments(content);
+        assert_eq!(stripped, "# AGENTS\n- rule\n- more\n");
+
+        // and the first close ends the comment
+        let content = "# AGENTS\n<!-- outer <!-- inner --> after -->\n";
+        assert_eq!(utils::strip_html_comments(content), "# AGENTS\n after -->\n");
+
+        // An unterminated comment is left as-is rather than swallowing the rest of the file
+        let unterminated = "# AGENTS\n<!-- never closed\n- rule\n";
+        assert_eq!(utils::strip_html_comments(unterminated), unterminated);
+
+        // Comments before it are still stripped, and only its tail is kept verbatim
+        let content = "# AGENTS\n<!-- note -->\n- rule\n<!-- never closed\n- tail\n";
+        assert_eq!(utils::strip_html_comments(content), "# AGENTS\n- rule\n<!-- never closed\n- tail\n");
+    }
+
+    #[test]
+    #[serial]
+    #[cfg(unix)]
+    fn test_clipboard_round_trip() {
+        let temp_dir = TempDir::new().unwrap();
+        let original_path = env::var("PATH").unwrap_or_default();
+        let clipboard_file = utils::install_clipboard_stub(temp_dir.path());
+
+        // Ensure cleanup happens
+        let _cleanup_path = defer::defer(move || {
+            env::set_var("PATH", original_path);
+        });
+
+        let content = "# AGENTS\n\n- clipboard content\n";
+        assert!(utils::write_clipboard(content).is_ok());
+        assert_eq!(fs::read_to_string(&clipboard_file).unwrap(), content);
+
+        let read_result = utils::read_clipboard();
+        assert!(read_result.is_ok());
+        assert_eq!(read_result.unwrap(), content);
+    }
+
+    #[test]
+    #[serial]
+    fn test_clipboard_unavailable() {
+        // Point PATH at an empty directory so no clipboard utility can be found
+        let temp_dir = TempDir::new().unwrap();
+        let original_path = env::var("PATH").unwrap_or_default();
+        env::set_var("PATH", temp_dir.path());
+
+        // Ensure cleanup happens
+        let _cleanup_path = defer::defer(move || {
+            env::set_var("PATH", original_path);
+        });
+
+        let write_err = utils::write_clipboard("# AGENTS").unwrap_err();
+        assert!(write_err.to_string().contains("No clipboard utility found"));
+
+        let read_err = utils::read_clipboard().unwrap_err();
+        assert!(read_err.to_string().contains("No clipboard utility found"));
+    }
+
+    #[test]
+    fn test_format_timestamp() {
+        use std::time::UNIX_EPOCH;
+
+        assert_eq!(utils::format_timestamp(UNIX_EPOCH), "1970-01-01T00:00:00Z");
+        assert_eq!(
+            utils::format_timestamp(UNIX_EPOCH + Duration::from_secs(951_782_400)),
+            "2000-02-29T00:00:00Z"
+        );
+        assert_eq!(
+            utils::format_timestamp(UNIX_EPOCH + Duration::from_secs(1_714_566_645)),
+            "2024-05-01T12:30:45Z"
+        );
+    }
+
+    #[test]
+    fn test_parse_duration() {
+        assert_eq!(utils::parse_duration("500ms"), Ok(Duration::from_millis(500)));
+        assert_eq!(utils::parse_duration("30s"), Ok(Duration::from_secs(30)));
+        assert_eq!(utils::parse_duration("30"), Ok(Duration::from_secs(30)));
+        assert_eq!(utils::parse_duration("5m"), Ok(Duration::from_secs(300)));
+        assert_eq!(utils::parse_duration("1h"), Ok(Duration::from_secs(3600)));
+        assert_eq!(utils::parse_duration("0"), Ok(Duration::ZERO));
+
+        assert!(utils::parse_duration("").is_err());
+        assert!(utils::parse_duration("fast").is_err());
+        assert!(utils::parse_duration("10d").is_err());
+        assert!(utils::parse_duration("-5s").is_err());
+    }
+
+    #[test]
+    fn test_parse_remote_project() {
+        assert_eq!(utils::parse_remote_project("https://github.com/acme/widgets.git\n"), Some("acme/widgets".to_string()));
+        assert_eq!(utils::parse_remote_project("git@github.com:acme/widgets.git"), Some("acme/widgets".to_string()));
+        assert_eq!(utils::parse_remote_project("ssh://git@host.example/acme/widgets/"), Some("acme/widgets".to_string()));
+        assert_eq!(utils::parse_remote_project("widgets"), None);
+        assert_eq!(utils::parse_remote_project(""), None);
+    }
+
+    #[test]
+    fn test_acquire_lock() {
+        let temp_dir = TempDir::new().unwrap();
+        let lock_path = temp_dir.path().join("deploy.lock");
+
+        let held = utils::acquire_lock(&lock_path, Duration::ZERO).unwrap();
+        assert!(lock_path.exists());
+
+        // A second lock waits out its timeout and then fails
+        let started = std::time::Instant::now();
+        let err = utils::acquire_lock(&lock_path, Duration::from_millis(200)).unwrap_err();
+        assert!(started.elapsed() >= Duration::from_millis(200));
+        assert!(err.to_string().contains("Could not acquire lock"));
+
+        // Once released the lock can be taken again
+        drop(held);
+        assert!(utils::acquire_lock(&lock_path, Duration::ZERO).is_ok());
+    }
+
+    #[test]
+    fn test_acquire_lock_waits_for_release() {
+        let temp_dir = TempDir::new().unwrap();
+        let lock_path = temp_dir.path().join("deploy.lock");
+
+        // Another job holds the lock briefly
+        let held = utils::acquire_lock(&lock_path, Duration::ZERO).unwrap();
+        let releaser = std::thread::spawn(move || {
+            std::thread::sleep(Duration::from_millis(300));
+            drop(held);
+        });
+
+        let started = std::time::Instant::now();
+        assert!(utils::acquire_lock(&lock_path, Duration::from_secs(5)).is_ok());
+        assert!(started.elapsed() >= Duration::from_millis(250));
+        assert!(started.elapsed() < Duration::from_secs(5));
+        releaser.join().unwrap();
+    }
+
+    // serve_http starts a server on a free local port that answers each request with the given
+    // status line and body, and returns its base URL
+    fn serve_http(status: &'static str, body: &'static str) -> String {
+        use std::io::{BufRead, BufReader, Write};
+        use std::net::TcpListener;
+
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let url = format!("http://{}", listener.local_addr().unwrap());
+        std::thread::spawn(move || {
+            for stream in listener.incoming() {
+                let Ok(mut stream) = stream else { break };
+                // Read the request headers before answering
+                let mut reader = BufReader::new(stream.try_clone().unwrap());
+                let mut line = String::new();
+                while reader.read_line(&mut line).map(|n| n > 0).unwrap_or(false) && line != "\r\n" {
+                    line.clear();
+                }
+                let response = format!(
+                    "HTTP/1.1 {}\r\nContent-Length: {}\r\nConnection: close\r\n\r\n{}",
+                    status,
+                    body.len(),
+                    body
+                );
+                let _ = stream.write_all(response.as_bytes());
+            }
+        });
+        url
+    }
+
+    #[test]
+    fn test_fetch_url() {
+        let url = serve_http("200 OK", "# AGENTS\n\nRemote content");
+        assert_eq!(utils::fetch_url(&url, 1_000).unwrap(), "# AGENTS\n\nRemote content");
+
+        // Bodies over the cap are refused
+        let err = utils::fetch_url(&url, 10).unwrap_err();
+        assert!(err.to_string().contains("larger than 10 bytes"));
+
+        // Non-success statuses are reported
+        let url = serve_http("404 Not Found", "missing");
+        let err = utils::fetch_url(&url, 1_000).unwrap_err();
+        assert!(err.to_string().contains("404"));
+
+        // So are connection failures
+        let closed = std::net::TcpListener::bind("127.0.0.1:0").unwrap();
+        let url = format!("http://{}", closed.local_addr().unwrap());
+        drop(closed);
+        let err = utils::fetch_url(&url, 1_000).unwrap_err();
+        assert!(err.to_string().contains("Could not fetch"));
+    }
+
+    #[test]
+    #[serial]
+    fn test_subprocess_timeout_setting() {
+        let _cleanup_timeout = defer::defer(|| {
+            utils::set_subprocess_timeout(utils::DEFAULT_SUBPROCESS_TIMEOUT);
+        });
+
+        utils::set_subprocess_timeout(Duration::from_secs(5));
+        assert_eq!(utils::subprocess_timeout(), Some(Duration::from_secs(5)));
+
+        // Zero disables the timeout
+        utils::set_subprocess_timeout(Duration::ZERO);
+        assert_eq!(utils::subprocess_timeout(), None);
+    }
+
+    #[test]
+    #[serial]
+    #[cfg(unix)]
+    fn test_clipboard_timeout() {
+        use std::os::unix::fs::PermissionsExt;
+
+        // A clipboard utility that hangs
+        let temp_dir = TempDir::new().unwrap();
+        for name in ["xclip", "pbcopy"] {
+            let stub = temp_dir.path().join(name);
+            fs::write(&stub, "#!/bin/sh\nsleep 5\n").unwrap();
+            fs::set_permissions(&stub, fs::Permissions::from_mode(0o755)).unwrap();
+        }
+
+        let original_path = env::var("PATH").unwrap_or_default();
+        env::set_var("PATH", format!("{}:{}", temp_dir.path().display(), original_path));
+        utils::set_subprocess_timeout(Duration::from_millis(200));
+
+        // Ensure cleanup happens
+        let _cleanup = defer::defer(move || {
+            env::set_var("PATH", original_path);
+            utils::set_subprocess_timeout(utils::DEFAULT_SUBPROCESS_TIMEOUT);
+        });
+
+        let started = std::time::Instant::now();
+        let err = utils::write_clipboard("# AGENTS").unwrap_err();
+        assert!(started.elapsed() < Duration::from_secs(4));
+
+        // The timeout is reported as its own error type
+        let timeout_err = err.downcast_ref::<utils::TimeoutError>();
+        assert!(timeout_err.is_some());
+        assert_eq!(timeout_err.unwrap().timeout, Duration::from_millis(200));
+        assert!(err.to_string().contains("timed out after"));
     }
 
     #[test]